@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	param_parser "flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/pb/master_pb"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/archive"
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	myutils "github.com/amazingchow/seaweedfs-tools/pkg/utils"
+)
+
+var (
+	_Dir = param_parser.String("dir",
+		"/mnt/locals/seeweedfsvolume/volume0/volume",
+		"backup directories, comma separated, same as the -dir of backup.")
+	_Collection = param_parser.String("collection",
+		"",
+		"collection to archive.")
+	_VolumeIds = param_parser.String("vid",
+		"",
+		"only archive these volumes if provided, comma separated.")
+	_OlderThan = param_parser.Duration("older_than",
+		0,
+		"only archive the volumes whose .dat has not been modified within this duration.")
+	_Output = param_parser.String("output",
+		"/mnt/locals/seeweedfsvolume/archive",
+		"directory to create the archive in, the archive is put into <collection>_<unix time> under it.")
+	_SegmentSize = param_parser.Int64("segment_size",
+		4096,
+		"uncompressed size of each segment in MB.")
+	_Compression = param_parser.String("compression",
+		archive.CompressionGzip,
+		"gzip, zstd or none.")
+	_Remove = param_parser.Bool("remove",
+		false,
+		"remove the archived volume files from the backup dirs after the archive is complete, only the volumes which no longer exist on -master_grpc are removed.")
+	_MasterGrpc = param_parser.String("master_grpc",
+		"",
+		"seaweedfs master server grpc endpoint of the primary cluster, required with -remove.")
+	_Verbose = param_parser.Bool("verbose",
+		false,
+		"verbose")
+)
+
+// 只归档volume本身的文件, 忽略.tmp等中间文件
+var archivedExts = map[string]bool{
+	".dat": true,
+	".idx": true,
+	".vif": true,
+	".enc": true,
+}
+
+func main() {
+	param_parser.Parse()
+
+	if *_Verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	if *_Collection == "" {
+		logrus.Fatal("please provide -collection")
+	}
+	if err := archive.CheckCompression(*_Compression); err != nil {
+		logrus.Fatal(err)
+	}
+	if *_Remove && *_MasterGrpc == "" {
+		logrus.Fatal("please provide -master_grpc to check which volumes can be removed")
+	}
+	vids, err := parseVolumeIds(*_VolumeIds)
+	if err != nil {
+		logrus.Fatalf("failed to parse -vid %s, err: %v", *_VolumeIds, err)
+	}
+
+	locations, err := location.NewDiskLocations(*_Dir)
+	if err != nil {
+		logrus.Fatalf("failed to load backup dirs %s, err: %v", *_Dir, err)
+	}
+	volumes, err := locations.Volumes()
+	if err != nil {
+		logrus.Fatalf("failed to list volumes in %s, err: %v", *_Dir, err)
+	}
+
+	var selected []location.LocalVolume
+	for _, v := range volumes {
+		if v.Collection != *_Collection {
+			continue
+		}
+		if len(vids) > 0 && !vids[v.Vid] {
+			continue
+		}
+		if *_OlderThan > 0 {
+			info, err := os.Stat(v.BaseFileName() + ".dat")
+			if err != nil {
+				logrus.Fatalf("failed to stat volume <%d>, err: %v", v.Vid, err)
+			}
+			if time.Since(info.ModTime()) < *_OlderThan {
+				logrus.Debugf("skip volume <%d> which was modified at %v", v.Vid, info.ModTime())
+				continue
+			}
+		}
+		selected = append(selected, v)
+	}
+	if len(selected) == 0 {
+		logrus.Warningf("no volume of collection <%s> to archive", *_Collection)
+		return
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Vid < selected[j].Vid
+	})
+
+	archiveDir := path.Join(*_Output, fmt.Sprintf("%s_%d", *_Collection, time.Now().Unix()))
+	w, err := archive.NewWriter(archiveDir, *_Collection, *_Compression, *_SegmentSize*1024*1024)
+	if err != nil {
+		logrus.Fatalf("failed to create archive %s, err: %v", archiveDir, err)
+	}
+	archivedFiles := make(map[uint32][]string)
+	for _, v := range selected {
+		files, err := v.Files()
+		if err != nil {
+			logrus.Fatalf("failed to list files of volume <%d>, err: %v", v.Vid, err)
+		}
+		var filenames []string
+		for _, f := range files {
+			if archivedExts[filepath.Ext(f)] {
+				filenames = append(filenames, f)
+			}
+		}
+		logrus.Debugf("archiving volume <%d> from %s", v.Vid, v.Dir)
+		if err = w.AddVolume(v.Vid, filenames); err != nil {
+			logrus.Fatalf("failed to archive volume <%d>, err: %v", v.Vid, err)
+		}
+		archivedFiles[v.Vid] = filenames
+	}
+	index, err := w.Close()
+	if err != nil {
+		logrus.Fatalf("failed to finish archive %s, err: %v", archiveDir, err)
+	}
+
+	var size int64
+	for _, sd := range index.Segments {
+		size += sd.Size
+	}
+	logrus.Infof("archived %d volumes of collection <%s> into %s, %d segments, %d bytes",
+		len(index.Volumes), *_Collection, archiveDir, len(index.Segments), size)
+
+	if *_Remove {
+		// 归档已经完整写入并fsync, 可以删除本地文件. 主集群中仍然存在的volume删除后会被backup重新全量拉取, 保留
+		alive := aliveVolumes()
+		for vid, filenames := range archivedFiles {
+			if alive[vid] {
+				logrus.Warningf("volume <%d> still exists on the master, keep its files, backup would copy it again otherwise", vid)
+				continue
+			}
+			for _, f := range filenames {
+				if err = os.Remove(f); err != nil {
+					logrus.Errorf("failed to remove %s of volume <%d>, err: %v", f, vid, err)
+				}
+			}
+		}
+		logrus.Infof("removed the archived volume files from %s", *_Dir)
+	}
+}
+
+// aliveVolumes returns the volumes of -collection which still exist on the master, including the erasure coded ones.
+func aliveVolumes() map[uint32]bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	// TODO: add more dial options
+	conn, err := grpc.Dial(*_MasterGrpc, grpc.WithInsecure())
+	if err != nil {
+		logrus.Fatalf("failed to connect to %s, err: %v", *_MasterGrpc, err)
+	}
+	defer conn.Close()
+	resp, err := master_pb.NewSeaweedClient(conn).VolumeList(ctx, &master_pb.VolumeListRequest{})
+	if err != nil {
+		logrus.Fatalf("failed to list volume info from %s, err: %v", *_MasterGrpc, err)
+	}
+	volumes := myutils.CollectVolumeInfo(resp.TopologyInfo, false)
+	ecVolumes := myutils.CollectEcVolumeInfo(resp.TopologyInfo)
+	if len(volumes) == 0 && len(ecVolumes) == 0 {
+		// 拿到一个空的拓扑更可能是master出了问题
+		logrus.Fatalf("master %s reports no volume at all, keep all the archived volume files", *_MasterGrpc)
+	}
+	alive := make(map[uint32]bool)
+	for _, vid := range append(volumes[*_Collection], ecVolumes[*_Collection]...) {
+		alive[vid] = true
+	}
+	return alive
+}
+
+func parseVolumeIds(s string) (map[uint32]bool, error) {
+	vids := make(map[uint32]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		vid, err := strconv.ParseUint(item, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		vids[uint32(vid)] = true
+	}
+	return vids, nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+
 	"github.com/chrislusf/seaweedfs/weed/operation"
 	"github.com/chrislusf/seaweedfs/weed/security"
 	"github.com/chrislusf/seaweedfs/weed/storage"
@@ -8,12 +10,23 @@ import (
 	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
 	"github.com/chrislusf/seaweedfs/weed/util"
 	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/cryptvolume"
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	myutils "github.com/amazingchow/seaweedfs-tools/pkg/utils"
+)
+
+var (
+	ErrEncryptionMismatch = errors.New("local volume is not encrypted the same way as required by -encrypt")
 )
 
 type Backup struct {
-	Dir         string
+	Locations   *location.DiskLocations
 	Master      string
 	Replication string
+	FullCopy    bool
+	// 不为空时加密备份needle数据
+	CipherKey myutils.CipherKey
 }
 
 func (bk *Backup) Do(collection string, volumeId uint32) error {
@@ -36,6 +49,13 @@ func (bk *Backup) Do(collection string, volumeId uint32) error {
 		return err
 	}
 
+	// find the backup dir which holds or is going to hold the volume
+	dir, err := bk.Locations.Locate(collection, volumeId, status.TailOffset+status.IdxFileSize)
+	if err != nil {
+		logrus.Errorf("failed to locate volume <%d>, err: %v", vid, err)
+		return err
+	}
+
 	ttl, err := needle.ReadTTL(status.Ttl)
 	if err != nil {
 		logrus.Errorf("failed to get volume <%d> ttl, err: %v", vid, err)
@@ -57,13 +77,37 @@ func (bk *Backup) Do(collection string, volumeId uint32) error {
 		}
 	}
 
-	volume, err := storage.NewVolume(bk.Dir, collection, vid, storage.NeedleMapInMemory, replication, ttl, 0, 0)
+	// 加密备份不能直接拷贝文件, 也不能在本地compact, 单独处理
+	if bk.CipherKey != nil {
+		err = bk.encryptedSync(volumeServer, grpcDialOption, dir, collection, volumeId, status, replication)
+		if err != nil && err != ErrEncryptionMismatch {
+			logrus.Errorf("failed to sync encrypted volume <%d>, err: %v", vid, err)
+		}
+		return err
+	}
+	if cryptvolume.IsEncrypted(storage.VolumeFileName(dir, collection, int(volumeId))) {
+		return ErrEncryptionMismatch
+	}
+
+	// brand-new volume, copy the whole files instead of replaying every needle
+	if _, exists := bk.Locations.Find(collection, volumeId); !exists && bk.FullCopy {
+		if err = bk.fullCopy(volumeServer, grpcDialOption, dir, collection, volumeId); err != nil {
+			logrus.Errorf("failed to full copy volume <%d>, err: %v", vid, err)
+			return err
+		}
+	}
+
+	volume, err := openVolume(dir, collection, vid, replication, ttl)
 	if err != nil {
 		logrus.Errorf("failed to create or read from volume <%d>, err: %v", vid, err)
 		return err
 	}
 
 	if volume.SuperBlock.CompactionRevision < uint16(status.CompactRevision) {
+		if err = bk.forgetHashes(volume.FileName()); err != nil {
+			volume.Close()
+			return err
+		}
 		if err = volume.Compact2(30 * 1024 * 1024 * 1024); err != nil {
 			logrus.Errorf("failed to compact volume before sync, err: %v", err)
 			return err
@@ -79,10 +123,21 @@ func (bk *Backup) Do(collection string, volumeId uint32) error {
 	datSize, _, _ := volume.FileStat()
 
 	if datSize > status.TailOffset {
+		if err = bk.forgetHashes(volume.FileName()); err != nil {
+			volume.Close()
+			return err
+		}
 		// remove the old data
 		volume.Destroy()
-		// recreate an empty volume
-		volume, err = storage.NewVolume(bk.Dir, collection, vid, storage.NeedleMapInMemory, replication, ttl, 0, 0)
+		// pull the whole volume again
+		if bk.FullCopy {
+			if err = bk.fullCopy(volumeServer, grpcDialOption, dir, collection, volumeId); err != nil {
+				logrus.Errorf("failed to full copy volume <%d>, err: %v", vid, err)
+				return err
+			}
+		}
+		// recreate an empty volume, or open the full copied one
+		volume, err = openVolume(dir, collection, vid, replication, ttl)
 		if err != nil {
 			logrus.Errorf("failed to create or read from volume <%d>, err: %v", vid, err)
 			return err
@@ -97,3 +152,16 @@ func (bk *Backup) Do(collection string, volumeId uint32) error {
 
 	return nil
 }
+
+func openVolume(dir, collection string, vid needle.VolumeId, replication *super_block.ReplicaPlacement, ttl *needle.TTL) (*storage.Volume, error) {
+	volume, err := storage.NewVolume(dir, collection, vid, storage.NeedleMapInMemory, replication, ttl, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if volume.SuperBlock.ReplicaPlacement.Byte() != replication.Byte() {
+		// the full copied super block carries the replication of the source volume
+		volume.SuperBlock.ReplicaPlacement = replication
+		volume.DataBackend.WriteAt(volume.SuperBlock.Bytes(), 0)
+	}
+	return volume, nil
+}
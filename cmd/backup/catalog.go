@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	catalogFile = "backup.catalog"
+)
+
+// 备份目录的操作记录, 每行一条json记录, 只追加不修改
+type Catalog struct {
+	filename string
+}
+
+type CatalogRecord struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Collection string    `json:"collection"`
+	VolumeId   uint32    `json:"volume_id"`
+	Dir        string    `json:"dir"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+func NewCatalog(dir string) *Catalog {
+	return &Catalog{filename: path.Join(dir, catalogFile)}
+}
+
+func (c *Catalog) Append(record *CatalogRecord) error {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(c.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
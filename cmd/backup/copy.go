@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/chrislusf/seaweedfs/weed/storage"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/volumecopy"
+)
+
+// fullCopy fetches the .dat, .idx and .vif files of a volume through the CopyFile stream.
+// It is much faster than replaying every needle with IncrementalBackup, and the volume can
+// switch to incremental sync afterwards.
+func (bk *Backup) fullCopy(volumeServer string, grpcDialOption grpc.DialOption, dir, collection string, volumeId uint32) error {
+	baseFileName := storage.VolumeFileName(dir, collection, int(volumeId))
+	if err := bk.forgetHashes(baseFileName); err != nil {
+		return err
+	}
+	status, err := volumecopy.Copy(volumeServer, grpcDialOption, baseFileName, collection, volumeId)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("full copied volume <%d> from %s, dat size %d, idx size %d",
+		volumeId, volumeServer, status.DatFileSize, status.IdxFileSize)
+	return nil
+}
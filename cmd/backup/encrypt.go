@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/chrislusf/seaweedfs/weed/operation"
+	"github.com/chrislusf/seaweedfs/weed/pb/volume_server_pb"
+	"github.com/chrislusf/seaweedfs/weed/storage"
+	"github.com/chrislusf/seaweedfs/weed/storage/backend"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/cryptvolume"
+	"github.com/amazingchow/seaweedfs-tools/pkg/volumecopy"
+)
+
+// encryptedSync pulls the needles appended since the last sync through VolumeIncrementalCopy,
+// encrypts their data and appends them to the local volume. The local offsets differ from the
+// source ones, so the position on the source is tracked by the .enc state file instead.
+func (bk *Backup) encryptedSync(volumeServer string, grpcDialOption grpc.DialOption, dir, collection string, volumeId uint32,
+	status *volume_server_pb.VolumeSyncStatusResponse, replication *super_block.ReplicaPlacement) error {
+	baseFileName := storage.VolumeFileName(dir, collection, int(volumeId))
+
+	state, err := cryptvolume.LoadState(baseFileName)
+	if err != nil {
+		return fmt.Errorf("failed to load %s%s, err: %v", baseFileName, cryptvolume.StateFileExt, err)
+	}
+	_, datErr := os.Stat(baseFileName + ".dat")
+	if state == nil && datErr == nil {
+		return ErrEncryptionMismatch
+	}
+	if state != nil && os.IsNotExist(datErr) {
+		// 上一次创建volume时中断
+		state = nil
+	}
+	if state != nil && (state.CompactRevision != status.CompactRevision || state.SourceTailOffset > status.TailOffset) {
+		// 主集群compact之后offset和needle顺序都发生了变化, 只能重新同步
+		logrus.Infof("volume <%d> was compacted on %s, pull the whole volume again", volumeId, volumeServer)
+		bk.removeVolumeFiles(baseFileName)
+		state = nil
+	}
+	if state == nil {
+		if state, err = bk.createEncryptedVolume(volumeServer, grpcDialOption, baseFileName, collection, volumeId, status, replication); err != nil {
+			return err
+		}
+	}
+	if state.SourceTailOffset == status.TailOffset {
+		return nil
+	}
+
+	datFile, err := os.OpenFile(baseFileName+".dat", os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	datBackend := backend.NewDiskFile(datFile)
+	defer datBackend.Close()
+	idxFile, err := os.OpenFile(baseFileName+".idx", os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer idxFile.Close()
+
+	// 丢弃上一次同步中断时写入的数据, 它们会在本次被重新同步
+	if err = datBackend.Truncate(int64(state.LocalDatSize)); err != nil {
+		return err
+	}
+	if err = idxFile.Truncate(int64(state.LocalIdxSize)); err != nil {
+		return err
+	}
+
+	sb, err := super_block.ReadSuperBlock(datBackend)
+	if err != nil {
+		return err
+	}
+	version := sb.Version
+
+	var synced, needles uint64
+	err = operation.WithVolumeServerClient(volumeServer, grpcDialOption, func(client volume_server_pb.VolumeServerClient) error {
+		stream, err := client.VolumeIncrementalCopy(context.Background(), &volume_server_pb.VolumeIncrementalCopyRequest{
+			VolumeId: volumeId,
+			SinceNs:  state.LastAppendAtNs,
+		})
+		if err != nil {
+			return err
+		}
+
+		// 数据流不按needle切分, 攒够一个完整的needle再处理
+		var pending []byte
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			pending = append(pending, resp.FileContent...)
+			for len(pending) >= types.NeedleHeaderSize {
+				n := new(needle.Needle)
+				n.ParseNeedleHeader(pending)
+				total := types.NeedleHeaderSize + needle.NeedleBodyLength(n.Size, version)
+				if int64(len(pending)) < total {
+					break
+				}
+				if err = n.ReadBytes(pending[:total], int64(state.SourceTailOffset+synced), n.Size, version); err != nil {
+					return err
+				}
+				if err = bk.appendEncryptedNeedle(datBackend, idxFile, n, version); err != nil {
+					return err
+				}
+				synced += uint64(total)
+				needles++
+				state.LastAppendAtNs = n.AppendAtNs
+				pending = pending[total:]
+			}
+		}
+		if len(pending) > 0 {
+			// 主集群正在写入的needle, 下一次再同步
+			logrus.Debugf("volume <%d> got %d bytes of an incomplete needle, leave them to the next sync", volumeId, len(pending))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = datFile.Sync(); err != nil {
+		return err
+	}
+	if err = idxFile.Sync(); err != nil {
+		return err
+	}
+	datSize, _, err := datBackend.GetStat()
+	if err != nil {
+		return err
+	}
+	idxInfo, err := idxFile.Stat()
+	if err != nil {
+		return err
+	}
+	state.SourceTailOffset += synced
+	state.LocalDatSize = uint64(datSize)
+	state.LocalIdxSize = uint64(idxInfo.Size())
+	if err = cryptvolume.SaveState(baseFileName, state); err != nil {
+		return err
+	}
+	logrus.Infof("encrypted %d needles of volume <%d>, source tail offset %d", needles, volumeId, state.SourceTailOffset)
+	return nil
+}
+
+func (bk *Backup) appendEncryptedNeedle(datBackend *backend.DiskFile, idxFile *os.File, n *needle.Needle, version needle.Version) error {
+	// 与seaweedfs重建索引时的处理方式一致, 大小为0的needle是删除记录
+	deleted := n.Size == 0 || n.Size == types.TombstoneFileSize
+	if !deleted {
+		if err := cryptvolume.EncryptNeedle(n, bk.CipherKey); err != nil {
+			return err
+		}
+	}
+	offset, _, _, err := n.Append(datBackend, version)
+	if err != nil {
+		return err
+	}
+	size := n.Size
+	if deleted {
+		size = types.TombstoneFileSize
+	}
+	_, err = idxFile.Write(needle_map.ToBytes(n.Id, types.ToOffset(int64(offset)), size))
+	return err
+}
+
+// createEncryptedVolume creates an empty local volume with the super block of the source volume.
+func (bk *Backup) createEncryptedVolume(volumeServer string, grpcDialOption grpc.DialOption, baseFileName, collection string, volumeId uint32,
+	status *volume_server_pb.VolumeSyncStatusResponse, replication *super_block.ReplicaPlacement) (*cryptvolume.State, error) {
+	if err := bk.forgetHashes(baseFileName); err != nil {
+		return nil, err
+	}
+	tmpFile := baseFileName + ".dat" + volumecopy.CopyingSuffix
+	defer os.Remove(tmpFile)
+
+	var sb []byte
+	err := operation.WithVolumeServerClient(volumeServer, grpcDialOption, func(client volume_server_pb.VolumeServerClient) error {
+		f := volumecopy.File{Ext: ".dat", StopOffset: super_block.SuperBlockSize}
+		for {
+			if _, err := volumecopy.CopyFile(client, collection, volumeId, status.CompactRevision, f, tmpFile); err != nil {
+				return err
+			}
+			data, err := ioutil.ReadFile(tmpFile)
+			if err != nil {
+				return err
+			}
+			if uint64(len(data)) != f.StopOffset {
+				return fmt.Errorf("super block is incomplete, copied %d of %d bytes", len(data), f.StopOffset)
+			}
+			extraSize := uint64(binary.BigEndian.Uint16(data[6:8]))
+			if f.StopOffset == super_block.SuperBlockSize+extraSize {
+				sb = data
+				return nil
+			}
+			// 带有extra数据的super block
+			f.StopOffset = super_block.SuperBlockSize + extraSize
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy the super block of volume <%d>, err: %v", volumeId, err)
+	}
+	if needle.Version(sb[0]) != needle.Version3 {
+		return nil, fmt.Errorf("volume <%d> of version %d has no append timestamp, can not be synced incrementally", volumeId, sb[0])
+	}
+	sb[1] = replication.Byte()
+
+	if err = ioutil.WriteFile(tmpFile, sb, 0644); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(baseFileName+".idx", nil, 0644); err != nil {
+		return nil, err
+	}
+	// .enc先于.dat落盘, 保证存在.dat的加密volume一定有.enc
+	state := &cryptvolume.State{
+		SourceTailOffset: uint64(len(sb)),
+		CompactRevision:  status.CompactRevision,
+		LocalDatSize:     uint64(len(sb)),
+	}
+	if err = cryptvolume.SaveState(baseFileName, state); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmpFile, baseFileName+".dat"); err != nil {
+		return nil, err
+	}
+	logrus.Infof("created encrypted volume %s.dat", baseFileName)
+	return state, nil
+}
+
+// removeVolumeFiles removes the files of a volume to pull it again.
+func (bk *Backup) removeVolumeFiles(baseFileName string) {
+	_ = bk.forgetHashes(baseFileName)
+	_ = os.Remove(baseFileName + ".dat")
+	_ = os.Remove(baseFileName + ".idx")
+	_ = os.Remove(baseFileName + cryptvolume.StateFileExt)
+}
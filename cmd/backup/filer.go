@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/pb"
+	"github.com/chrislusf/seaweedfs/weed/pb/filer_pb"
+	"github.com/chrislusf/seaweedfs/weed/security"
+	"github.com/chrislusf/seaweedfs/weed/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/filermeta"
+)
+
+type FilerBackup struct {
+	Dir       string
+	FilerGrpc string
+	Root      string
+	// 保留最近的Keep个导出文件, 0表示全部保留
+	Keep int
+}
+
+func (fb *FilerBackup) Do() error {
+	util.LoadConfiguration("security", false)
+	grpcDialOption := security.LoadClientTLS(util.GetViper(), "grpc.client")
+
+	// 每次都全量导出, 重命名和删除无法从entry的属性中判断
+	filename := filerMetaFile(time.Now().Unix())
+	tmpFile := path.Join(fb.Dir, filename+".tmp")
+	file, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		logrus.Errorf("failed to create filer meta file %s, err: %v", tmpFile, err)
+		return err
+	}
+
+	var res *filermeta.ExportResult
+	err = pb.WithGrpcFilerClient(fb.FilerGrpc, grpcDialOption, func(client filer_pb.SeaweedFilerClient) error {
+		var exportErr error
+		res, exportErr = filermeta.Export(client, fb.Root, file)
+		return exportErr
+	})
+	if err == nil {
+		err = file.Sync()
+	}
+	_ = file.Close()
+	if err != nil {
+		_ = os.Remove(tmpFile)
+		logrus.Errorf("failed to export filer meta from %s, err: %v", fb.FilerGrpc, err)
+		return err
+	}
+	if err = os.Rename(tmpFile, path.Join(fb.Dir, filename)); err != nil {
+		_ = os.Remove(tmpFile)
+		logrus.Errorf("failed to rename filer meta file %s, err: %v", tmpFile, err)
+		return err
+	}
+
+	logrus.Infof("exported filer meta into %s, %d dirs + %d files",
+		path.Join(fb.Dir, filename), res.Directories, res.Files)
+
+	// 清理失败不影响本次导出
+	if err = fb.prune(); err != nil {
+		logrus.Warningf("failed to remove old filer meta files, err: %v", err)
+	}
+	return nil
+}
+
+// prune removes the oldest exports beyond fb.Keep.
+func (fb *FilerBackup) prune() error {
+	if fb.Keep <= 0 {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(fb.Dir)
+	if err != nil {
+		return err
+	}
+	var exports []int64
+	for _, info := range infos {
+		var ts int64
+		if n, _ := fmt.Sscanf(info.Name(), "filer_meta_%d_full.swfm", &ts); n != 1 || info.Name() != filerMetaFile(ts) {
+			continue
+		}
+		exports = append(exports, ts)
+	}
+	sort.Slice(exports, func(i, j int) bool { return exports[i] < exports[j] })
+	for len(exports) > fb.Keep {
+		filename := path.Join(fb.Dir, filerMetaFile(exports[0]))
+		if err = os.Remove(filename); err != nil {
+			return err
+		}
+		logrus.Infof("removed filer meta file %s", filename)
+		exports = exports[1:]
+	}
+	return nil
+}
+
+func filerMetaFile(ts int64) string {
+	return fmt.Sprintf("filer_meta_%d_full.swfm", ts)
+}
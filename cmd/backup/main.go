@@ -4,25 +4,33 @@ import (
 	"context"
 	param_parser "flag"
 	"os"
-	"path"
-	"strconv"
 	"time"
 
 	"github.com/cenkalti/backoff"
 	"github.com/chrislusf/seaweedfs/weed/pb/master_pb"
+	"github.com/chrislusf/seaweedfs/weed/storage"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/manifest"
+	"github.com/amazingchow/seaweedfs-tools/pkg/shard"
 	myutils "github.com/amazingchow/seaweedfs-tools/pkg/utils"
 )
 
 var (
 	_Dir = param_parser.String("dir",
 		"/mnt/locals/seeweedfsvolume/volume0/volume",
-		"directory to store volume data files, the .idx and .dat files should already exist inside the dir.")
+		"directories to store volume data files, comma separated, e.g. /disk1/volume,/disk2/volume. new volumes go to the dir with the most free space.")
 	_Replication = param_parser.String("replica",
 		"000",
 		"seaweedfs volume server replication parameter")
+	_FullCopy = param_parser.Bool("full_copy",
+		true,
+		"copy the whole .dat/.idx/.vif files for brand-new or fully re-pulled volumes instead of replaying every needle")
+	_Encrypt = param_parser.Bool("encrypt",
+		false,
+		"encrypt the needle data with the AES key from the ENCRYPTION_KEY env before writing them into the backup dirs")
 	_SkipReadOnly = param_parser.Bool("skip_read_only",
 		false,
 		"skip read-only volumes")
@@ -32,6 +40,42 @@ var (
 	_MasterGrpc = param_parser.String("master_grpc",
 		"localhost:19333",
 		"seaweedfs master server grpc endpoint")
+	_OrphanPolicy = param_parser.String("orphan_policy",
+		OrphanPolicyKeep,
+		"what to do with the local volumes which no longer exist on the master, keep, archive (move into the tombstoned subfolder) or prune")
+	_OrphanGrace = param_parser.Duration("orphan_grace",
+		7*24*time.Hour,
+		"how long a volume must have been missing on the master before it gets archived or pruned")
+	_ShardIndex = param_parser.Int("shard_index",
+		0,
+		"index of this backup host among all the backup hosts, starts from 0")
+	_ShardCount = param_parser.Int("shard_count",
+		1,
+		"number of backup hosts sharing the volumes, volumes are assigned by consistent hashing of (collection, vid)")
+	_ShardHosts = param_parser.String("shard_hosts",
+		"",
+		"optional comma separated backup host names, the i-th one is the host of shard i, only used by -status")
+	_AffinityDC = param_parser.String("affinity_dc",
+		"",
+		"optional comma separated data centers, only backup the volumes which have a replica inside them")
+	_Status = param_parser.Bool("status",
+		false,
+		"print the owner of each volume and exit without backing up")
+	_MasterMeta = param_parser.Bool("master_meta",
+		true,
+		"save the master meta (configuration, collections, max volume id, file key, topology) needed by seeder to set up a standby master")
+	_ManifestKey = param_parser.String("manifest_key",
+		"",
+		"ed25519 private key in PKCS#8 PEM format, sign a manifest of all the local volumes after backup if provided")
+	_FilerGrpc = param_parser.String("filer_grpc",
+		"",
+		"seaweedfs filer server grpc endpoint, export filer meta alongside volume data if provided")
+	_FilerPath = param_parser.String("filer_path",
+		"/",
+		"root of the filer namespace to export")
+	_FilerMetaKeep = param_parser.Int("filer_meta_keep",
+		7,
+		"keep the latest n filer meta exports and remove the older ones, 0 keeps all of them")
 	_Verbose = param_parser.Bool("verbose",
 		false,
 		"verbose")
@@ -44,6 +88,16 @@ func main() {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
+	sharding, err := shard.NewSharding(*_ShardIndex, *_ShardCount, *_ShardHosts, *_AffinityDC)
+	if err != nil {
+		logrus.Fatalf("failed to set up sharding, err: %v", err)
+	}
+
+	locations, err := location.NewDiskLocations(*_Dir)
+	if err != nil {
+		logrus.Fatalf("failed to load backup dirs %s, err: %v", *_Dir, err)
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
 	// TODO: add more dial options
@@ -61,23 +115,72 @@ func main() {
 
 	// fetch collection + volume id pairs
 	collectionMap := myutils.CollectVolumeInfo(resp.TopologyInfo, *_SkipReadOnly)
+	dcMap := myutils.CollectVolumeDataCenters(resp.TopologyInfo)
+	if *_Status {
+		if err = sharding.PrintStatus(os.Stdout, collectionMap, dcMap, locations); err != nil {
+			logrus.Fatalf("failed to print status, err: %v", err)
+		}
+		return
+	}
+	// only keep the volumes owned by this backup host
+	collectionMap = sharding.Filter(collectionMap, dcMap)
+
+	// master元数据很小, 先于volume数据保存, 避免被volume同步失败影响
+	if *_MasterMeta {
+		mb := &MasterBackup{
+			Dir:       locations.Dirs[0],
+			Master:    *_MasterHttp,
+			Client:    client,
+			Catalog:   NewCatalog(locations.Dirs[0]),
+			Locations: locations,
+		}
+		if err = mb.Do(resp); err != nil {
+			logrus.Fatalf("failed to backup master meta from <%s>, err: %v", *_MasterGrpc, err)
+		}
+	}
+
+	// 检查主集群中已经被删除的volume, 需要使用包括只读volume在内的完整拓扑,
+	// 已经转为ec的volume只出现在ec shard中, 同样不是orphan
+	alive := myutils.CollectVolumeInfo(resp.TopologyInfo, false)
+	for collection, vids := range myutils.CollectEcVolumeInfo(resp.TopologyInfo) {
+		alive[collection] = append(alive[collection], vids...)
+	}
+	oh := &OrphanHandler{
+		Locations: locations,
+		Catalog:   NewCatalog(locations.Dirs[0]),
+		Policy:    *_OrphanPolicy,
+		Grace:     *_OrphanGrace,
+	}
+	if err = oh.Do(alive); err != nil {
+		logrus.Fatalf("failed to handle orphan volumes, err: %v", err)
+	}
 
 	bk := &Backup{
-		Dir:         *_Dir,
+		Locations:   locations,
 		Master:      *_MasterHttp,
 		Replication: *_Replication,
+		FullCopy:    *_FullCopy,
+	}
+	if *_Encrypt {
+		if bk.CipherKey, err = myutils.GetCipherKey(); err != nil {
+			logrus.Fatal(err)
+		}
 	}
 	for collection, vids := range collectionMap {
 		for _, vid := range vids {
 			retries := 0
 			operation := func() error {
 				if err := bk.Do(collection, vid); err != nil {
+					if err == location.ErrNoFreeSpace || err == ErrEncryptionMismatch {
+						// 空间不足或者加密方式不一致时重试没有意义, 也不能删除已有的备份数据
+						return backoff.Permanent(err)
+					}
 					logrus.Warningf("failed to sync with master <%s>, retry=%d, err: %v", *_MasterHttp, retries, err)
-					idxFileName := path.Join(*_Dir, collection+"_"+strconv.Itoa(int(vid))+".idx")
-					datFileName := path.Join(*_Dir, collection+"_"+strconv.Itoa(int(vid))+".dat")
-					logrus.Infof("delete %s and %s and pull again\n", idxFileName, datFileName)
-					_ = os.Remove(idxFileName)
-					_ = os.Remove(datFileName)
+					if dir, ok := locations.Find(collection, vid); ok {
+						baseFileName := storage.VolumeFileName(dir, collection, int(vid))
+						logrus.Infof("delete %s.idx and %s.dat and pull again\n", baseFileName, baseFileName)
+						bk.removeVolumeFiles(baseFileName)
+					}
 					retries++
 					return err
 				}
@@ -85,15 +188,47 @@ func main() {
 			}
 			notify := func(e error, t time.Duration) {
 				if e != nil {
-					logrus.Infof("will retry in %d secs", t.Seconds())
+					logrus.Infof("will retry in %.0f secs", t.Seconds())
 				}
 			}
 			err = backoff.RetryNotify(operation, NewBackoffConfig(), notify)
+			if err == location.ErrNoFreeSpace || err == ErrEncryptionMismatch {
+				logrus.Errorf("refuse to backup volume <%d>, err: %v", vid, err)
+				continue
+			}
 			if err != nil {
 				logrus.Fatalf("failed to sync with master <%s>, err: %v", *_MasterHttp, err)
 			}
 		}
 	}
+
+	if *_FilerGrpc != "" {
+		fb := &FilerBackup{
+			Dir:       locations.Dirs[0],
+			FilerGrpc: *_FilerGrpc,
+			Root:      *_FilerPath,
+			Keep:      *_FilerMetaKeep,
+		}
+		if err = fb.Do(); err != nil {
+			logrus.Fatalf("failed to backup filer meta from <%s>, err: %v", *_FilerGrpc, err)
+		}
+	}
+
+	// manifest覆盖本次备份的所有数据, 放在最后生成
+	if *_ManifestKey != "" {
+		key, err := manifest.LoadPrivateKey(*_ManifestKey)
+		if err != nil {
+			logrus.Fatalf("failed to load manifest key %s, err: %v", *_ManifestKey, err)
+		}
+		mw := &ManifestWriter{
+			Locations:  locations,
+			Catalog:    NewCatalog(locations.Dirs[0]),
+			PrivateKey: key,
+		}
+		if err = mw.Do(); err != nil {
+			logrus.Fatalf("failed to write manifest, err: %v", err)
+		}
+	}
 }
 
 func NewBackoffConfig() backoff.BackOff {
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/backend"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/cryptvolume"
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/manifest"
+)
+
+// 在每次备份结束后生成一份签名的manifest
+type ManifestWriter struct {
+	Locations  *location.DiskLocations
+	Catalog    *Catalog
+	PrivateKey ed25519.PrivateKey
+}
+
+func (mw *ManifestWriter) Do() error {
+	dir := path.Join(mw.Locations.Dirs[0], manifest.Dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	m := &manifest.Manifest{Time: time.Now()}
+	files, err := manifest.List(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		prev, raw, err := manifest.Load(files[len(files)-1])
+		if err != nil {
+			logrus.Errorf("failed to load the previous manifest %s, err: %v", files[len(files)-1], err)
+			return err
+		}
+		m.Sequence = prev.Sequence + 1
+		m.PrevSha256 = manifest.Sha256Hex(raw)
+	}
+
+	cache, err := manifest.LoadHashCache(dir)
+	if err != nil {
+		return err
+	}
+	volumes, err := mw.Locations.Volumes()
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		vd, err := digestVolume(cache, v)
+		if err != nil {
+			logrus.Errorf("failed to digest volume <%d> in %s, err: %v", v.Vid, v.Dir, err)
+			return err
+		}
+		m.Volumes = append(m.Volumes, vd)
+	}
+
+	if err = m.Sign(mw.PrivateKey); err != nil {
+		return err
+	}
+	filename, err := manifest.Save(dir, m)
+	if err != nil {
+		logrus.Errorf("failed to save manifest into %s, err: %v", dir, err)
+		return err
+	}
+	if err = cache.Save(); err != nil {
+		logrus.Warningf("failed to save hash cache, err: %v", err)
+	}
+	logrus.Infof("saved manifest %s of %d volumes", filename, len(m.Volumes))
+
+	err = mw.Catalog.Append(&CatalogRecord{
+		Action: "manifest",
+		Dir:    dir,
+		Detail: path.Base(filename),
+	})
+	if err != nil {
+		logrus.Errorf("failed to append manifest record into catalog, err: %v", err)
+	}
+	return nil
+}
+
+// digestVolume hashes the .dat and .idx of v up to the synced offset.
+func digestVolume(cache *manifest.HashCache, v location.LocalVolume) (*manifest.VolumeDigest, error) {
+	baseFileName := v.BaseFileName()
+	vd := &manifest.VolumeDigest{Collection: v.Collection, VolumeId: v.Vid, Dir: v.Dir}
+
+	state, err := cryptvolume.LoadState(baseFileName)
+	if err != nil {
+		return nil, err
+	}
+	if state != nil {
+		// 加密volume中超出已同步位置的数据会在下一次同步时被丢弃
+		vd.Dat.Size, vd.Idx.Size = int64(state.LocalDatSize), int64(state.LocalIdxSize)
+	} else {
+		for _, f := range []struct {
+			ext string
+			fd  *manifest.FileDigest
+		}{{".dat", &vd.Dat}, {".idx", &vd.Idx}} {
+			info, err := os.Stat(baseFileName + f.ext)
+			if err != nil {
+				return nil, err
+			}
+			f.fd.Size = info.Size()
+		}
+	}
+
+	revision, err := readCompactionRevision(baseFileName + ".dat")
+	if err != nil {
+		return nil, err
+	}
+	if vd.Dat.Sha256, err = cache.HashFile(baseFileName+".dat", vd.Dat.Size, revision); err != nil {
+		return nil, err
+	}
+	if vd.Idx.Sha256, err = cache.HashFile(baseFileName+".idx", vd.Idx.Size, revision); err != nil {
+		return nil, err
+	}
+	return vd, nil
+}
+
+func readCompactionRevision(datFileName string) (uint16, error) {
+	file, err := os.Open(datFileName)
+	if err != nil {
+		return 0, err
+	}
+	datBackend := backend.NewDiskFile(file)
+	defer datBackend.Close()
+	sb, err := super_block.ReadSuperBlock(datBackend)
+	if err != nil {
+		return 0, err
+	}
+	return sb.CompactionRevision, nil
+}
+
+// forgetHashes drops the cached hash states of a volume before its files are destroyed, copied again or compacted.
+func (bk *Backup) forgetHashes(baseFileName string) error {
+	err := manifest.ForgetHashes(path.Join(bk.Locations.Dirs[0], manifest.Dir), baseFileName)
+	if err != nil {
+		logrus.Errorf("failed to drop the cached hashes of %s, err: %v", baseFileName, err)
+	}
+	return err
+}
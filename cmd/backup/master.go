@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/pb/master_pb"
+	"github.com/chrislusf/seaweedfs/weed/storage/idx"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/mastermeta"
+)
+
+// 保存master的元数据, 使得备用master不会重复分配主集群已经用过的volume id和file key
+type MasterBackup struct {
+	Dir     string
+	Master  string
+	Client  master_pb.SeaweedClient
+	Catalog *Catalog
+	// 从备份的.idx中得到最大的file key
+	Locations *location.DiskLocations
+}
+
+func (mb *MasterBackup) Do(volumeList *master_pb.VolumeListResponse) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	meta := &mastermeta.MasterMeta{
+		Time:              time.Now(),
+		Master:            mb.Master,
+		VolumeSizeLimitMB: volumeList.VolumeSizeLimitMb,
+	}
+
+	conf, err := mb.Client.GetMasterConfiguration(ctx, &master_pb.GetMasterConfigurationRequest{})
+	if err != nil {
+		logrus.Errorf("failed to get master configuration, err: %v", err)
+		return err
+	}
+	meta.MetricsAddress = conf.MetricsAddress
+	meta.MetricsIntervalSeconds = conf.MetricsIntervalSeconds
+
+	collections, err := mb.Client.CollectionList(ctx, &master_pb.CollectionListRequest{
+		IncludeNormalVolumes: true,
+		IncludeEcVolumes:     true,
+	})
+	if err != nil {
+		logrus.Errorf("failed to list collections, err: %v", err)
+		return err
+	}
+	for _, c := range collections.Collections {
+		meta.Collections = append(meta.Collections, c.Name)
+	}
+
+	meta.CollectVolumes(volumeList.TopologyInfo)
+	meta.MaxFileKey, err = mb.maxFileKey()
+	if err != nil {
+		// 拿不到file key时依然保存其余的元数据, 由seeder使用足够大的余量
+		logrus.Warningf("failed to read the max file key of the backed-up volumes, err: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err = (&jsonpb.Marshaler{}).Marshal(&buf, volumeList.TopologyInfo); err != nil {
+		logrus.Errorf("failed to marshal topology, err: %v", err)
+		return err
+	}
+	meta.Topology = buf.Bytes()
+
+	filename, err := mastermeta.Save(mb.Dir, meta)
+	if err != nil {
+		logrus.Errorf("failed to save master meta into %s, err: %v", mb.Dir, err)
+		return err
+	}
+	logrus.Infof("saved master meta into %s, max volume id: %d, max file key: %d, %d collections",
+		filename, meta.MaxVolumeId, meta.MaxFileKey, len(meta.Collections))
+
+	err = mb.Catalog.Append(&CatalogRecord{
+		Action: "master_meta",
+		Dir:    mb.Dir,
+		Detail: path.Base(filename),
+	})
+	if err != nil {
+		logrus.Errorf("failed to append master_meta record into catalog, err: %v", err)
+	}
+	return nil
+}
+
+// maxFileKey returns the largest needle key in the .idx files of the backed-up volumes.
+// master没有提供只读的接口读取sequencer, 申请fid会写入主集群, 所以只使用备份中已有的数据,
+// 之后主集群新分配的file key由seeder的-file_key_margin覆盖.
+func (mb *MasterBackup) maxFileKey() (uint64, error) {
+	volumes, err := mb.Locations.Volumes()
+	if err != nil {
+		return 0, err
+	}
+	var maxKey types.NeedleId
+	for _, v := range volumes {
+		idxFile, err := os.Open(v.BaseFileName() + ".idx")
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = idx.WalkIndexFile(idxFile, func(key types.NeedleId, _ types.Offset, _ uint32) error {
+			if key > maxKey {
+				maxKey = key
+			}
+			return nil
+		})
+		_ = idxFile.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s, err: %v", v.BaseFileName()+".idx", err)
+		}
+	}
+	return uint64(maxKey), nil
+}
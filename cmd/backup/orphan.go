@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+)
+
+const (
+	OrphanPolicyKeep    = "keep"
+	OrphanPolicyArchive = "archive"
+	OrphanPolicyPrune   = "prune"
+
+	orphanStateFile = "orphan_volumes.state"
+	tombstonedDir   = "tombstoned"
+)
+
+// 处理在主集群中已经被删除, 但仍然残留在备份目录中的volume
+type OrphanHandler struct {
+	Locations *location.DiskLocations
+	Catalog   *Catalog
+	Policy    string
+	Grace     time.Duration
+}
+
+func (h *OrphanHandler) Do(alive map[string][]uint32) error {
+	if h.Policy != OrphanPolicyKeep && h.Policy != OrphanPolicyArchive && h.Policy != OrphanPolicyPrune {
+		return fmt.Errorf("unknown orphan policy %s", h.Policy)
+	}
+	aliveSet := make(map[string]bool)
+	for collection, vids := range alive {
+		for _, vid := range vids {
+			aliveSet[orphanKey(collection, vid)] = true
+		}
+	}
+	if len(aliveSet) == 0 {
+		// 拿到一个空的拓扑更可能是master出了问题, 而不是所有的volume都被删除了
+		logrus.Warning("master reports no volume at all, skip checking orphan volumes")
+		return nil
+	}
+
+	// key = collection_vid, value = 第一次发现该volume在主集群中不存在的时间
+	statePath := path.Join(h.Locations.Dirs[0], orphanStateFile)
+	state, err := loadOrphanState(statePath)
+	if err != nil {
+		return err
+	}
+
+	volumes, err := h.Locations.Volumes()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, v := range volumes {
+		key := orphanKey(v.Collection, v.Vid)
+		firstMissing, tracked := state[key]
+		if aliveSet[key] {
+			if tracked {
+				delete(state, key)
+				h.record("orphan_recovered", v, "volume shows up in the master topology again")
+			}
+			continue
+		}
+		seen[key] = true
+		if !tracked {
+			firstMissing = now.Unix()
+			state[key] = firstMissing
+			logrus.Warningf("volume <%d> of collection <%s> in %s no longer exists on the master", v.Vid, v.Collection, v.Dir)
+			h.record("orphan_detected", v, "policy: "+h.Policy)
+		}
+
+		if h.Policy == OrphanPolicyKeep || now.Sub(time.Unix(firstMissing, 0)) < h.Grace {
+			continue
+		}
+		switch h.Policy {
+		case OrphanPolicyArchive:
+			dst, err := archiveVolume(v, now)
+			if err != nil {
+				logrus.Errorf("failed to archive orphan volume <%d>, err: %v", v.Vid, err)
+				continue
+			}
+			logrus.Infof("archived orphan volume <%d> of collection <%s> into %s", v.Vid, v.Collection, dst)
+			h.record("orphan_archived", v, dst)
+		case OrphanPolicyPrune:
+			if err = pruneVolume(v); err != nil {
+				logrus.Errorf("failed to prune orphan volume <%d>, err: %v", v.Vid, err)
+				continue
+			}
+			logrus.Infof("pruned orphan volume <%d> of collection <%s> from %s", v.Vid, v.Collection, v.Dir)
+			h.record("orphan_pruned", v, fmt.Sprintf("missing since %s", time.Unix(firstMissing, 0).Format(time.RFC3339)))
+		}
+		delete(state, key)
+		delete(seen, key)
+	}
+	// 手动删除的volume不再跟踪
+	for key := range state {
+		if !seen[key] {
+			delete(state, key)
+		}
+	}
+	return saveOrphanState(statePath, state)
+}
+
+func (h *OrphanHandler) record(action string, v location.LocalVolume, detail string) {
+	err := h.Catalog.Append(&CatalogRecord{
+		Action:     action,
+		Collection: v.Collection,
+		VolumeId:   v.Vid,
+		Dir:        v.Dir,
+		Detail:     detail,
+	})
+	if err != nil {
+		logrus.Errorf("failed to append %s record into catalog, err: %v", action, err)
+	}
+}
+
+func orphanKey(collection string, vid uint32) string {
+	return fmt.Sprintf("%s_%d", collection, vid)
+}
+
+func archiveVolume(v location.LocalVolume, now time.Time) (string, error) {
+	dst := path.Join(v.Dir, tombstonedDir, now.Format("20060102T150405"))
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return "", err
+	}
+	files, err := v.Files()
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if err = os.Rename(file, path.Join(dst, filepath.Base(file))); err != nil {
+			return "", err
+		}
+	}
+	return dst, nil
+}
+
+func pruneVolume(v location.LocalVolume) error {
+	files, err := v.Files()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadOrphanState(filename string) (map[string]int64, error) {
+	state := make(map[string]int64)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func saveOrphanState(filename string, state map[string]int64) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
@@ -1,17 +1,26 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	param_parser "flag"
-	"io"
 	"os"
-	"path"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/chrislusf/seaweedfs/weed/storage"
-	"github.com/chrislusf/seaweedfs/weed/storage/needle"
-	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
+	"github.com/chrislusf/seaweedfs/weed/pb/master_pb"
+	"github.com/chrislusf/seaweedfs/weed/security"
+	"github.com/chrislusf/seaweedfs/weed/util"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/batch"
+	"github.com/amazingchow/seaweedfs-tools/pkg/chunkplan"
+	"github.com/amazingchow/seaweedfs-tools/pkg/filter"
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/rewrite"
+	myutils "github.com/amazingchow/seaweedfs-tools/pkg/utils"
 )
 
 var (
@@ -20,19 +29,85 @@ var (
 		"directory to store volume data files, the .idx and .dat files should already exist inside the dir.")
 	_DstDir = param_parser.String("dst",
 		"/mnt/locals/seeweedfsvolume/volume0/volume-output",
-		"directory to store encrypted volume data files.")
+		"directory to store the rewritten volume data files.")
 	_Collection = param_parser.String("collection",
 		"",
-		"the volume collection name.")
+		"the volume collection name, only process the volumes of this collection if provided when processing -src.")
 	_VolumeId = param_parser.Int("vid",
 		-1,
-		"the volume id.")
+		"the volume id, process all the volumes in -src if not provided.")
 	_Newer = param_parser.String("newer",
 		"",
 		"export only files newer than this time, must be specified in RFC3339 without timezone, e.g. 2006-01-02T15:04:05.")
 	_TimeZone = param_parser.String("tz",
 		"",
 		"timezone, e.g. Asia/Shanghai.")
+	_Drop = param_parser.String("drop",
+		"",
+		"drop the needles matching this filter expression, e.g. 'mime ~ \"image/*\" and age > 180d and not header(\"X-Legal-Hold\")'.")
+	_MergeVolumeIds = param_parser.String("merge_vids",
+		"",
+		"merge the live needles of these volumes into new volumes under -dst, comma separated, the fids of the merged needles change.")
+	_MergeDstVid = param_parser.Int("merge_dst_vid",
+		-1,
+		"id of the first new volume when merging, the new volumes use consecutive ids which must not be used in the cluster.")
+	_MergeTargetSize = param_parser.Int64("merge_target_size",
+		30000,
+		"size of each new volume in MB when merging.")
+	_FidMapping = param_parser.String("fid_mapping",
+		"",
+		"file to write the old and new fid of every merged needle into, one needle per line, used to update the filer.")
+	_AcceptNewFids = param_parser.Bool("accept_new_fids",
+		false,
+		"merging assigns new fids to the needles, set to true to confirm the filer is going to be updated with -fid_mapping.")
+	_Concurrency = param_parser.Int("concurrency",
+		4,
+		"number of volumes to process at the same time when processing -src.")
+	_Replace = param_parser.Bool("replace",
+		true,
+		"replace the original volumes with the processed ones when processing -src, -dst must be on the same filesystem as -src.")
+	_KeepGenerations = param_parser.Int("keep_generations",
+		1,
+		"number of replaced generations of each volume to keep for rollback, 0 keeps all.")
+	_Restamp = param_parser.Bool("restamp",
+		false,
+		"set the AppendAtNs of the rewritten needles to the rewrite time, the original AppendAtNs is kept by default.")
+	_Raw = param_parser.Bool("raw",
+		false,
+		"copy the kept needles byte-for-byte instead of re-serialising them, faster but can not be used with -restamp or when merging.")
+	_Scan = param_parser.String("scan",
+		"auto",
+		"how to read the source volumes: sequential reads the whole .dat, index reads only the live needles in the .idx, auto picks one by the garbage ratio.")
+	_MemoryBudget = param_parser.Int64("memory_budget",
+		0,
+		"memory in MB the index of each volume may use, larger indexes are kept in a temporary leveldb in -dst, 0 means no limit.")
+	_KeepExpired = param_parser.Bool("keep_expired",
+		false,
+		"keep the needles whose ttl has expired, they are dropped by default.")
+	_DropExpired = param_parser.Bool("drop_expired",
+		false,
+		"rewrite the volumes only to drop the needles whose ttl has expired, required when neither -newer nor -drop is provided.")
+	_Online = param_parser.Bool("online",
+		false,
+		"delete the dropped needles through BatchDelete on the volume servers instead of rewriting the volume files, the volumes keep serving and the cluster vacuum reclaims the space.")
+	_MasterHttp = param_parser.String("master_http",
+		"localhost:9333",
+		"seaweedfs master server http endpoint, used in -online mode and with -chunk_plan.")
+	_MasterGrpc = param_parser.String("master_grpc",
+		"localhost:19333",
+		"seaweedfs master server grpc endpoint, used in -online mode and with -volume_server or -chunk_plan.")
+	_VolumeServer = param_parser.String("volume_server",
+		"",
+		"address of the volume server serving -src as registered in the master, e.g. 10.0.2.15:8080, if provided each volume is unmounted from it before its files are replaced and mounted back afterwards, otherwise the volume files are made read-only (0444) before processing.")
+	_DeleteBatch = param_parser.Int("delete_batch",
+		100,
+		"number of needles deleted by each BatchDelete call in -online mode.")
+	_DeleteRate = param_parser.Int64("delete_rate",
+		1000,
+		"delete at most this many needles per second in -online mode, 0 means no limit.")
+	_ChunkPlan = param_parser.String("chunk_plan",
+		"",
+		"keep or drop each chunked file as a whole with its chunks, the chunk manifests of all the volumes of -collection in the cluster are scanned, the dropped chunked files are written into this file, one json per line.")
 	_Verbose = param_parser.Bool("verbose",
 		false,
 		"verbose")
@@ -45,11 +120,248 @@ func main() {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	if *_Collection == "" || *_VolumeId == -1 || *_Newer == "" {
-		logrus.Warning("no collection or volume id or newer time provided")
+	scanMode, err := rewrite.ParseScanMode(*_Scan)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	memoryBudget := *_MemoryBudget * 1024 * 1024
+
+	var stages []rewrite.Stage
+	if !*_KeepExpired {
+		stages = append(stages, rewrite.DropExpired())
+	}
+	if *_Newer != "" {
+		stages = append(stages, rewrite.NewerThan(parseNewer()))
+	}
+	if *_Drop != "" {
+		drop, err := filter.Parse(*_Drop)
+		if err != nil {
+			logrus.Fatalf("failed to parse -drop %s, err: %v", *_Drop, err)
+		}
+		logrus.Infof("drop the needles matching %s", drop)
+		stages = append(stages, rewrite.DropMatching(drop))
+	}
+
+	if *_MergeVolumeIds != "" {
+		if *_Online {
+			logrus.Fatal("-online can not be used when merging volumes")
+		}
+		if *_Raw {
+			logrus.Fatal("-raw can not be used when merging volumes")
+		}
+		merge(stages, scanMode, memoryBudget)
+		return
+	}
+
+	// 默认参数会重写并替换-src中的所有volume, 必须明确指定要丢弃哪些needle
+	if *_DropExpired && *_KeepExpired {
+		logrus.Fatal("-drop_expired can not be used with -keep_expired")
+	}
+	if *_Newer == "" && *_Drop == "" && !*_DropExpired {
+		logrus.Warning("no newer time, drop expression or -drop_expired provided")
+		return
+	}
+	if *_Online {
+		online(stages, memoryBudget)
+		return
+	}
+	if *_Raw && *_Restamp {
+		logrus.Fatal("-raw can not be used with -restamp")
+	}
+	rewriter := &rewrite.Rewriter{
+		Stages:       stages,
+		Restamp:      *_Restamp,
+		Raw:          *_Raw,
+		Scan:         scanMode,
+		MemoryBudget: memoryBudget,
+	}
+
+	// 指定了volume id时只处理该volume, 否则处理-src中的所有volume
+	if *_VolumeId != -1 {
+		v := location.LocalVolume{Dir: *_SrcDir, Collection: *_Collection, Vid: uint32(*_VolumeId)}
+		if plan := buildPlan([]location.LocalVolume{v}, stages, memoryBudget); plan != nil {
+			rewriter.Stages = plan.Stages(v.Vid, stages)
+		}
+		counter, err := rewriter.Rewrite(v, *_DstDir)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("totally processed %d needles", counter)
 		return
 	}
 
+	// 先处理上一次中断的替换
+	if err := batch.Recover(*_SrcDir); err != nil {
+		logrus.Fatalf("failed to recover unfinished swaps in %s, err: %v", *_SrcDir, err)
+	}
+	volumes, err := batch.Select(*_SrcDir, *_Collection)
+	if err != nil {
+		logrus.Fatalf("failed to list volumes in %s, err: %v", *_SrcDir, err)
+	}
+	if err = os.MkdirAll(*_DstDir, 0755); err != nil {
+		logrus.Fatalf("failed to create %s, err: %v", *_DstDir, err)
+	}
+	plan := buildPlan(volumes, stages, memoryBudget)
+	process := func(v location.LocalVolume) (int64, error) {
+		r := rewriter
+		if plan != nil {
+			// 每个volume使用自己的stage, 不修改共享的rewriter
+			copied := *rewriter
+			copied.Stages = plan.Stages(v.Vid, stages)
+			r = &copied
+		}
+		counter, err := r.Rewrite(v, *_DstDir)
+		if err == nil {
+			err = batch.Verify(v, *_DstDir, counter, memoryBudget)
+		}
+		if err == nil && *_Replace {
+			err = batch.Replace(v, *_DstDir, *_KeepGenerations)
+		}
+		return counter, err
+	}
+	// 不替换原来的volume时不需要卸载
+	volumeServer := *_VolumeServer
+	if !*_Replace {
+		volumeServer = ""
+	}
+	if process, err = batch.Guard(volumes, volumeServer, *_MasterGrpc, process); err != nil {
+		logrus.Fatal(err)
+	}
+	results := batch.Run(volumes, *_Concurrency, process)
+	if *_Replace {
+		// 删除临时目录, 还有未替换的文件时保留
+		_ = os.Remove(*_DstDir)
+	}
+	if batch.Report(results) > 0 {
+		os.Exit(1)
+	}
+}
+
+// buildPlan scans the chunk manifests of the volumes and of all the other volumes of -collection
+// in the cluster, it returns nil unless -chunk_plan is provided.
+func buildPlan(volumes []location.LocalVolume, stages []rewrite.Stage, memoryBudget int64) *chunkplan.Plan {
+	if *_ChunkPlan == "" {
+		return nil
+	}
+	if err := os.MkdirAll(*_DstDir, 0755); err != nil {
+		logrus.Fatalf("failed to create %s, err: %v", *_DstDir, err)
+	}
+	retention := newRetention(stages, memoryBudget)
+	plan := scanPlan(retention, volumes)
+	vids := make(map[uint32]bool)
+	for _, v := range volumes {
+		vids[v.Vid] = true
+	}
+	// 其它volume中的chunk只能根据-chunk_plan删除
+	if outside := plan.Outside(vids); outside > 0 {
+		logrus.Warningf("%d needles of the dropped chunked files are in other volumes, delete them as listed in %s", outside, *_ChunkPlan)
+	}
+	savePlan(plan)
+	return plan
+}
+
+// scanPlan scans the chunk manifests of the local volumes, then those of all the other volumes of -collection
+// in the cluster, which are read from -src or copied from the volume servers. A chunk is judged with its manifest
+// wherever the manifest is, so the plan is refused unless every volume is scanned.
+func scanPlan(retention *OnlineRetention, local []location.LocalVolume) *chunkplan.Plan {
+	plan := chunkplan.New()
+	retention.Plan = plan
+	scanned := make(map[uint32]bool)
+	for _, v := range local {
+		logrus.Infof("ready to scan the chunk manifests of volume <%d>", v.Vid)
+		if err := plan.Scan(v, retention.Stages, retention.MemoryBudget, retention.TmpDir); err != nil {
+			logrus.Fatalf("failed to scan the chunk manifests of volume <%d>, err: %v", v.Vid, err)
+		}
+		scanned[v.Vid] = true
+	}
+	volumes, ecVolumes := clusterVolumes()
+	if len(ecVolumes) > 0 {
+		// ec volume没有.dat, 无法扫描其中的manifest
+		logrus.Fatalf("can not scan the chunk manifests of the erasure coded volumes %v", ecVolumes)
+	}
+	for _, v := range volumes {
+		if scanned[v.Vid] {
+			continue
+		}
+		logrus.Infof("ready to scan the chunk manifests of volume <%d> of collection <%s>", v.Vid, v.Collection)
+		if err := retention.ScanManifests(v.Collection, v.Vid); err != nil {
+			logrus.Fatalf("failed to scan the chunk manifests of volume <%d>, err: %v", v.Vid, err)
+		}
+		scanned[v.Vid] = true
+	}
+	plan.Resolve()
+	return plan
+}
+
+// clusterVolumes lists the volumes of -collection in the cluster, all the collections if -collection is empty,
+// and the erasure coded ones separately.
+func clusterVolumes() ([]location.LocalVolume, []uint32) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	// TODO: add more dial options
+	conn, err := grpc.Dial(*_MasterGrpc, grpc.WithInsecure())
+	if err != nil {
+		logrus.Fatalf("failed to connect to %s, err: %v", *_MasterGrpc, err)
+	}
+	defer conn.Close()
+	resp, err := master_pb.NewSeaweedClient(conn).VolumeList(ctx, &master_pb.VolumeListRequest{})
+	if err != nil {
+		logrus.Fatalf("failed to list volume info from %s, err: %v", *_MasterGrpc, err)
+	}
+
+	var volumes []location.LocalVolume
+	for collection, vids := range myutils.CollectVolumeInfo(resp.TopologyInfo, false) {
+		if *_Collection != "" && collection != *_Collection {
+			continue
+		}
+		// 每个副本都会出现在拓扑中
+		seen := make(map[uint32]bool)
+		for _, vid := range vids {
+			if !seen[vid] {
+				seen[vid] = true
+				volumes = append(volumes, location.LocalVolume{Collection: collection, Vid: vid})
+			}
+		}
+	}
+	var ecVolumes []uint32
+	for collection, vids := range myutils.CollectEcVolumeInfo(resp.TopologyInfo) {
+		if *_Collection != "" && collection != *_Collection {
+			continue
+		}
+		seen := make(map[uint32]bool)
+		for _, vid := range vids {
+			if !seen[vid] {
+				seen[vid] = true
+				ecVolumes = append(ecVolumes, vid)
+			}
+		}
+	}
+	return volumes, ecVolumes
+}
+
+func newRetention(stages []rewrite.Stage, memoryBudget int64) *OnlineRetention {
+	util.LoadConfiguration("security", false)
+	return &OnlineRetention{
+		Master:         *_MasterHttp,
+		GrpcDialOption: security.LoadClientTLS(util.GetViper(), "grpc.client"),
+		Stages:         stages,
+		SrcDir:         *_SrcDir,
+		TmpDir:         *_DstDir,
+		MemoryBudget:   memoryBudget,
+		BatchSize:      *_DeleteBatch,
+		Rate:           *_DeleteRate,
+	}
+}
+
+func savePlan(plan *chunkplan.Plan) {
+	if err := plan.Save(*_ChunkPlan); err != nil {
+		logrus.Fatalf("failed to write chunk plan %s, err: %v", *_ChunkPlan, err)
+	}
+	logrus.Infof("found %d chunked files, dropped %d of them, kept %d broken chunk manifests, the dropped chunked files are written into %s",
+		plan.Files, plan.Dropped, plan.Broken, *_ChunkPlan)
+}
+
+func parseNewer() int64 {
 	localLocation, err := time.LoadLocation("Local")
 	if err != nil {
 		logrus.Fatalf("failed to load time location, err: %v", err)
@@ -64,48 +376,113 @@ func main() {
 	if err != nil {
 		logrus.Fatalf("failed to parse time, err: %v", err)
 	}
-	newerThanUnix := newerThan.Unix()
-
-	// 只需生成.idx文件和.dat文件, 可以复用原先的.vif文件
-	filename := *_Collection + "_" + strconv.Itoa(*_VolumeId)
-	idxFile := filename + ".idx"
-	datFile := filename + ".dat"
+	return newerThan.Unix()
+}
 
-	// needle map缓存needle索引信息, key = []byte(NeedleId), value = []byte(Offset + Size)
-	srcNM := needle_map.NewMemDb()
-	defer srcNM.Close()
-	if err = srcNM.LoadFromIdx(path.Join(*_SrcDir, idxFile)); err != nil {
-		logrus.Fatalf("failed to load needle map from %s, err: %v", path.Join(*_SrcDir, idxFile), err)
+func online(stages []rewrite.Stage, memoryBudget int64) {
+	if *_DeleteBatch <= 0 {
+		logrus.Fatal("-delete_batch must be positive")
+	}
+	if err := os.MkdirAll(*_DstDir, 0755); err != nil {
+		logrus.Fatalf("failed to create %s, err: %v", *_DstDir, err)
 	}
-	dstNM := needle_map.NewMemDb()
-	defer dstNM.Close()
 
-	logrus.Infof("ready to parse %s", path.Join(*_SrcDir, datFile))
+	// 指定了volume id时只处理该volume, 否则处理master上的所有volume
+	volumes := []location.LocalVolume{{Collection: *_Collection, Vid: uint32(*_VolumeId)}}
+	if *_VolumeId == -1 {
+		volumes, _ = clusterVolumes()
+	}
+	retention := newRetention(stages, memoryBudget)
 
-	vid := needle.VolumeId(*_VolumeId)
-	volumeFileScanner := &VolumeFileScanner4Compactor{
-		SrcNeedleMap: srcNM,
-		DstNeedleMap: dstNM,
-		DstDataFile:  path.Join(*_DstDir, datFile),
-		NewerThan:    newerThanUnix,
+	var failedVolumes int
+	if *_ChunkPlan != "" {
+		// 先删除整个chunked file, 即使只处理一个volume也要扫描集群中所有volume的manifest
+		scanPlan(retention, nil)
+		retention.DeleteChunkedFiles()
+		savePlan(retention.Plan)
 	}
-	err = storage.ScanVolumeFile(*_SrcDir, *_Collection, vid, storage.NeedleMapInMemory, volumeFileScanner)
-	if err != nil && err != io.EOF {
-		if volumeFileScanner.ExitErr != ErrCreateDataFile {
-			volumeFileScanner.Close()
-			_ = os.Remove(path.Join(*_DstDir, datFile))
+	for _, v := range volumes {
+		logrus.Infof("ready to delete the dropped needles of volume <%d> of collection <%s>", v.Vid, v.Collection)
+		if err := retention.Do(v.Collection, v.Vid); err != nil {
+			logrus.Errorf("failed to delete the dropped needles of volume <%d>, err: %v", v.Vid, err)
+			failedVolumes++
 		}
-		logrus.Fatalf("failed to scan %s, err: %v", path.Join(*_SrcDir, datFile), err)
 	}
-	volumeFileScanner.Close()
 
-	// 生成新的.idx文件
-	if err = dstNM.SaveToIdx(path.Join(*_DstDir, idxFile)); err != nil {
-		logrus.Fatalf("failed to save needle map to %s, err: %v", path.Join(*_DstDir, idxFile), err)
-		_ = os.Remove(path.Join(*_DstDir, idxFile))
-		_ = os.Remove(path.Join(*_DstDir, datFile))
+	logrus.Infof("deleted %d needles, %d were already gone, failed to delete %d needles",
+		retention.Deleted, retention.NotFound, retention.Failed)
+	if failedVolumes > 0 || retention.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func merge(stages []rewrite.Stage, scanMode rewrite.ScanMode, memoryBudget int64) {
+	if *_MergeDstVid < 0 || *_FidMapping == "" || *_MergeTargetSize <= 0 {
+		logrus.Fatal("please provide -merge_dst_vid, -merge_target_size and -fid_mapping to merge volumes")
+	}
+	if !*_AcceptNewFids {
+		logrus.Fatal("merged needles get new fids, please set -accept_new_fids=true and update the filer with -fid_mapping")
+	}
+	var srcVids []uint32
+	for _, item := range strings.Split(*_MergeVolumeIds, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		vid, err := strconv.ParseUint(item, 10, 32)
+		if err != nil {
+			logrus.Fatalf("failed to parse -merge_vids %s, err: %v", *_MergeVolumeIds, err)
+		}
+		srcVids = append(srcVids, uint32(vid))
+	}
+	mapping, err := os.OpenFile(*_FidMapping, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		logrus.Fatalf("failed to create fid mapping %s, err: %v", *_FidMapping, err)
+	}
+	w := bufio.NewWriter(mapping)
+	merger := &VolumeMerger{
+		DstDir:       *_DstDir,
+		Collection:   *_Collection,
+		NextVid:      uint32(*_MergeDstVid),
+		TargetSize:   *_MergeTargetSize * 1024 * 1024,
+		Stages:       stages,
+		Restamp:      *_Restamp,
+		Scan:         scanMode,
+		MemoryBudget: memoryBudget,
+		FidMapping:   w,
+	}
+	// 失败时删除已经生成的volume和fid mapping, 源volume保持不变
+	abort := func(format string, args ...interface{}) {
+		merger.Abort()
+		_ = mapping.Close()
+		_ = os.Remove(*_FidMapping)
+		logrus.Fatalf(format, args...)
+	}
+	var srcVolumes []location.LocalVolume
+	for _, vid := range srcVids {
+		srcVolumes = append(srcVolumes, location.LocalVolume{Dir: *_SrcDir, Collection: *_Collection, Vid: vid})
+	}
+	plan := buildPlan(srcVolumes, stages, memoryBudget)
+	for _, vid := range srcVids {
+		logrus.Infof("ready to merge volume <%d>", vid)
+		if plan != nil {
+			merger.Stages = plan.Stages(vid, stages)
+		}
+		if err = merger.Merge(*_SrcDir, vid); err != nil {
+			abort("failed to merge volume <%d>, err: %v", vid, err)
+		}
+	}
+	if err = merger.Close(); err != nil {
+		abort("failed to finish merged volumes, err: %v", err)
+	}
+	if err = w.Flush(); err != nil {
+		abort("failed to write fid mapping %s, err: %v", *_FidMapping, err)
+	}
+	if err = mapping.Sync(); err != nil {
+		abort("failed to write fid mapping %s, err: %v", *_FidMapping, err)
 	}
+	_ = mapping.Close()
 
-	logrus.Infof("finish to parse %s", path.Join(*_SrcDir, datFile))
-	logrus.Infof("totally processed %d needles", volumeFileScanner.Counter())
+	logrus.Infof("merged %d needles of %d volumes into volumes %v, fid mapping is written into %s",
+		merger.Counter(), len(srcVids), merger.Created, *_FidMapping)
 }
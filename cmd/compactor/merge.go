@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/chrislusf/seaweedfs/weed/storage"
+	"github.com/chrislusf/seaweedfs/weed/storage/backend"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/needlemap"
+	"github.com/amazingchow/seaweedfs-tools/pkg/rewrite"
+)
+
+var (
+	ErrSuperBlockMismatch = errors.New("source volumes have different superblocks")
+)
+
+// volume server按照fid中的volume id查找needle, 因此needle合并到新的volume之后fid必然改变,
+// 合并时每个needle保留原来的needle id和cookie, 只改变volume id, 新旧fid的对应关系写入FidMapping,
+// 调用方需要根据FidMapping更新filer中的元数据.
+type VolumeMerger struct {
+	DstDir     string
+	Collection string
+	// 新volume的id从NextVid开始递增, 必须是集群中没有使用过的volume id
+	NextVid    uint32
+	TargetSize int64
+	// 合并时需要经过的Stage, 例如丢弃旧的needle
+	Stages []rewrite.Stage
+	// 使用合并时的时间作为AppendAtNs, 默认保留原来的AppendAtNs
+	Restamp bool
+	// 读取源volume的方式
+	Scan rewrite.ScanMode
+	// needle map可以使用的内存, 超出时放到DstDir下的临时leveldb中, 0表示不限制
+	MemoryBudget int64
+	// 每行一个needle: <旧fid> <新fid>
+	FidMapping io.Writer
+
+	superBlock *super_block.SuperBlock
+	srcVid     uint32
+	srcNM      needlemap.NeedleMap
+	// 当前源volume的needle平均大小, 用于估算目标volume的needle数量
+	avgNeedleSize int64
+	dst           *mergedVolume
+	counter       int64
+
+	Created []uint32
+}
+
+// 正在写入的目标volume
+type mergedVolume struct {
+	vid         uint32
+	dataBackend *backend.DiskFile
+	nm          needlemap.NeedleMap
+	size        int64
+	// 多个源volume的AppendAtNs可能交错, 每个目标volume中保持单调递增
+	clock *rewrite.AppendClock
+}
+
+func (m *VolumeMerger) baseFileName(vid uint32) string {
+	return storage.VolumeFileName(m.DstDir, m.Collection, int(vid))
+}
+
+// Merge appends the live needles of a source volume into the destination volumes.
+func (m *VolumeMerger) Merge(srcDir string, srcVid uint32) error {
+	m.srcVid = srcVid
+	srcBase := storage.VolumeFileName(srcDir, m.Collection, int(srcVid))
+	var err error
+	if m.srcNM, err = needlemap.Load(srcBase+".idx", m.MemoryBudget, m.DstDir); err != nil {
+		return fmt.Errorf("failed to load needle map from %s, err: %v", srcBase+".idx", err)
+	}
+	defer m.srcNM.Close()
+	m.avgNeedleSize = 0
+	datInfo, datErr := os.Stat(srcBase + ".dat")
+	idxInfo, idxErr := os.Stat(srcBase + ".idx")
+	if datErr == nil && idxErr == nil && idxInfo.Size() >= types.NeedleMapEntrySize {
+		m.avgNeedleSize = datInfo.Size() / (idxInfo.Size() / types.NeedleMapEntrySize)
+	}
+	v := location.LocalVolume{Dir: srcDir, Collection: m.Collection, Vid: srcVid}
+	return rewrite.ScanVolume(v, m.srcNM, m.Scan, m)
+}
+
+func (m *VolumeMerger) VisitSuperBlock(superBlock super_block.SuperBlock) error {
+	if m.superBlock == nil {
+		m.superBlock = &super_block.SuperBlock{
+			Version:          superBlock.Version,
+			ReplicaPlacement: superBlock.ReplicaPlacement,
+			Ttl:              superBlock.Ttl,
+		}
+		return nil
+	}
+	// 副本策略和TTL不同的volume不能合并
+	if superBlock.Version != m.superBlock.Version ||
+		superBlock.ReplicaPlacement.Byte() != m.superBlock.ReplicaPlacement.Byte() ||
+		superBlock.Ttl.String() != m.superBlock.Ttl.String() {
+		logrus.Errorf("volume <%d> has version %d, replication %s, ttl %s, but the merged volumes have version %d, replication %s, ttl %s",
+			m.srcVid, superBlock.Version, superBlock.ReplicaPlacement, superBlock.Ttl,
+			m.superBlock.Version, m.superBlock.ReplicaPlacement, m.superBlock.Ttl)
+		return ErrSuperBlockMismatch
+	}
+	return nil
+}
+
+func (m *VolumeMerger) ReadNeedleBody() bool {
+	return true
+}
+
+func (m *VolumeMerger) VisitNeedle(srcNeedle *needle.Needle, offset int64, _, _ []byte) error {
+	nv, ok := m.srcNM.Get(srcNeedle.Id)
+	if !ok || nv.Size == 0 || nv.Size == types.TombstoneFileSize || nv.Offset.ToAcutalOffset() != offset {
+		return nil
+	}
+	dstNeedle, err := rewrite.Apply(m.Stages, srcNeedle)
+	if err != nil {
+		logrus.Errorf("failed to create new needle, err: %v", err)
+		return rewrite.ErrCreateNeedle
+	}
+	if dstNeedle == nil {
+		return nil
+	}
+	// 先按原来的AppendAtNs计算大小, 切换目标volume之后再重新设置
+	dstNeedle.AppendAtNs = srcNeedle.AppendAtNs
+	bytesToWrite, _, _, err := dstNeedle.PrepareWriteBuffer(m.superBlock.Version)
+	if err != nil {
+		logrus.Errorf("failed to prepare write buffer, err: %v", err)
+		return rewrite.ErrPrepareNeedleWriteBuffer
+	}
+
+	// 目标volume写满, 或者needle id与目标volume中已有的needle冲突时, 切换到下一个目标volume
+	if m.dst != nil {
+		_, collided := m.dst.nm.Get(dstNeedle.Id)
+		if collided || m.dst.size+int64(len(bytesToWrite)) > m.TargetSize {
+			if collided {
+				logrus.Warningf("needle <%d> of volume <%d> collides in volume <%d>, start a new volume",
+					dstNeedle.Id, m.srcVid, m.dst.vid)
+			}
+			if err = m.finishVolume(); err != nil {
+				return err
+			}
+		}
+	}
+	if m.dst == nil {
+		if err = m.createVolume(); err != nil {
+			return err
+		}
+	}
+
+	m.dst.clock.Stamp(srcNeedle, dstNeedle)
+	if dstNeedle.AppendAtNs != srcNeedle.AppendAtNs {
+		// AppendAtNs不影响needle的大小
+		if bytesToWrite, _, _, err = dstNeedle.PrepareWriteBuffer(m.superBlock.Version); err != nil {
+			logrus.Errorf("failed to prepare write buffer, err: %v", err)
+			return rewrite.ErrPrepareNeedleWriteBuffer
+		}
+	}
+
+	if _, err = m.dst.dataBackend.WriteAt(bytesToWrite, m.dst.size); err != nil {
+		logrus.Errorf("failed to write needle bytes, err: %v", err)
+		return rewrite.ErrWriteNeedleBytes
+	}
+	if err = m.dst.nm.Set(dstNeedle.Id, types.ToOffset(m.dst.size), dstNeedle.Size); err != nil {
+		logrus.Errorf("failed to set k/v for needle map, err: %v", err)
+		return rewrite.ErrSetNeedleMap
+	}
+	m.dst.size += int64(len(bytesToWrite))
+
+	oldFid := needle.NewFileId(needle.VolumeId(m.srcVid), uint64(srcNeedle.Id), uint32(srcNeedle.Cookie))
+	newFid := needle.NewFileId(needle.VolumeId(m.dst.vid), uint64(dstNeedle.Id), uint32(dstNeedle.Cookie))
+	if _, err = fmt.Fprintf(m.FidMapping, "%s %s\n", oldFid, newFid); err != nil {
+		return err
+	}
+	m.counter++
+	return nil
+}
+
+func (m *VolumeMerger) createVolume() error {
+	vid := m.NextVid
+	datFile := m.baseFileName(vid) + ".dat"
+	logrus.Debugf("create new data file %s", datFile)
+	file, err := os.OpenFile(datFile, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		logrus.Errorf("failed to create new data file %s, err: %v", datFile, err)
+		return rewrite.ErrCreateDataFile
+	}
+	m.NextVid++
+	m.Created = append(m.Created, vid)
+	var entries int64
+	if m.avgNeedleSize > 0 {
+		entries = m.TargetSize / m.avgNeedleSize
+	}
+	nm, err := needlemap.New(entries, m.MemoryBudget, m.DstDir)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	m.dst = &mergedVolume{
+		vid:         vid,
+		dataBackend: backend.NewDiskFile(file),
+		nm:          nm,
+		clock:       &rewrite.AppendClock{Restamp: m.Restamp},
+	}
+	header := m.superBlock.Bytes()
+	if _, err = m.dst.dataBackend.WriteAt(header, 0); err != nil {
+		logrus.Errorf("failed to write needle bytes for super block, err: %v", err)
+		return rewrite.ErrWriteNeedleBytes
+	}
+	m.dst.size = int64(len(header))
+	return nil
+}
+
+func (m *VolumeMerger) finishVolume() error {
+	dst := m.dst
+	m.dst = nil
+	defer dst.nm.Close()
+	if err := dst.dataBackend.File.Sync(); err != nil {
+		_ = dst.dataBackend.Close()
+		return err
+	}
+	if err := dst.dataBackend.Close(); err != nil {
+		return err
+	}
+	idxFile := m.baseFileName(dst.vid) + ".idx"
+	if err := dst.nm.SaveToIdx(idxFile); err != nil {
+		logrus.Errorf("failed to save needle map to %s, err: %v", idxFile, err)
+		return err
+	}
+	logrus.Infof("finish merged volume <%d>, %d bytes", dst.vid, dst.size)
+	return nil
+}
+
+// Close finishes the last destination volume.
+func (m *VolumeMerger) Close() error {
+	if m.dst == nil {
+		return nil
+	}
+	return m.finishVolume()
+}
+
+// Abort removes all the destination volumes created so far.
+func (m *VolumeMerger) Abort() {
+	if m.dst != nil {
+		_ = m.dst.dataBackend.Close()
+		m.dst.nm.Close()
+		m.dst = nil
+	}
+	for _, vid := range m.Created {
+		_ = os.Remove(m.baseFileName(vid) + ".dat")
+		_ = os.Remove(m.baseFileName(vid) + ".idx")
+	}
+}
+
+func (m *VolumeMerger) Counter() int64 {
+	return m.counter
+}
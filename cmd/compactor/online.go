@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/chrislusf/seaweedfs/weed/operation"
+	"github.com/chrislusf/seaweedfs/weed/pb/volume_server_pb"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/chrislusf/seaweedfs/weed/util"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/chunkplan"
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/needlemap"
+	"github.com/amazingchow/seaweedfs-tools/pkg/rewrite"
+	"github.com/amazingchow/seaweedfs-tools/pkg/volumecopy"
+)
+
+// OnlineRetention deletes the needles dropped by the stages through BatchDelete on every replica
+// of the volume, the volume keeps serving and the cluster vacuum reclaims the space afterwards.
+// Chunk manifests are deleted through the http api of the volume server, which deletes their chunks as well.
+type OnlineRetention struct {
+	Master         string
+	GrpcDialOption grpc.DialOption
+	Stages         []rewrite.Stage
+	// 优先读取SrcDir中的volume文件, 不存在时通过CopyFile拷贝到TmpDir
+	SrcDir       string
+	TmpDir       string
+	MemoryBudget int64
+	// 每个BatchDelete请求中的fid数量
+	BatchSize int
+	// 每秒最多删除的needle数量, 0表示不限速
+	Rate int64
+	// 不为nil时chunked file作为一个整体删除, 需要先对所有volume调用ScanManifests和DeleteChunkedFiles
+	Plan *chunkplan.Plan
+
+	started   time.Time
+	requested int64
+	Deleted   int64
+	NotFound  int64
+	Failed    int64
+}
+
+// Do scans the volume and deletes its dropped needles on all the servers holding it.
+func (o *OnlineRetention) Do(collection string, vid uint32) error {
+	servers, err := o.lookup(vid)
+	if err != nil {
+		return err
+	}
+	v, cleanup, err := o.open(collection, vid, servers)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	nm, err := needlemap.Load(v.BaseFileName()+".idx", o.MemoryBudget, o.TmpDir)
+	if err != nil {
+		return fmt.Errorf("failed to load needle map from %s, err: %v", v.BaseFileName()+".idx", err)
+	}
+	defer nm.Close()
+
+	stages := o.Stages
+	if o.Plan != nil {
+		stages = o.Plan.Stages(vid, o.Stages)
+	}
+	scanner := &deleteScanner{
+		retention: o,
+		vid:       vid,
+		servers:   servers,
+		stages:    stages,
+	}
+	// 本地的volume可能还在写入, 只按照已经加载的.idx读取live needle, 不读取.dat的末尾
+	if err = rewrite.ScanVolume(v, nm, rewrite.ScanIndex, scanner); err != nil {
+		return fmt.Errorf("failed to scan %s, err: %v", v.BaseFileName()+".dat", err)
+	}
+	scanner.flush()
+	logrus.Infof("requested to delete %d of %d needles of volume <%d>", scanner.dropped, scanner.scanned, vid)
+
+	// 空间由master的vacuum回收, 这里只输出垃圾比例
+	for _, server := range servers {
+		err = operation.WithVolumeServerClient(server, o.GrpcDialOption, func(client volume_server_pb.VolumeServerClient) error {
+			resp, err := client.VacuumVolumeCheck(context.Background(), &volume_server_pb.VacuumVolumeCheckRequest{VolumeId: vid})
+			if err != nil {
+				return err
+			}
+			logrus.Infof("volume <%d> on %s has garbage ratio %.2f, it is vacuumed once the ratio exceeds the garbageThreshold of the master",
+				vid, server, resp.GarbageRatio)
+			return nil
+		})
+		if err != nil {
+			logrus.Warningf("failed to check the garbage ratio of volume <%d> on %s, err: %v", vid, server, err)
+		}
+	}
+	return nil
+}
+
+// ScanManifests adds the chunk manifests of the volume into o.Plan, o.Plan must be resolved
+// after all the volumes are scanned.
+func (o *OnlineRetention) ScanManifests(collection string, vid uint32) error {
+	servers, err := o.lookup(vid)
+	if err != nil {
+		return err
+	}
+	v, cleanup, err := o.open(collection, vid, servers)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return o.Plan.Scan(v, o.Stages, o.MemoryBudget, o.TmpDir)
+}
+
+// DeleteChunkedFiles deletes the chunked files dropped by o.Plan before any volume is processed,
+// each manifest is deleted together with its chunks by the volume server holding it.
+func (o *OnlineRetention) DeleteChunkedFiles() {
+	for _, file := range o.Plan.DroppedFiles() {
+		fileId, err := needle.ParseFileIdFromString(file.Manifest)
+		if err != nil {
+			logrus.Errorf("failed to parse chunk manifest %s, err: %v", file.Manifest, err)
+			o.Failed++
+			o.Plan.Keep(file.Manifest)
+			continue
+		}
+		servers, err := o.lookup(uint32(fileId.VolumeId))
+		if err != nil {
+			logrus.Errorf("failed to delete chunk manifest %s, err: %v", file.Manifest, err)
+			o.Failed++
+			o.Plan.Keep(file.Manifest)
+			continue
+		}
+		if !o.deleteManifest(servers, file.Manifest) {
+			// 没有删除的chunked file保留它的chunk
+			o.Plan.Keep(file.Manifest)
+		}
+	}
+}
+
+func (o *OnlineRetention) lookup(vid uint32) ([]string, error) {
+	lookup, err := operation.Lookup(o.Master, needle.VolumeId(vid).String())
+	if err != nil {
+		return nil, err
+	}
+	if len(lookup.Locations) == 0 {
+		return nil, fmt.Errorf("unable to locate volume %d", vid)
+	}
+	var servers []string
+	for _, loc := range lookup.Locations {
+		servers = append(servers, loc.Url)
+	}
+	return servers, nil
+}
+
+// open returns the volume in SrcDir, or copies it from the first server into TmpDir,
+// cleanup removes the copied files.
+func (o *OnlineRetention) open(collection string, vid uint32, servers []string) (location.LocalVolume, func(), error) {
+	v := location.LocalVolume{Dir: o.SrcDir, Collection: collection, Vid: vid}
+	_, err := os.Stat(v.BaseFileName() + ".idx")
+	if err == nil {
+		return v, func() {}, nil
+	}
+	if !os.IsNotExist(err) {
+		return v, nil, err
+	}
+
+	v.Dir = o.TmpDir
+	baseFileName := v.BaseFileName()
+	cleanup := func() {
+		for _, ext := range []string{".dat", ".idx", ".vif"} {
+			_ = os.Remove(baseFileName + ext)
+		}
+	}
+	if _, err = volumecopy.Copy(servers[0], o.GrpcDialOption, baseFileName, collection, vid); err != nil {
+		cleanup()
+		return v, nil, err
+	}
+	logrus.Debugf("copied volume <%d> from %s into %s", vid, servers[0], o.TmpDir)
+	return v, cleanup, nil
+}
+
+// batchDelete deletes the fids on every server, a fid counts as failed if any server fails to delete it.
+func (o *OnlineRetention) batchDelete(servers []string, fids []string) {
+	o.throttle(int64(len(fids)))
+
+	failed := make(map[string]bool)
+	notFound := make(map[string]int)
+	for _, server := range servers {
+		var results []*volume_server_pb.DeleteResult
+		op := func() error {
+			return operation.WithVolumeServerClient(server, o.GrpcDialOption, func(client volume_server_pb.VolumeServerClient) error {
+				resp, err := client.BatchDelete(context.Background(), &volume_server_pb.BatchDeleteRequest{FileIds: fids})
+				if err != nil {
+					return err
+				}
+				results = resp.Results
+				return nil
+			})
+		}
+		err := backoff.Retry(op, backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 5))
+		if err != nil {
+			logrus.Errorf("failed to delete %d needles on %s, err: %v", len(fids), server, err)
+			for _, fid := range fids {
+				failed[fid] = true
+			}
+			continue
+		}
+		for _, result := range results {
+			switch {
+			case result.Error == "":
+			case result.Status == http.StatusNotFound:
+				notFound[result.FileId]++
+			default:
+				logrus.Errorf("failed to delete needle %s on %s, err: %s", result.FileId, server, result.Error)
+				failed[result.FileId] = true
+			}
+		}
+	}
+
+	for _, fid := range fids {
+		switch {
+		case failed[fid]:
+			o.Failed++
+		case notFound[fid] == len(servers):
+			// 已经被删除或者过期
+			o.NotFound++
+		default:
+			o.Deleted++
+		}
+	}
+}
+
+// deleteManifest deletes a chunk manifest through the http api, BatchDelete refuses chunk manifests.
+// The volume server deletes the chunks first and replicates the delete of the manifest.
+func (o *OnlineRetention) deleteManifest(servers []string, fid string) bool {
+	o.throttle(1)
+	op := func() error {
+		return util.Delete("http://"+servers[0]+"/"+fid, "")
+	}
+	if err := backoff.Retry(op, backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 5)); err != nil {
+		logrus.Errorf("failed to delete chunk manifest %s on %s, err: %v", fid, servers[0], err)
+		o.Failed++
+		return false
+	}
+	o.Deleted++
+	return true
+}
+
+func (o *OnlineRetention) throttle(n int64) {
+	if o.started.IsZero() {
+		o.started = time.Now()
+	}
+	o.requested += n
+	if o.Rate <= 0 {
+		return
+	}
+	expected := time.Duration(float64(o.requested) / float64(o.Rate) * float64(time.Second))
+	if elapsed := time.Since(o.started); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+// 实现seaweedfs的VolumeFileScanner接口, 收集需要删除的fid
+type deleteScanner struct {
+	retention *OnlineRetention
+	vid       uint32
+	servers   []string
+	stages    []rewrite.Stage
+
+	fids    []string
+	scanned int64
+	dropped int64
+}
+
+func (scanner *deleteScanner) VisitSuperBlock(super_block.SuperBlock) error {
+	return nil
+}
+
+func (scanner *deleteScanner) ReadNeedleBody() bool {
+	return true
+}
+
+func (scanner *deleteScanner) VisitNeedle(n *needle.Needle, _ int64, _, _ []byte) error {
+	scanner.scanned++
+	if !rewrite.Dropped(scanner.stages, n) {
+		return nil
+	}
+	scanner.dropped++
+	fid := needle.NewFileId(needle.VolumeId(scanner.vid), uint64(n.Id), uint32(n.Cookie)).String()
+	if n.IsChunkedManifest() {
+		// 有Plan时已经由DeleteChunkedFiles删除
+		if scanner.retention.Plan == nil {
+			_ = scanner.retention.deleteManifest(scanner.servers, fid)
+		}
+		return nil
+	}
+	scanner.fids = append(scanner.fids, fid)
+	if len(scanner.fids) >= scanner.retention.BatchSize {
+		scanner.flush()
+	}
+	return nil
+}
+
+func (scanner *deleteScanner) flush() {
+	if len(scanner.fids) == 0 {
+		return
+	}
+	scanner.retention.batchDelete(scanner.servers, scanner.fids)
+	scanner.fids = scanner.fids[:0]
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	param_parser "flag"
+	"os"
+
+	"github.com/chrislusf/seaweedfs/weed/storage"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/cryptvolume"
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	myutils "github.com/amazingchow/seaweedfs-tools/pkg/utils"
+)
+
+var (
+	_SrcDir = param_parser.String("src",
+		"/mnt/locals/seeweedfsvolume/volume0/volume",
+		"backup directories holding the encrypted volumes, comma separated, same as the -dir of backup.")
+	_DstDir = param_parser.String("dst",
+		"/mnt/locals/seeweedfsvolume/volume0/volume-output",
+		"directory to store decrypted volume data files.")
+	_Collection = param_parser.String("collection",
+		"",
+		"only decrypt the volumes of this collection if provided.")
+	_VolumeId = param_parser.Int("vid",
+		-1,
+		"only decrypt this volume if provided.")
+	_Verbose = param_parser.Bool("verbose",
+		false,
+		"verbose")
+)
+
+func main() {
+	param_parser.Parse()
+
+	if *_Verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	ck, err := myutils.GetCipherKey()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	locations, err := location.NewDiskLocations(*_SrcDir)
+	if err != nil {
+		logrus.Fatalf("failed to load backup dirs %s, err: %v", *_SrcDir, err)
+	}
+	volumes, err := locations.Volumes()
+	if err != nil {
+		logrus.Fatalf("failed to list volumes in %s, err: %v", *_SrcDir, err)
+	}
+
+	var decrypted int
+	for _, v := range volumes {
+		if *_Collection != "" && v.Collection != *_Collection {
+			continue
+		}
+		if *_VolumeId != -1 && v.Vid != uint32(*_VolumeId) {
+			continue
+		}
+		state, err := cryptvolume.LoadState(v.BaseFileName())
+		if err != nil {
+			logrus.Fatalf("failed to load %s%s, err: %v", v.BaseFileName(), cryptvolume.StateFileExt, err)
+		}
+		if state == nil {
+			logrus.Debugf("skip volume <%d>, it is not encrypted", v.Vid)
+			continue
+		}
+
+		dstBaseFileName := storage.VolumeFileName(*_DstDir, v.Collection, int(v.Vid))
+		if _, err = os.Stat(dstBaseFileName + ".dat"); err == nil {
+			logrus.Fatalf("%s.dat already exists", dstBaseFileName)
+		}
+		volumeFileScanner := &VolumeFileScanner4Decryptor{
+			DstBaseFileName: dstBaseFileName,
+			CipherKey:       ck,
+			StopOffset:      int64(state.LocalDatSize),
+		}
+		err = storage.ScanVolumeFile(v.Dir, v.Collection, needle.VolumeId(v.Vid), storage.NeedleMapInMemory, volumeFileScanner)
+		if closeErr := volumeFileScanner.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(dstBaseFileName + ".dat")
+			_ = os.Remove(dstBaseFileName + ".idx")
+			logrus.Fatalf("failed to decrypt %s.dat, err: %v", v.BaseFileName(), err)
+		}
+		logrus.Infof("decrypted %d needles of %s.dat into %s.dat", volumeFileScanner.Counter(), v.BaseFileName(), dstBaseFileName)
+		decrypted++
+	}
+	logrus.Infof("totally decrypted %d volumes", decrypted)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/backend"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/cryptvolume"
+	myutils "github.com/amazingchow/seaweedfs-tools/pkg/utils"
+)
+
+// 实现seaweedfs的VolumeFileScanner接口, 按照写入顺序解密每一个needle, 删除记录原样保留
+type VolumeFileScanner4Decryptor struct {
+	version        needle.Version
+	counter        int64
+	dstDataBackend *backend.DiskFile
+	dstIndexFile   *os.File
+
+	DstBaseFileName string
+	CipherKey       myutils.CipherKey
+	// 超出该位置的数据是同步中断时写入的, 不做处理
+	StopOffset int64
+}
+
+func (scanner *VolumeFileScanner4Decryptor) VisitSuperBlock(superBlock super_block.SuperBlock) error {
+	scanner.version = superBlock.Version
+
+	datFile, err := os.OpenFile(scanner.DstBaseFileName+".dat", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	scanner.dstDataBackend = backend.NewDiskFile(datFile)
+	if _, err = scanner.dstDataBackend.WriteAt(superBlock.Bytes(), 0); err != nil {
+		return err
+	}
+	scanner.dstIndexFile, err = os.OpenFile(scanner.DstBaseFileName+".idx", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	return err
+}
+
+func (scanner *VolumeFileScanner4Decryptor) ReadNeedleBody() bool {
+	return true
+}
+
+func (scanner *VolumeFileScanner4Decryptor) VisitNeedle(n *needle.Needle, offset int64, _, _ []byte) error {
+	if offset >= scanner.StopOffset {
+		return io.EOF
+	}
+	deleted := n.Size == 0 || n.Size == types.TombstoneFileSize
+	if !deleted {
+		if err := cryptvolume.DecryptNeedle(n, scanner.CipherKey); err != nil {
+			return err
+		}
+	}
+	// Append保留原有的AppendAtNs, 恢复出来的volume可以继续与主集群增量同步
+	dstOffset, _, _, err := n.Append(scanner.dstDataBackend, scanner.version)
+	if err != nil {
+		return err
+	}
+	size := n.Size
+	if deleted {
+		size = types.TombstoneFileSize
+	}
+	if _, err = scanner.dstIndexFile.Write(needle_map.ToBytes(n.Id, types.ToOffset(int64(dstOffset)), size)); err != nil {
+		return err
+	}
+	scanner.counter++
+	return nil
+}
+
+func (scanner *VolumeFileScanner4Decryptor) Counter() int64 {
+	return scanner.counter
+}
+
+func (scanner *VolumeFileScanner4Decryptor) Close() error {
+	var err error
+	if scanner.dstDataBackend != nil {
+		if err = scanner.dstDataBackend.File.Sync(); err == nil {
+			err = scanner.dstDataBackend.Close()
+		}
+	}
+	if scanner.dstIndexFile != nil {
+		if e := scanner.dstIndexFile.Sync(); e != nil && err == nil {
+			err = e
+		}
+		if e := scanner.dstIndexFile.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/storage"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+)
+
+type DrillResult struct {
+	Time             time.Time `json:"time"`
+	Collection       string    `json:"collection"`
+	VolumeId         uint32    `json:"volume_id"`
+	Dir              string    `json:"dir"`
+	Version          uint8     `json:"version"`
+	ReplicaPlacement string    `json:"replica_placement"`
+	Ttl              string    `json:"ttl"`
+	DatSize          int64     `json:"dat_size"`
+	Needles          int       `json:"needles"`
+	Sampled          int       `json:"sampled"`
+	Passed           bool      `json:"passed"`
+	Errors           []string  `json:"errors,omitempty"`
+}
+
+func (r *DrillResult) fail(format string, args ...interface{}) {
+	r.Passed = false
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+type Driller struct {
+	// 临时目录, volume server加载volume时会生成.sdx/.vif等文件, 不能写入备份目录
+	WorkDir string
+	Samples int
+}
+
+// Drill loads the volume the way a volume server does and checks that it can be served.
+func (d *Driller) Drill(v location.LocalVolume) *DrillResult {
+	r := &DrillResult{
+		Time:       time.Now(),
+		Collection: v.Collection,
+		VolumeId:   v.Vid,
+		Dir:        v.Dir,
+		Passed:     true,
+	}
+
+	// 在临时目录中通过符号链接加载volume, 备份目录保持不变
+	scratch, err := ioutil.TempDir(d.WorkDir, "drill_")
+	if err != nil {
+		r.fail("failed to create scratch dir, err: %v", err)
+		return r
+	}
+	defer os.RemoveAll(scratch)
+	for _, ext := range []string{".dat", ".idx"} {
+		src := v.BaseFileName() + ext
+		abs, err := filepath.Abs(src)
+		if err != nil {
+			r.fail("failed to resolve %s, err: %v", src, err)
+			return r
+		}
+		if err = os.Symlink(abs, storage.VolumeFileName(scratch, v.Collection, int(v.Vid))+ext); err != nil {
+			r.fail("failed to link %s, err: %v", src, err)
+			return r
+		}
+	}
+	// volume server会改写.vif, 只能复制
+	if data, err := ioutil.ReadFile(v.BaseFileName() + ".vif"); err == nil {
+		if err = ioutil.WriteFile(storage.VolumeFileName(scratch, v.Collection, int(v.Vid))+".vif", data, 0644); err != nil {
+			r.fail("failed to copy .vif, err: %v", err)
+			return r
+		}
+	} else if !os.IsNotExist(err) {
+		r.fail("failed to read .vif, err: %v", err)
+		return r
+	}
+
+	// 空的.dat会被写入superblock
+	info, err := os.Stat(v.BaseFileName() + ".dat")
+	if err != nil {
+		r.fail("missing .dat, err: %v", err)
+		return r
+	}
+	if _, err = os.Stat(v.BaseFileName() + ".idx"); err != nil {
+		r.fail("missing .idx, err: %v", err)
+		return r
+	}
+	if info.Size() < super_block.SuperBlockSize {
+		r.fail(".dat of %d bytes has no superblock", info.Size())
+		return r
+	}
+	// .dat没有写权限时, volume server以只读方式打开.dat和.idx, 加载结束后恢复原来的权限
+	if info.Mode()&0222 != 0 {
+		if err = os.Chmod(v.BaseFileName()+".dat", info.Mode()&^0222); err != nil {
+			r.fail("failed to make .dat read-only, err: %v", err)
+			return r
+		}
+		defer func() {
+			if err := os.Chmod(v.BaseFileName()+".dat", info.Mode()); err != nil {
+				r.fail("failed to restore the mode of .dat, err: %v", err)
+			}
+		}()
+	}
+
+	vol, err := storage.NewVolume(scratch, v.Collection, needle.VolumeId(v.Vid), storage.NeedleMapInMemory, nil, nil, 0, 0)
+	if err != nil {
+		r.fail("failed to load volume, err: %v", err)
+		return r
+	}
+	defer vol.Close()
+	if !vol.ToVolumeInformationMessage().ReadOnly {
+		r.fail("volume is loaded writable")
+		return r
+	}
+
+	sb := vol.SuperBlock
+	r.Version = uint8(sb.Version)
+	if sb.Version < needle.Version1 || sb.Version > needle.CurrentVersion {
+		r.fail("unsupported superblock version %d", sb.Version)
+		return r
+	}
+	if sb.ReplicaPlacement == nil {
+		r.fail("no replica placement in the superblock")
+	} else {
+		r.ReplicaPlacement = sb.ReplicaPlacement.String()
+	}
+	if sb.Ttl == nil {
+		r.fail("no ttl in the superblock")
+	} else {
+		r.Ttl = sb.Ttl.String()
+		if _, err = needle.ReadTTL(r.Ttl); err != nil {
+			r.fail("invalid ttl %s, err: %v", r.Ttl, err)
+		}
+	}
+
+	datSize, _, _ := vol.FileStat()
+	r.DatSize = int64(datSize)
+
+	// 与volume server启动时相同的检查: .idx的大小以及最后一个entry指向的needle
+	idxFile, err := os.Open(v.BaseFileName() + ".idx")
+	if err != nil {
+		r.fail("failed to open .idx, err: %v", err)
+		return r
+	}
+	defer idxFile.Close()
+	if _, err = storage.CheckVolumeDataIntegrity(vol, idxFile); err != nil {
+		r.fail("the last .idx entry does not match .dat, err: %v", err)
+	}
+
+	nm := needle_map.NewMemDb()
+	defer nm.Close()
+	if err = nm.LoadFromIdx(v.BaseFileName() + ".idx"); err != nil {
+		r.fail("failed to load .idx, err: %v", err)
+		return r
+	}
+	var live []needle_map.NeedleValue
+	err = nm.AscendingVisit(func(nv needle_map.NeedleValue) error {
+		if nv.Size == 0 || nv.Size == types.TombstoneFileSize {
+			return nil
+		}
+		offset := nv.Offset.ToAcutalOffset()
+		if offset < int64(sb.BlockSize()) || offset+needle.GetActualSize(nv.Size, sb.Version) > r.DatSize {
+			return fmt.Errorf("needle %v at offset %d with size %d is out of .dat of %d bytes", nv.Key, offset, nv.Size, r.DatSize)
+		}
+		live = append(live, nv)
+		return nil
+	})
+	if err != nil {
+		r.fail("%v", err)
+		return r
+	}
+	r.Needles = len(live)
+
+	for _, nv := range d.sample(live) {
+		n := new(needle.Needle)
+		if err = n.ReadData(vol.DataBackend, nv.Offset.ToAcutalOffset(), nv.Size, sb.Version); err != nil {
+			r.fail("failed to read needle %v, err: %v", nv.Key, err)
+			continue
+		}
+		if n.Id != nv.Key {
+			r.fail("needle at offset %d has id %v, but .idx says %v", nv.Offset.ToAcutalOffset(), n.Id, nv.Key)
+		}
+		r.Sampled++
+	}
+	return r
+}
+
+// sample picks d.Samples needles at random, the last written needle is always included.
+func (d *Driller) sample(live []needle_map.NeedleValue) []needle_map.NeedleValue {
+	if d.Samples <= 0 || len(live) <= d.Samples {
+		return live
+	}
+	last := 0
+	for i, nv := range live {
+		if nv.Offset.ToAcutalOffset() > live[last].Offset.ToAcutalOffset() {
+			last = i
+		}
+	}
+	picked := []needle_map.NeedleValue{live[last]}
+	for _, i := range rand.Perm(len(live))[:d.Samples-1] {
+		if i != last {
+			picked = append(picked, live[i])
+		}
+	}
+	return picked
+}
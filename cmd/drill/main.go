@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	param_parser "flag"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+)
+
+var (
+	_Dir = param_parser.String("dir",
+		"/mnt/locals/seeweedfsvolume/volume0/volume",
+		"backup directories, comma separated, same as the -dir of backup.")
+	_Collection = param_parser.String("collection",
+		"",
+		"only drill the volumes of this collection if provided.")
+	_Samples = param_parser.Int("samples",
+		100,
+		"number of needles to read from each volume, 0 means all the needles")
+	_WorkDir = param_parser.String("work_dir",
+		"",
+		"scratch directory to load the volumes in, default to the system temp dir, must not be a backup dir")
+	_Report = param_parser.String("report",
+		"",
+		"file to write the result of every volume into, one json per line")
+	_Verbose = param_parser.Bool("verbose",
+		false,
+		"verbose")
+)
+
+func main() {
+	param_parser.Parse()
+
+	if *_Verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	rand.Seed(time.Now().UnixNano())
+
+	locations, err := location.NewDiskLocations(*_Dir)
+	if err != nil {
+		logrus.Fatalf("failed to load backup dirs %s, err: %v", *_Dir, err)
+	}
+	for _, dir := range locations.Dirs {
+		if *_WorkDir != "" && strings.TrimRight(dir, "/") == strings.TrimRight(*_WorkDir, "/") {
+			logrus.Fatalf("-work_dir must not be a backup dir")
+		}
+	}
+	volumes, err := locations.Volumes()
+	if err != nil {
+		logrus.Fatalf("failed to list volumes in %s, err: %v", *_Dir, err)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		if volumes[i].Collection != volumes[j].Collection {
+			return volumes[i].Collection < volumes[j].Collection
+		}
+		return volumes[i].Vid < volumes[j].Vid
+	})
+
+	var report *os.File
+	if *_Report != "" {
+		report, err = os.OpenFile(*_Report, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			logrus.Fatalf("failed to open drill report %s, err: %v", *_Report, err)
+		}
+		defer report.Close()
+	}
+
+	driller := &Driller{WorkDir: *_WorkDir, Samples: *_Samples}
+	var passed, failed int
+	for _, v := range volumes {
+		if *_Collection != "" && v.Collection != *_Collection {
+			continue
+		}
+		r := driller.Drill(v)
+		if r.Passed {
+			passed++
+			logrus.Infof("PASS volume <%d> of collection <%s> in %s, version %d, replication %s, ttl %s, %d needles, %d sampled",
+				r.VolumeId, r.Collection, r.Dir, r.Version, r.ReplicaPlacement, r.Ttl, r.Needles, r.Sampled)
+		} else {
+			failed++
+			logrus.Errorf("FAIL volume <%d> of collection <%s> in %s: %s",
+				r.VolumeId, r.Collection, r.Dir, strings.Join(r.Errors, "; "))
+		}
+		if report != nil {
+			data, _ := json.Marshal(r)
+			if _, err = report.Write(append(data, '\n')); err != nil {
+				logrus.Errorf("failed to write drill report, err: %v", err)
+			}
+		}
+	}
+
+	logrus.Infof("drilled %d volumes, %d passed, %d failed", passed+failed, passed, failed)
+	if failed > 0 {
+		if report != nil {
+			_ = report.Close()
+		}
+		// 以非0退出, 方便定时任务告警
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	param_parser "flag"
+	"os"
+	"strings"
+
+	"github.com/chrislusf/seaweedfs/weed/pb"
+	"github.com/chrislusf/seaweedfs/weed/pb/filer_pb"
+	"github.com/chrislusf/seaweedfs/weed/security"
+	"github.com/chrislusf/seaweedfs/weed/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/filermeta"
+)
+
+var (
+	_Files = param_parser.String("files",
+		"",
+		"comma separated filer meta files exported by backup, imported in the given order, usually only the latest one is needed.")
+	_FilerGrpc = param_parser.String("filer_grpc",
+		"localhost:18888",
+		"seaweedfs filer server grpc endpoint")
+	_SkipExisting = param_parser.Bool("skip_existing",
+		false,
+		"skip the entries which already exist on the filer instead of overwriting them")
+	_Verbose = param_parser.Bool("verbose",
+		false,
+		"verbose")
+)
+
+func main() {
+	param_parser.Parse()
+
+	if *_Verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	if *_Files == "" {
+		logrus.Warning("no filer meta file provided")
+		return
+	}
+
+	util.LoadConfiguration("security", false)
+	grpcDialOption := security.LoadClientTLS(util.GetViper(), "grpc.client")
+
+	for _, filename := range strings.Split(*_Files, ",") {
+		filename = strings.TrimSpace(filename)
+		if filename == "" {
+			continue
+		}
+		file, err := os.Open(filename)
+		if err != nil {
+			logrus.Fatalf("failed to open %s, err: %v", filename, err)
+		}
+
+		logrus.Infof("ready to import %s", filename)
+
+		var imported, skipped int64
+		err = pb.WithGrpcFilerClient(*_FilerGrpc, grpcDialOption, func(client filer_pb.SeaweedFilerClient) error {
+			var importErr error
+			imported, importErr = filermeta.Import(client, file, *_SkipExisting, func(req *filer_pb.CreateEntryRequest, err error) error {
+				if err == filermeta.ErrEntryExists {
+					logrus.Debugf("skip %s/%s, as it already exists", req.Directory, req.Entry.Name)
+					skipped++
+					return nil
+				}
+				if err == nil {
+					logrus.Debugf("imported %s/%s", req.Directory, req.Entry.Name)
+				}
+				return err
+			})
+			return importErr
+		})
+		_ = file.Close()
+		if err != nil {
+			logrus.Fatalf("failed to import %s into <%s>, err: %v", filename, *_FilerGrpc, err)
+		}
+
+		logrus.Infof("finish to import %s", filename)
+		logrus.Infof("totally imported %d entries, %d entries skipped", imported-skipped, skipped)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/operation"
+	"github.com/chrislusf/seaweedfs/weed/pb/volume_server_pb"
+	"github.com/chrislusf/seaweedfs/weed/storage/backend"
+	"github.com/chrislusf/seaweedfs/weed/storage/idx"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+	"google.golang.org/grpc"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/cryptvolume"
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+)
+
+// 单个volume的备份延迟
+type VolumeLag struct {
+	Collection string
+	VolumeId   uint32
+	Server     string
+	// 备份目录中不存在该volume
+	Missing bool
+
+	SourceTailOffset    uint64
+	LocalTailOffset     uint64
+	LocalLastAppendAtNs uint64
+	// 主集群中第一个还没有备份的needle的写入时间, 为0表示没有未备份的needle
+	OldestUnsyncedAppendAtNs uint64
+
+	LagBytes   uint64
+	LagSeconds float64
+}
+
+type LagMeter struct {
+	Master         string
+	GrpcDialOption grpc.DialOption
+	Locations      *location.DiskLocations
+}
+
+// Measure measures the lag of a volume, version is the needle version of the source volume.
+func (m *LagMeter) Measure(collection string, vid uint32, version needle.Version, now time.Time) (*VolumeLag, error) {
+	lag := &VolumeLag{Collection: collection, VolumeId: vid}
+
+	lookup, err := operation.Lookup(m.Master, needle.VolumeId(vid).String())
+	if err != nil {
+		return nil, err
+	}
+	if len(lookup.Locations) == 0 {
+		return nil, fmt.Errorf("unable to locate volume %d", vid)
+	}
+	lag.Server = lookup.Locations[0].Url
+
+	status, err := operation.GetVolumeSyncStatus(lag.Server, m.GrpcDialOption, vid)
+	if err != nil {
+		return nil, err
+	}
+	lag.SourceTailOffset = status.TailOffset
+
+	if dir, ok := m.Locations.Find(collection, vid); ok {
+		v := location.LocalVolume{Dir: dir, Collection: collection, Vid: vid}
+		state, err := cryptvolume.LoadState(v.BaseFileName())
+		if err != nil {
+			return nil, err
+		}
+		if state != nil {
+			// 加密备份的本地offset与主集群不一致, 使用记录下来的主集群位置
+			lag.LocalTailOffset, lag.LocalLastAppendAtNs = state.SourceTailOffset, state.LastAppendAtNs
+		} else {
+			lag.LocalTailOffset, lag.LocalLastAppendAtNs, err = readLocalTail(v.BaseFileName())
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		lag.Missing = true
+	}
+
+	if lag.SourceTailOffset <= lag.LocalTailOffset {
+		return lag, nil
+	}
+	lag.LagBytes = lag.SourceTailOffset - lag.LocalTailOffset
+	// Version3之前的needle没有AppendAtNs, 只能统计落后的字节数
+	if version < needle.Version3 {
+		return lag, nil
+	}
+
+	lag.OldestUnsyncedAppendAtNs, err = m.oldestUnsyncedAppendAtNs(lag.Server, vid, version, lag.LocalLastAppendAtNs)
+	if err != nil {
+		return nil, err
+	}
+	if lag.OldestUnsyncedAppendAtNs > 0 {
+		lag.LagSeconds = now.Sub(time.Unix(0, int64(lag.OldestUnsyncedAppendAtNs))).Seconds()
+		if lag.LagSeconds < 0 {
+			lag.LagSeconds = 0
+		}
+	}
+	return lag, nil
+}
+
+// oldestUnsyncedAppendAtNs asks the source for the first needle appended after sinceNs,
+// the stream is canceled as soon as that needle is received.
+func (m *LagMeter) oldestUnsyncedAppendAtNs(server string, vid uint32, version needle.Version, sinceNs uint64) (uint64, error) {
+	var appendAtNs uint64
+	err := operation.WithVolumeServerClient(server, m.GrpcDialOption, func(client volume_server_pb.VolumeServerClient) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stream, err := client.VolumeTailSender(ctx, &volume_server_pb.VolumeTailSenderRequest{
+			VolumeId:           vid,
+			SinceNs:            sinceNs,
+			IdleTimeoutSeconds: 1,
+		})
+		if err != nil {
+			return err
+		}
+		var header, body []byte
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if len(header) == 0 {
+				if len(resp.NeedleHeader) == 0 {
+					continue
+				}
+				header = resp.NeedleHeader
+			}
+			body = append(body, resp.NeedleBody...)
+			if resp.IsLastChunk {
+				break
+			}
+		}
+		n := new(needle.Needle)
+		n.ParseNeedleHeader(header)
+		if err = n.ReadNeedleBodyBytes(body, version); err != nil {
+			return err
+		}
+		appendAtNs = n.AppendAtNs
+		return nil
+	})
+	return appendAtNs, err
+}
+
+// readLocalTail returns the .dat size and the AppendAtNs of the last appended needle of a local volume.
+func readLocalTail(baseFileName string) (datSize uint64, appendAtNs uint64, err error) {
+	datFile, err := os.Open(baseFileName + ".dat")
+	if err != nil {
+		return 0, 0, err
+	}
+	datBackend := backend.NewDiskFile(datFile)
+	defer datBackend.Close()
+	size, _, err := datBackend.GetStat()
+	if err != nil {
+		return 0, 0, err
+	}
+	datSize = uint64(size)
+
+	offset, err := readLastIndexOffset(baseFileName + ".idx")
+	if err != nil || offset.IsZero() {
+		return datSize, 0, err
+	}
+	sb, err := super_block.ReadSuperBlock(datBackend)
+	if err != nil {
+		return datSize, 0, err
+	}
+	n, _, bodyLength, err := needle.ReadNeedleHeader(datBackend, sb.Version, offset.ToAcutalOffset())
+	if err != nil {
+		return datSize, 0, err
+	}
+	if _, err = n.ReadNeedleBody(datBackend, sb.Version, offset.ToAcutalOffset()+int64(types.NeedleHeaderSize), bodyLength); err != nil {
+		return datSize, 0, err
+	}
+	return datSize, n.AppendAtNs, nil
+}
+
+func readLastIndexOffset(idxFileName string) (types.Offset, error) {
+	indexFile, err := os.Open(idxFileName)
+	if err != nil {
+		return types.Offset{}, err
+	}
+	defer indexFile.Close()
+	info, err := indexFile.Stat()
+	if err != nil {
+		return types.Offset{}, err
+	}
+	size := info.Size()
+	if size%types.NeedleMapEntrySize != 0 {
+		return types.Offset{}, fmt.Errorf("unexpected file %s size: %d", idxFileName, size)
+	}
+	if size == 0 {
+		return types.Offset{}, nil
+	}
+	bytes := make([]byte, types.NeedleMapEntrySize)
+	if _, err = indexFile.ReadAt(bytes, size-types.NeedleMapEntrySize); err != nil {
+		return types.Offset{}, err
+	}
+	_, offset, _ := idx.IdxFileEntry(bytes)
+	return offset, nil
+}
+
+type LagSummary struct {
+	Time        time.Time
+	Volumes     int
+	Behind      int
+	TotalBytes  uint64
+	WorstBytes  uint64
+	WorstSecond float64
+	P50Seconds  float64
+	P90Seconds  float64
+	P99Seconds  float64
+	Collections map[string]*CollectionLag
+}
+
+type CollectionLag struct {
+	Volumes     int
+	TotalBytes  uint64
+	WorstSecond float64
+}
+
+func Summarize(lags []*VolumeLag, now time.Time) *LagSummary {
+	s := &LagSummary{Time: now, Volumes: len(lags), Collections: make(map[string]*CollectionLag)}
+	seconds := make([]float64, 0, len(lags))
+	for _, lag := range lags {
+		c, ok := s.Collections[lag.Collection]
+		if !ok {
+			c = &CollectionLag{}
+			s.Collections[lag.Collection] = c
+		}
+		c.Volumes++
+		c.TotalBytes += lag.LagBytes
+		if lag.LagSeconds > c.WorstSecond {
+			c.WorstSecond = lag.LagSeconds
+		}
+		if lag.LagBytes > 0 {
+			s.Behind++
+		}
+		s.TotalBytes += lag.LagBytes
+		if lag.LagBytes > s.WorstBytes {
+			s.WorstBytes = lag.LagBytes
+		}
+		if lag.LagSeconds > s.WorstSecond {
+			s.WorstSecond = lag.LagSeconds
+		}
+		seconds = append(seconds, lag.LagSeconds)
+	}
+	sort.Float64s(seconds)
+	s.P50Seconds = percentile(seconds, 50)
+	s.P90Seconds = percentile(seconds, 90)
+	s.P99Seconds = percentile(seconds, 99)
+	return s
+}
+
+// percentile uses the nearest-rank method, sorted must be in ascending order.
+func percentile(sorted []float64, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
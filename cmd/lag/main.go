@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	param_parser "flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/pb/master_pb"
+	"github.com/chrislusf/seaweedfs/weed/security"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/shard"
+	myutils "github.com/amazingchow/seaweedfs-tools/pkg/utils"
+)
+
+var (
+	_Dir = param_parser.String("dir",
+		"/mnt/locals/seeweedfsvolume/volume0/volume",
+		"backup directories, comma separated, same as the -dir of backup.")
+	_MasterHttp = param_parser.String("master_http",
+		"localhost:9333",
+		"seaweedfs master server http endpoint of the primary cluster")
+	_MasterGrpc = param_parser.String("master_grpc",
+		"localhost:19333",
+		"seaweedfs master server grpc endpoint of the primary cluster")
+	_History = param_parser.String("history",
+		"",
+		"csv file to append the lag summary of each run into, so that the lag can be plotted over time")
+	_Interval = param_parser.Duration("interval",
+		0,
+		"keep measuring the lag at this interval, measure once and exit if not provided")
+	_MetricsAddress = param_parser.String("metrics_address",
+		"",
+		"prometheus push gateway address, e.g. localhost:9091, push the lag metrics after each run if provided")
+	_ShardIndex = param_parser.Int("shard_index",
+		0,
+		"index of this backup host among all the backup hosts, same as the -shard_index of backup")
+	_ShardCount = param_parser.Int("shard_count",
+		1,
+		"number of backup hosts sharing the volumes, same as the -shard_count of backup")
+	_AffinityDC = param_parser.String("affinity_dc",
+		"",
+		"optional comma separated data centers, same as the -affinity_dc of backup")
+	_Verbose = param_parser.Bool("verbose",
+		false,
+		"verbose")
+)
+
+var (
+	lagSecondsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "SeaweedFS",
+			Subsystem: "backup",
+			Name:      "lag_seconds",
+			Help:      "Age of the oldest write not yet backed up.",
+		}, []string{"collection", "volume"})
+	lagBytesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "SeaweedFS",
+			Subsystem: "backup",
+			Name:      "lag_bytes",
+			Help:      "Bytes not yet backed up.",
+		}, []string{"collection", "volume"})
+	worstLagSecondsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "SeaweedFS",
+			Subsystem: "backup",
+			Name:      "worst_lag_seconds",
+			Help:      "Worst lag among all the volumes.",
+		})
+)
+
+func main() {
+	param_parser.Parse()
+
+	if *_Verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	locations, err := location.NewDiskLocations(*_Dir)
+	if err != nil {
+		logrus.Fatalf("failed to load backup dirs %s, err: %v", *_Dir, err)
+	}
+
+	sharding, err := shard.NewSharding(*_ShardIndex, *_ShardCount, "", *_AffinityDC)
+	if err != nil {
+		logrus.Fatalf("failed to set up sharding, err: %v", err)
+	}
+
+	util.LoadConfiguration("security", false)
+	meter := &LagMeter{
+		Master:         *_MasterHttp,
+		GrpcDialOption: security.LoadClientTLS(util.GetViper(), "grpc.client"),
+		Locations:      locations,
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(lagSecondsGauge, lagBytesGauge, worstLagSecondsGauge)
+
+	for {
+		if err = runOnce(meter, sharding, registry); err != nil {
+			if *_Interval == 0 {
+				logrus.Fatal(err)
+			}
+			logrus.Error(err)
+		}
+		if *_Interval == 0 {
+			return
+		}
+		time.Sleep(*_Interval)
+	}
+}
+
+func runOnce(meter *LagMeter, sharding *shard.Sharding, registry *prometheus.Registry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	// TODO: add more dial options
+	conn, err := grpc.Dial(*_MasterGrpc, grpc.WithInsecure())
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s, err: %v", *_MasterGrpc, err)
+	}
+	defer conn.Close()
+	resp, err := master_pb.NewSeaweedClient(conn).VolumeList(ctx, &master_pb.VolumeListRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list volume info from %s, err: %v", *_MasterGrpc, err)
+	}
+
+	now := time.Now()
+	var lags []*VolumeLag
+	versions := myutils.CollectVolumeVersions(resp.TopologyInfo)
+	// 只统计分配给本机的volume, 其它分片的volume不在本机备份
+	collectionMap := sharding.Filter(myutils.CollectVolumeInfo(resp.TopologyInfo, false),
+		myutils.CollectVolumeDataCenters(resp.TopologyInfo))
+	for collection, vids := range collectionMap {
+		for _, vid := range vids {
+			lag, err := meter.Measure(collection, vid, needle.Version(versions[vid]), now)
+			if err != nil {
+				logrus.Errorf("failed to measure the lag of volume <%d>, err: %v", vid, err)
+				continue
+			}
+			lags = append(lags, lag)
+		}
+	}
+	sort.Slice(lags, func(i, j int) bool {
+		if lags[i].Collection != lags[j].Collection {
+			return lags[i].Collection < lags[j].Collection
+		}
+		return lags[i].VolumeId < lags[j].VolumeId
+	})
+	summary := Summarize(lags, now)
+
+	if err = printLags(os.Stdout, lags, summary); err != nil {
+		return err
+	}
+	if *_History != "" {
+		if err = appendHistory(*_History, summary); err != nil {
+			return fmt.Errorf("failed to append lag history into %s, err: %v", *_History, err)
+		}
+	}
+	if *_MetricsAddress != "" {
+		lagSecondsGauge.Reset()
+		lagBytesGauge.Reset()
+		for _, lag := range lags {
+			vid := strconv.Itoa(int(lag.VolumeId))
+			lagSecondsGauge.WithLabelValues(lag.Collection, vid).Set(lag.LagSeconds)
+			lagBytesGauge.WithLabelValues(lag.Collection, vid).Set(float64(lag.LagBytes))
+		}
+		worstLagSecondsGauge.Set(summary.WorstSecond)
+		hostname, _ := os.Hostname()
+		err = push.New(*_MetricsAddress, "backup_lag").Gatherer(registry).Grouping("instance", hostname).Push()
+		if err != nil {
+			return fmt.Errorf("failed to push metrics to %s, err: %v", *_MetricsAddress, err)
+		}
+	}
+	return nil
+}
+
+func printLags(w io.Writer, lags []*VolumeLag, summary *LagSummary) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTION\tVOLUME\tSERVER\tSOURCE TAIL\tLOCAL TAIL\tLAG BYTES\tLAG SECONDS")
+	for _, lag := range lags {
+		localTail := strconv.FormatUint(lag.LocalTailOffset, 10)
+		if lag.Missing {
+			localTail = "missing"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%s\t%d\t%.0f\n",
+			lag.Collection, lag.VolumeId, lag.Server, lag.SourceTailOffset, localTail, lag.LagBytes, lag.LagSeconds)
+	}
+	fmt.Fprintln(tw)
+
+	collections := make([]string, 0, len(summary.Collections))
+	for collection := range summary.Collections {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+	fmt.Fprintln(tw, "COLLECTION\tVOLUMES\tLAG BYTES\tWORST LAG SECONDS")
+	for _, collection := range collections {
+		c := summary.Collections[collection]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.0f\n", collection, c.Volumes, c.TotalBytes, c.WorstSecond)
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintf(tw, "volumes behind:\t%d of %d\n", summary.Behind, summary.Volumes)
+	fmt.Fprintf(tw, "total lag bytes:\t%d\n", summary.TotalBytes)
+	fmt.Fprintf(tw, "worst lag:\t%.0fs, %d bytes\n", summary.WorstSecond, summary.WorstBytes)
+	fmt.Fprintf(tw, "lag seconds p50/p90/p99:\t%.0f/%.0f/%.0f\n", summary.P50Seconds, summary.P90Seconds, summary.P99Seconds)
+	return tw.Flush()
+}
+
+func appendHistory(filename string, summary *LagSummary) error {
+	_, err := os.Stat(filename)
+	isNew := os.IsNotExist(err)
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if isNew {
+		_, err = fmt.Fprintln(file, "time,volumes,behind,total_lag_bytes,worst_lag_bytes,worst_lag_seconds,p50_lag_seconds,p90_lag_seconds,p99_lag_seconds")
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(file, "%s,%d,%d,%d,%d,%.0f,%.0f,%.0f,%.0f\n",
+		summary.Time.Format(time.RFC3339), summary.Volumes, summary.Behind, summary.TotalBytes, summary.WorstBytes,
+		summary.WorstSecond, summary.P50Seconds, summary.P90Seconds, summary.P99Seconds)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	param_parser "flag"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/batch"
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+)
+
+var (
+	_Dir = param_parser.String("dir",
+		"/mnt/locals/seeweedfsvolume/volume0/volume",
+		"directory holding the volume, same as the -src of compactor and transformer.")
+	_Collection = param_parser.String("collection",
+		"",
+		"the volume collection name.")
+	_VolumeId = param_parser.Int("vid",
+		-1,
+		"the volume id.")
+	_Generation = param_parser.Int("generation",
+		-1,
+		"the generation to restore, default to the latest one.")
+	_MasterGrpc = param_parser.String("master_grpc",
+		"localhost:19333",
+		"seaweedfs master server grpc endpoint, used with -volume_server.")
+	_VolumeServer = param_parser.String("volume_server",
+		"",
+		"address of the volume server serving -dir as registered in the master, e.g. 10.0.2.15:8080, if provided the volume is unmounted from it before its files are restored and mounted back afterwards, otherwise the volume server must be stopped.")
+	_List = param_parser.Bool("list",
+		false,
+		"only list the generations of the volume.")
+	_Verbose = param_parser.Bool("verbose",
+		false,
+		"verbose")
+)
+
+func main() {
+	param_parser.Parse()
+
+	if *_Verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	if err := batch.Recover(*_Dir); err != nil {
+		logrus.Fatalf("failed to recover unfinished swaps in %s, err: %v", *_Dir, err)
+	}
+	if *_VolumeId == -1 {
+		logrus.Warning("no volume id provided")
+		return
+	}
+
+	v := location.LocalVolume{Dir: *_Dir, Collection: *_Collection, Vid: uint32(*_VolumeId)}
+	generations, err := batch.Generations(v)
+	if err != nil {
+		logrus.Fatalf("failed to list generations of volume <%d>, err: %v", v.Vid, err)
+	}
+	if *_List {
+		for _, generation := range generations {
+			info, err := os.Stat(batch.GenerationBase(v, generation) + ".dat")
+			if err != nil {
+				continue
+			}
+			fmt.Printf("generation %d, .dat %d bytes, last modified at %v\n", generation, info.Size(), info.ModTime())
+		}
+		return
+	}
+	if len(generations) == 0 {
+		logrus.Fatalf("volume <%d> of collection <%s> has no generation to restore", v.Vid, v.Collection)
+	}
+
+	generation := *_Generation
+	if generation == -1 {
+		generation = generations[len(generations)-1]
+	}
+	rollback := func(v location.LocalVolume) (int64, error) {
+		return 0, batch.Rollback(v, generation)
+	}
+	if *_VolumeServer != "" {
+		coordinator, err := batch.NewCoordinator(*_VolumeServer, *_MasterGrpc)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		rollback = coordinator.Wrap(rollback)
+	} else {
+		logrus.Warningf("no volume server provided, make sure no volume server is serving volume <%d> in %s", v.Vid, *_Dir)
+	}
+	if _, err = rollback(v); err != nil {
+		logrus.Fatalf("failed to restore generation %d of volume <%d>, err: %v", generation, v.Vid, err)
+	}
+	logrus.Infof("restored generation %d of volume <%d> of collection <%s>, the replaced files are kept as a new generation",
+		generation, v.Vid, v.Collection)
+}
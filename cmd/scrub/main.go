@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	param_parser "flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+)
+
+const (
+	scrubStateFile  = "scrub.state"
+	scrubReportFile = "scrub.report"
+)
+
+var (
+	_Dir = param_parser.String("dir",
+		"/mnt/locals/seeweedfsvolume/volume0/volume",
+		"backup directories, comma separated, same as the -dir of backup.")
+	_Rate = param_parser.Int64("rate",
+		20,
+		"read at most this many MB per second, 0 means no limit")
+	_MinInterval = param_parser.Duration("min_interval",
+		7*24*time.Hour,
+		"skip the volumes which finished scrubbing within this interval")
+	_MaxDuration = param_parser.Duration("max_duration",
+		0,
+		"stop after running for this long and resume next time, no limit if not provided")
+	_Report = param_parser.String("report",
+		"",
+		"file to append the corrupted needles into, one json per line, default to scrub.report in the first backup dir")
+	_MemoryBudget = param_parser.Int64("memory_budget",
+		0,
+		"memory in MB the index of each volume may use, larger indexes are kept in a temporary leveldb in -tmp_dir, 0 means no limit")
+	_TmpDir = param_parser.String("tmp_dir",
+		"",
+		"directory for the temporary leveldb of the indexes exceeding -memory_budget, default to the first backup dir")
+	_Verbose = param_parser.Bool("verbose",
+		false,
+		"verbose")
+)
+
+func main() {
+	param_parser.Parse()
+
+	if *_Verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	locations, err := location.NewDiskLocations(*_Dir)
+	if err != nil {
+		logrus.Fatalf("failed to load backup dirs %s, err: %v", *_Dir, err)
+	}
+	statePath := path.Join(locations.Dirs[0], scrubStateFile)
+	state, err := loadScrubState(statePath)
+	if err != nil {
+		logrus.Fatalf("failed to load scrub state %s, err: %v", statePath, err)
+	}
+	// 临时的leveldb可能与索引一样大, 默认放在备份目录而不是系统临时目录
+	tmpDir := *_TmpDir
+	if tmpDir == "" {
+		tmpDir = locations.Dirs[0]
+	}
+	reportPath := *_Report
+	if reportPath == "" {
+		reportPath = path.Join(locations.Dirs[0], scrubReportFile)
+	}
+	report, err := os.OpenFile(reportPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		logrus.Fatalf("failed to open scrub report %s, err: %v", reportPath, err)
+	}
+	defer report.Close()
+
+	// 收到退出信号时保存进度, 下一次继续
+	var stopped int32
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logrus.Info("stopping, the progress will be saved")
+		atomic.StoreInt32(&stopped, 1)
+	}()
+	deadline := time.Time{}
+	if *_MaxDuration > 0 {
+		deadline = time.Now().Add(*_MaxDuration)
+	}
+
+	scrubber := &Scrubber{
+		BytesPerSecond: *_Rate * 1024 * 1024,
+		MemoryBudget:   *_MemoryBudget * 1024 * 1024,
+		TmpDir:         tmpDir,
+		Report: func(c *CorruptedNeedle) {
+			fid := c.Fid
+			if fid == "" {
+				fid = fmt.Sprintf("%d,%s (cookie unknown)", c.VolumeId, c.NeedleId)
+			}
+			logrus.Errorf("corrupted needle %s in volume <%d> of collection <%s> at offset %d, err: %s",
+				fid, c.VolumeId, c.Collection, c.Offset, c.Error)
+			data, _ := json.Marshal(c)
+			if _, err := report.Write(append(data, '\n')); err != nil {
+				logrus.Errorf("failed to write scrub report, err: %v", err)
+			}
+		},
+		Stopped: func() bool {
+			return atomic.LoadInt32(&stopped) == 1 || (!deadline.IsZero() && time.Now().After(deadline))
+		},
+	}
+
+	volumes, err := locations.Volumes()
+	if err != nil {
+		logrus.Fatalf("failed to list volumes, err: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, v := range volumes {
+		key := scrubKey(v)
+		seen[key] = true
+		if _, ok := state.Volumes[key]; !ok {
+			state.Volumes[key] = &VolumeScrubState{}
+		}
+	}
+	for key := range state.Volumes {
+		if !seen[key] {
+			delete(state.Volumes, key)
+		}
+	}
+	// 进行中的volume优先, 其余按上一次完成的时间从早到晚
+	sort.Slice(volumes, func(i, j int) bool {
+		si, sj := state.Volumes[scrubKey(volumes[i])], state.Volumes[scrubKey(volumes[j])]
+		if (si.NextOffset > 0) != (sj.NextOffset > 0) {
+			return si.NextOffset > 0
+		}
+		if si.LastFinished != sj.LastFinished {
+			return si.LastFinished < sj.LastFinished
+		}
+		return scrubKey(volumes[i]) < scrubKey(volumes[j])
+	})
+
+	saveProgress := func() {
+		if err := saveScrubState(statePath, state); err != nil {
+			logrus.Errorf("failed to save scrub state %s, err: %v", statePath, err)
+		}
+	}
+	var finished, skipped int
+	for _, v := range volumes {
+		vs := state.Volumes[scrubKey(v)]
+		if vs.NextOffset == 0 && time.Since(time.Unix(vs.LastFinished, 0)) < *_MinInterval {
+			skipped++
+			continue
+		}
+		if scrubber.Stopped() {
+			break
+		}
+		logrus.Debugf("scrubbing volume <%d> of collection <%s> in %s from offset %d", v.Vid, v.Collection, v.Dir, vs.NextOffset)
+		done, err := scrubber.Scrub(v, vs, saveProgress)
+		if err != nil {
+			logrus.Errorf("failed to scrub volume <%d> in %s, err: %v", v.Vid, v.Dir, err)
+			continue
+		}
+		if done {
+			finished++
+			if vs.Corrupted > 0 {
+				logrus.Warningf("volume <%d> of collection <%s> has %d corrupted needles", v.Vid, v.Collection, vs.Corrupted)
+			}
+		}
+		saveProgress()
+	}
+	saveProgress()
+
+	logrus.Infof("scrubbed %d volumes, skipped %d recently scrubbed volumes, checked %d needles, found %d corrupted needles",
+		finished, skipped, scrubber.Needles, scrubber.Corrupted)
+	if scrubber.Corrupted > 0 {
+		logrus.Warningf("see %s for the fids of the corrupted needles, pull them again from the primary", reportPath)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/backend"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/needlemap"
+)
+
+// 每个volume的scrub进度, 中断后下一次从NextOffset继续
+type VolumeScrubState struct {
+	LastFinished int64 `json:"last_finished"`
+	// 正在进行中的scrub, 按offset从小到大检查
+	NextOffset      int64  `json:"next_offset,omitempty"`
+	CompactRevision uint16 `json:"compact_revision,omitempty"`
+	Corrupted       int    `json:"corrupted,omitempty"`
+}
+
+type ScrubState struct {
+	// key = collection_vid
+	Volumes map[string]*VolumeScrubState `json:"volumes"`
+}
+
+type CorruptedNeedle struct {
+	Time       time.Time `json:"time"`
+	Collection string    `json:"collection"`
+	VolumeId   uint32    `json:"volume_id"`
+	Dir        string    `json:"dir"`
+	NeedleId   string    `json:"needle_id"`
+	// needle header无法读取时cookie未知, Fid为空
+	Fid    string `json:"fid,omitempty"`
+	Offset int64  `json:"offset"`
+	Size   uint32 `json:"size"`
+	Error  string `json:"error"`
+}
+
+type Scrubber struct {
+	// 每秒最多读取的字节数, 0表示不限速
+	BytesPerSecond int64
+	Report         func(*CorruptedNeedle)
+	Stopped        func() bool
+	// 每个volume的索引最多占用的内存, 超过时放在临时的leveldb中, 0表示不限制
+	MemoryBudget int64
+	// 临时leveldb所在的目录
+	TmpDir string
+
+	started   time.Time
+	readBytes int64
+	Needles   int64
+	Corrupted int64
+}
+
+var errStopped = errors.New("scrub stopped")
+
+func scrubKey(v location.LocalVolume) string {
+	return fmt.Sprintf("%s_%d", v.Collection, v.Vid)
+}
+
+// Scrub checks the CRC of every live needle of v, starting from vs.NextOffset.
+// It returns false if it is stopped before reaching the end of the volume.
+func (s *Scrubber) Scrub(v location.LocalVolume, vs *VolumeScrubState, saveProgress func()) (bool, error) {
+	baseFileName := v.BaseFileName()
+	datFile, err := os.Open(baseFileName + ".dat")
+	if err != nil {
+		return false, err
+	}
+	datBackend := backend.NewDiskFile(datFile)
+	defer datBackend.Close()
+	sb, err := super_block.ReadSuperBlock(datBackend)
+	if err != nil {
+		return false, err
+	}
+	if vs.NextOffset > 0 && vs.CompactRevision != sb.CompactionRevision {
+		// volume已经被compact, offset不再有效
+		logrus.Infof("volume <%d> was compacted since the last scrub, start over", v.Vid)
+		vs.NextOffset = 0
+	}
+	vs.CompactRevision = sb.CompactionRevision
+	if vs.NextOffset == 0 {
+		vs.Corrupted = 0
+	}
+
+	nm, err := needlemap.Load(baseFileName+".idx", s.MemoryBudget, s.TmpDir)
+	if err != nil {
+		return false, err
+	}
+	defer nm.Close()
+
+	// 按offset顺序读取, 尽量顺序访问磁盘
+	lastSave := time.Now()
+	err = nm.OffsetVisit(func(nv needle_map.NeedleValue) error {
+		offset := nv.Offset.ToAcutalOffset()
+		if offset < vs.NextOffset {
+			return nil
+		}
+		if s.Stopped() {
+			return errStopped
+		}
+		n := new(needle.Needle)
+		err := n.ReadData(datBackend, offset, nv.Size, sb.Version)
+		if err == nil && n.Id != nv.Key {
+			// ReadData不检查header中的needle id
+			err = fmt.Errorf("needle id %s in the header does not match %s in the index", n.Id, nv.Key)
+		}
+		if err != nil {
+			vs.Corrupted++
+			s.Corrupted++
+			s.Report(&CorruptedNeedle{
+				Time:       time.Now(),
+				Collection: v.Collection,
+				VolumeId:   v.Vid,
+				Dir:        v.Dir,
+				NeedleId:   nv.Key.String(),
+				Fid:        readFid(datBackend, sb.Version, v.Vid, nv, offset),
+				Offset:     offset,
+				Size:       nv.Size,
+				Error:      err.Error(),
+			})
+		}
+		s.Needles++
+		s.throttle(needle.GetActualSize(nv.Size, sb.Version))
+
+		vs.NextOffset = offset + 1
+		if time.Since(lastSave) > 10*time.Second {
+			saveProgress()
+			lastSave = time.Now()
+		}
+		return nil
+	})
+	if err == errStopped {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	vs.LastFinished = time.Now().Unix()
+	vs.NextOffset = 0
+	return true, nil
+}
+
+// readFid reads the cookie from the needle header alone, ReadData leaves it unset or garbage when it fails.
+// It returns "" if the header can not be read or does not belong to the needle.
+func readFid(datBackend backend.BackendStorageFile, version needle.Version, vid uint32, nv needle_map.NeedleValue, offset int64) string {
+	n, _, _, err := needle.ReadNeedleHeader(datBackend, version, offset)
+	if err != nil || n == nil || n.Id != nv.Key || n.Size != nv.Size {
+		return ""
+	}
+	return needle.NewFileId(needle.VolumeId(vid), uint64(nv.Key), uint32(n.Cookie)).String()
+}
+
+func (s *Scrubber) throttle(n int64) {
+	if s.started.IsZero() {
+		s.started = time.Now()
+	}
+	s.readBytes += n
+	if s.BytesPerSecond <= 0 {
+		return
+	}
+	expected := time.Duration(float64(s.readBytes) / float64(s.BytesPerSecond) * float64(time.Second))
+	if elapsed := time.Since(s.started); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+func loadScrubState(filename string) (*ScrubState, error) {
+	state := &ScrubState{Volumes: make(map[string]*VolumeScrubState)}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Volumes == nil {
+		state.Volumes = make(map[string]*VolumeScrubState)
+	}
+	return state, nil
+}
+
+func saveScrubState(filename string, state *ScrubState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
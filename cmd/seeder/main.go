@@ -0,0 +1,142 @@
+package main
+
+import (
+	param_parser "flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/chrislusf/seaweedfs/weed/storage"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/mastermeta"
+)
+
+var (
+	_Meta = param_parser.String("meta",
+		"",
+		"master meta file saved by backup, use the newest one inside -backup_dir if not provided")
+	_BackupDir = param_parser.String("backup_dir",
+		"/mnt/locals/seeweedfsvolume/volume0/volume",
+		"the first backup directory of backup, where the master meta files are saved")
+	_Dir = param_parser.String("dir",
+		"",
+		"volume directory of a standby volume server, the seed volume is created inside it")
+	_Collection = param_parser.String("collection",
+		"",
+		"collection of the seed volume")
+	_VidMargin = param_parser.Uint("vid_margin",
+		100,
+		"volume ids the primary may allocate after the master meta was saved, the seed volume id = max volume id + vid_margin")
+	_FileKeyMargin = param_parser.Uint64("file_key_margin",
+		100000000,
+		"file keys the primary may assign after the master meta was saved, the seed file key = max file key + file_key_margin")
+	_DryRun = param_parser.Bool("dry_run",
+		false,
+		"only print what would be done")
+)
+
+// seeder利用volume server的心跳来初始化一个全新的备用master:
+// master会把自己的max volume id和file key sequencer调整到不小于心跳中上报的值,
+// 因此只需要在备用volume server上放一个只读的空volume, 它的id足够大, 且.idx中记录了一个足够大的(已删除的)file key.
+func main() {
+	param_parser.Parse()
+
+	if *_Dir == "" {
+		logrus.Fatal("please provide the volume directory of the standby volume server by -dir")
+	}
+
+	metaFile := *_Meta
+	if metaFile == "" {
+		var err error
+		if metaFile, err = mastermeta.Latest(*_BackupDir); err != nil {
+			logrus.Fatalf("failed to find master meta file, err: %v", err)
+		}
+	}
+	meta, err := mastermeta.Load(metaFile)
+	if err != nil {
+		logrus.Fatalf("failed to load master meta file %s, err: %v", metaFile, err)
+	}
+	if meta.MaxFileKey == 0 {
+		logrus.Warningf("master meta file %s has no file key, rely on -file_key_margin only", metaFile)
+	}
+
+	seedVid := needle.VolumeId(uint64(meta.MaxVolumeId) + uint64(*_VidMargin))
+	seedKey := types.NeedleId(meta.MaxFileKey + *_FileKeyMargin)
+	logrus.Infof("master meta %s saved at %s, max volume id: %d, max file key: %d",
+		metaFile, meta.Time.Format("2006-01-02 15:04:05"), meta.MaxVolumeId, meta.MaxFileKey)
+
+	if *_DryRun {
+		logrus.Infof("[dry run] would create seed volume <%d> with file key %d in %s", seedVid, seedKey, *_Dir)
+	} else {
+		if err = createSeedVolume(*_Dir, *_Collection, seedVid, seedKey); err != nil {
+			logrus.Fatalf("failed to create seed volume <%d> in %s, err: %v", seedVid, *_Dir, err)
+		}
+		logrus.Infof("created read-only seed volume <%d> with file key %d in %s", seedVid, seedKey, *_Dir)
+	}
+
+	printSuggestions(meta)
+}
+
+// createSeedVolume creates an empty read-only volume, the .idx of which holds one deletion of key.
+func createSeedVolume(dir, collection string, vid needle.VolumeId, key types.NeedleId) error {
+	baseFileName := storage.VolumeFileName(dir, collection, int(vid))
+	if _, err := os.Stat(baseFileName + ".dat"); err == nil {
+		return fmt.Errorf("%s.dat already exists", baseFileName)
+	}
+
+	rp, _ := super_block.NewReplicaPlacementFromString("000")
+	v, err := storage.NewVolume(dir, collection, vid, storage.NeedleMapInMemory, rp, needle.EMPTY_TTL, 0, 0)
+	if err != nil {
+		return err
+	}
+	v.Close()
+
+	idxFile, err := os.OpenFile(baseFileName+".idx", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = idxFile.Write(needle_map.ToBytes(key, types.Offset{}, types.TombstoneFileSize)); err != nil {
+		_ = idxFile.Close()
+		return err
+	}
+	if err = idxFile.Sync(); err != nil {
+		_ = idxFile.Close()
+		return err
+	}
+	if err = idxFile.Close(); err != nil {
+		return err
+	}
+
+	// volume server以只读方式加载没有写权限的.dat文件, 避免seed volume被分配写入
+	if err = os.Chmod(baseFileName+".dat", 0444); err != nil {
+		return err
+	}
+	return os.Chmod(baseFileName+".idx", 0444)
+}
+
+func printSuggestions(meta *mastermeta.MasterMeta) {
+	args := []string{fmt.Sprintf("-volumeSizeLimitMB=%d", meta.VolumeSizeLimitMB)}
+	if meta.MetricsAddress != "" {
+		args = append(args,
+			fmt.Sprintf("-metrics.address=%s", meta.MetricsAddress),
+			fmt.Sprintf("-metrics.intervalSeconds=%d", meta.MetricsIntervalSeconds))
+	}
+	fmt.Printf("start the standby master with: weed master %s\n", strings.Join(args, " "))
+	fmt.Println("then start the standby volume server on the seed volume dir, the master adjusts its max volume id and file key on the first heartbeat.")
+
+	collections := make([]string, 0, len(meta.ReplicaPlacements))
+	for collection := range meta.ReplicaPlacements {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+	fmt.Println("replica placements of the primary:")
+	for _, collection := range collections {
+		fmt.Printf("  collection <%s>: %s\n", collection, strings.Join(meta.ReplicaPlacements[collection], ","))
+	}
+}
@@ -2,16 +2,13 @@ package main
 
 import (
 	param_parser "flag"
-	"io"
 	"os"
-	"path"
-	"strconv"
 
-	"github.com/chrislusf/seaweedfs/weed/storage"
-	"github.com/chrislusf/seaweedfs/weed/storage/needle"
-	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
 	"github.com/sirupsen/logrus"
 
+	"github.com/amazingchow/seaweedfs-tools/pkg/batch"
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/rewrite"
 	myutils "github.com/amazingchow/seaweedfs-tools/pkg/utils"
 )
 
@@ -24,10 +21,37 @@ var (
 		"directory to store encrypted volume data files.")
 	_Collection = param_parser.String("collection",
 		"",
-		"the volume collection name.")
+		"the volume collection name, only process the volumes of this collection if provided when processing -src.")
 	_VolumeId = param_parser.Int("vid",
 		-1,
-		"the volume id.")
+		"the volume id, process all the volumes in -src if not provided.")
+	_Concurrency = param_parser.Int("concurrency",
+		4,
+		"number of volumes to process at the same time when processing -src.")
+	_Replace = param_parser.Bool("replace",
+		true,
+		"replace the original volumes with the processed ones when processing -src, -dst must be on the same filesystem as -src.")
+	_KeepGenerations = param_parser.Int("keep_generations",
+		1,
+		"number of replaced generations of each volume to keep for rollback, 0 keeps all.")
+	_Restamp = param_parser.Bool("restamp",
+		false,
+		"set the AppendAtNs of the rewritten needles to the rewrite time, the original AppendAtNs is kept by default.")
+	_Scan = param_parser.String("scan",
+		"auto",
+		"how to read the source volumes: sequential reads the whole .dat, index reads only the live needles in the .idx, auto picks one by the garbage ratio.")
+	_MemoryBudget = param_parser.Int64("memory_budget",
+		0,
+		"memory in MB the index of each volume may use, larger indexes are kept in a temporary leveldb in -dst, 0 means no limit.")
+	_KeepExpired = param_parser.Bool("keep_expired",
+		false,
+		"keep the needles whose ttl has expired, they are dropped by default.")
+	_MasterGrpc = param_parser.String("master_grpc",
+		"localhost:19333",
+		"seaweedfs master server grpc endpoint, used with -volume_server.")
+	_VolumeServer = param_parser.String("volume_server",
+		"",
+		"address of the volume server serving -src as registered in the master, e.g. 10.0.2.15:8080, if provided each volume is unmounted from it before its files are replaced and mounted back afterwards, otherwise the volume files are made read-only (0444) before processing.")
 	_Verbose = param_parser.Bool("verbose",
 		false,
 		"verbose")
@@ -40,58 +64,93 @@ func main() {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	if *_Collection == "" || *_VolumeId == -1 {
-		logrus.Warning("no collection or volume id provided")
-		return
-	}
-
-	var err error
-
 	ck, err := myutils.GetCipherKey()
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	// 只需生成.idx文件和.dat文件, 可以复用原先的.vif文件
-	filename := *_Collection + "_" + strconv.Itoa(*_VolumeId)
-	idxFile := filename + ".idx"
-	datFile := filename + ".dat"
+	scanMode, err := rewrite.ParseScanMode(*_Scan)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	memoryBudget := *_MemoryBudget * 1024 * 1024
 
-	// needle map缓存needle索引信息, key = []byte(NeedleId), value = []byte(Offset + Size)
-	srcNM := needle_map.NewMemDb()
-	defer srcNM.Close()
-	if err = srcNM.LoadFromIdx(path.Join(*_SrcDir, idxFile)); err != nil {
-		logrus.Fatalf("failed to load needle map from %s, err: %v", path.Join(*_SrcDir, idxFile), err)
+	var stages []rewrite.Stage
+	if !*_KeepExpired {
+		stages = append(stages, rewrite.DropExpired())
+	}
+	stages = append(stages, rewrite.Encrypt(ck))
+	rewriter := &rewrite.Rewriter{
+		Stages:       stages,
+		Restamp:      *_Restamp,
+		Scan:         scanMode,
+		MemoryBudget: memoryBudget,
 	}
-	dstNM := needle_map.NewMemDb()
-	defer dstNM.Close()
 
-	logrus.Infof("ready to parse %s", path.Join(*_SrcDir, datFile))
+	// 指定了volume id时只处理该volume, 否则处理-src中的所有volume
+	if *_VolumeId != -1 {
+		v := location.LocalVolume{Dir: *_SrcDir, Collection: *_Collection, Vid: uint32(*_VolumeId)}
+		if encrypted, err := batch.HasMark(v, batch.MarkEncrypted); err != nil {
+			logrus.Fatal(err)
+		} else if encrypted {
+			logrus.Fatalf("volume <%d> is already encrypted", v.Vid)
+		}
+		counter, err := rewriter.Rewrite(v, *_DstDir)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("totally processed %d needles", counter)
+		return
+	}
 
-	vid := needle.VolumeId(*_VolumeId)
-	volumeFileScanner := &VolumeFileScanner4Transformer{
-		SrcNeedleMap: srcNM,
-		DstNeedleMap: dstNM,
-		DstDataFile:  path.Join(*_DstDir, datFile),
-		CipherKey:    ck,
+	// 先处理上一次中断的替换
+	if err := batch.Recover(*_SrcDir); err != nil {
+		logrus.Fatalf("failed to recover unfinished swaps in %s, err: %v", *_SrcDir, err)
+	}
+	selected, err := batch.Select(*_SrcDir, *_Collection)
+	if err != nil {
+		logrus.Fatalf("failed to list volumes in %s, err: %v", *_SrcDir, err)
 	}
-	err = storage.ScanVolumeFile(*_SrcDir, *_Collection, vid, storage.NeedleMapInMemory, volumeFileScanner)
-	if err != nil && err != io.EOF {
-		if volumeFileScanner.ExitErr != ErrCreateDataFile {
-			volumeFileScanner.Close()
-			_ = os.Remove(path.Join(*_DstDir, datFile))
+	// 跳过之前已经加密并替换的volume, 避免中断后重跑时重复加密
+	var volumes []location.LocalVolume
+	for _, v := range selected {
+		encrypted, err := batch.HasMark(v, batch.MarkEncrypted)
+		if err != nil {
+			logrus.Fatalf("failed to read the marks of volume <%d>, err: %v", v.Vid, err)
+		}
+		if encrypted {
+			logrus.Infof("volume <%d> of collection <%s> is already encrypted, skip it", v.Vid, v.Collection)
+			continue
 		}
-		logrus.Fatalf("failed to scan %s, err: %v", path.Join(*_SrcDir, datFile), err)
+		volumes = append(volumes, v)
 	}
-	volumeFileScanner.Close()
-
-	// 生成新的.idx文件
-	if err = dstNM.SaveToIdx(path.Join(*_DstDir, idxFile)); err != nil {
-		logrus.Fatalf("failed to save needle map to %s, err: %v", path.Join(*_DstDir, idxFile), err)
-		_ = os.Remove(path.Join(*_DstDir, idxFile))
-		_ = os.Remove(path.Join(*_DstDir, datFile))
+	if err = os.MkdirAll(*_DstDir, 0755); err != nil {
+		logrus.Fatalf("failed to create %s, err: %v", *_DstDir, err)
+	}
+	process := func(v location.LocalVolume) (int64, error) {
+		counter, err := rewriter.Rewrite(v, *_DstDir)
+		if err == nil {
+			err = batch.Verify(v, *_DstDir, counter, memoryBudget)
+		}
+		if err == nil && *_Replace {
+			err = batch.Replace(v, *_DstDir, *_KeepGenerations, batch.MarkEncrypted)
+		}
+		return counter, err
+	}
+	// 不替换原来的volume时不需要卸载
+	volumeServer := *_VolumeServer
+	if !*_Replace {
+		volumeServer = ""
+	}
+	if process, err = batch.Guard(volumes, volumeServer, *_MasterGrpc, process); err != nil {
+		logrus.Fatal(err)
+	}
+	results := batch.Run(volumes, *_Concurrency, process)
+	if *_Replace {
+		// 删除临时目录, 还有未替换的文件时保留
+		_ = os.Remove(*_DstDir)
+	}
+	if batch.Report(results) > 0 {
+		os.Exit(1)
 	}
-
-	logrus.Infof("finish to parse %s", path.Join(*_SrcDir, datFile))
-	logrus.Infof("totally processed %d needles", volumeFileScanner.Counter())
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	param_parser "flag"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/archive"
+)
+
+var (
+	_Archive = param_parser.String("archive",
+		"",
+		"archive directory created by archive, which holds index.json and the segments.")
+	_DstDir = param_parser.String("dst",
+		"/mnt/locals/seeweedfsvolume/volume0/volume-output",
+		"directory to restore the volume files into.")
+	_VolumeIds = param_parser.String("vid",
+		"",
+		"only restore these volumes if provided, comma separated.")
+	_Verbose = param_parser.Bool("verbose",
+		false,
+		"verbose")
+)
+
+func main() {
+	param_parser.Parse()
+
+	if *_Verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	if *_Archive == "" {
+		logrus.Fatal("please provide -archive")
+	}
+	vids, err := parseVolumeIds(*_VolumeIds)
+	if err != nil {
+		logrus.Fatalf("failed to parse -vid %s, err: %v", *_VolumeIds, err)
+	}
+
+	index, err := archive.LoadIndex(*_Archive)
+	if err != nil {
+		logrus.Fatalf("failed to load archive %s, err: %v", *_Archive, err)
+	}
+	if err = archive.CheckCompression(index.Compression); err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Debugf("archive of collection <%s> created at %v has %d volumes in %d segments",
+		index.Collection, index.Created, len(index.Volumes), len(index.Segments))
+
+	restored, err := archive.Restore(*_Archive, *_DstDir, vids)
+	if err != nil {
+		logrus.Fatalf("failed to restore from %s, err: %v", *_Archive, err)
+	}
+	for _, ve := range restored {
+		logrus.Debugf("restored volume <%d> with %d files", ve.VolumeId, len(ve.Files))
+	}
+	logrus.Infof("restored and verified %d volumes of collection <%s> into %s", len(restored), index.Collection, *_DstDir)
+}
+
+func parseVolumeIds(s string) (map[uint32]bool, error) {
+	vids := make(map[uint32]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		vid, err := strconv.ParseUint(item, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		vids[uint32(vid)] = true
+	}
+	return vids, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	param_parser "flag"
+	"fmt"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/chrislusf/seaweedfs/weed/storage"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/manifest"
+)
+
+var (
+	_Dir = param_parser.String("dir",
+		"/mnt/locals/seeweedfsvolume/volume0/volume",
+		"the first backup directory of backup, where the manifests subfolder is")
+	_PublicKey = param_parser.String("public_key",
+		"",
+		"ed25519 public key in PKIX PEM format, which matches the -manifest_key of backup")
+	_Manifest = param_parser.String("manifest",
+		"",
+		"check the file hashes of this manifest, the newest one if not provided")
+	_Verbose = param_parser.Bool("verbose",
+		false,
+		"verbose")
+)
+
+func main() {
+	param_parser.Parse()
+
+	if *_Verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	if *_PublicKey == "" {
+		logrus.Fatal("please provide the public key by -public_key")
+	}
+	key, err := manifest.LoadPublicKey(*_PublicKey)
+	if err != nil {
+		logrus.Fatalf("failed to load public key %s, err: %v", *_PublicKey, err)
+	}
+
+	files, err := manifest.List(path.Join(*_Dir, manifest.Dir))
+	if err != nil {
+		logrus.Fatalf("failed to list manifests, err: %v", err)
+	}
+	if len(files) == 0 {
+		logrus.Fatalf("no manifest found in %s", path.Join(*_Dir, manifest.Dir))
+	}
+
+	// 1. 检查整条manifest链的签名和串联关系
+	manifests, problems, err := manifest.VerifyChain(files, key)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	for _, problem := range problems {
+		logrus.Error(problem)
+	}
+	broken := len(problems) > 0
+	if manifests[0].PrevSha256 != "" {
+		// 最早的manifest被删除了, 链条的起点无法验证
+		logrus.Warningf("manifest %s chains to a manifest which no longer exists", files[0])
+	}
+	var target *manifest.Manifest
+	for i, file := range files {
+		if file == *_Manifest || path.Base(file) == *_Manifest || (*_Manifest == "" && i == len(files)-1) {
+			target = manifests[i]
+		}
+	}
+	if target == nil {
+		logrus.Fatalf("manifest %s not found", *_Manifest)
+	}
+	logrus.Infof("checked the chain of %d manifests", len(files))
+
+	// 2. 检查目标manifest中每个文件的sha256
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTION\tVOLUME\tFILE\tSIZE\tRESULT")
+	for _, vd := range target.Volumes {
+		baseFileName := storage.VolumeFileName(vd.Dir, vd.Collection, int(vd.VolumeId))
+		for _, f := range []struct {
+			ext string
+			fd  manifest.FileDigest
+		}{{".dat", vd.Dat}, {".idx", vd.Idx}} {
+			result := "ok"
+			sum, err := manifest.HashFile(baseFileName+f.ext, f.fd.Size)
+			if err != nil {
+				result = err.Error()
+				broken = true
+			} else if sum != f.fd.Sha256 {
+				result = "MISMATCH"
+				broken = true
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%s\n", vd.Collection, vd.VolumeId, f.ext, f.fd.Size, result)
+		}
+	}
+	_ = tw.Flush()
+
+	if broken {
+		logrus.Fatalf("manifest %s failed to verify", target.FileName())
+	}
+	logrus.Infof("manifest %s verified, %d volumes", target.FileName(), len(target.Volumes))
+}
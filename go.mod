@@ -7,12 +7,15 @@ require (
 	github.com/cenkalti/backoff v2.2.1+incompatible
 	github.com/chrislusf/seaweedfs v0.0.0-20200310053240-e6de42f88806
 	github.com/disintegration/imaging v1.6.2 // indirect
+	github.com/golang/protobuf v1.4.3
+	github.com/klauspost/compress v1.11.13
 	github.com/onsi/ginkgo v1.14.2 // indirect
 	github.com/onsi/gomega v1.10.4 // indirect
-	github.com/prometheus/client_golang v1.11.0 // indirect
+	github.com/prometheus/client_golang v1.11.0
 	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/afero v1.3.1 // indirect
 	github.com/stretchr/testify v1.6.1 // indirect
+	github.com/syndtr/goleveldb v1.0.0
 	golang.org/x/image v0.0.0-20200119044424-58c23975cae1 // indirect
 	golang.org/x/tools v0.0.0-20201124115921-2c860bdd6e78 // indirect
 	google.golang.org/genproto v0.0.0-20200608115520-7c474a2e3482 // indirect
@@ -0,0 +1,211 @@
+package archive
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// 归档目录结构:
+//
+//	index.json          : 整个归档的描述, 包括每个volume的文件大小和sha256, 以及每个分段文件的sha256
+//	segment_00000.tar.gz: 分段文件, 每个分段的未压缩大小不超过SegmentSize, zstd压缩时为.tar.zst
+//
+// 大文件会被切分成多个piece放入连续的分段中, piece在tar中的名字为<文件名>.<3位序号>,
+// 直接按序号拼接即可还原. 每个分段的最后一个entry是MANIFEST.json, 描述该分段中的所有piece.
+const (
+	IndexFile            = "index.json"
+	SegmentManifestEntry = "MANIFEST.json"
+
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+type Index struct {
+	Collection  string           `json:"collection"`
+	Created     time.Time        `json:"created"`
+	Compression string           `json:"compression"`
+	SegmentSize int64            `json:"segment_size"`
+	Volumes     []*VolumeEntry   `json:"volumes"`
+	Segments    []*SegmentDigest `json:"segments"`
+}
+
+type VolumeEntry struct {
+	VolumeId uint32       `json:"volume_id"`
+	Files    []*FileEntry `json:"files"`
+}
+
+type FileEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+	// 该文件的piece所在的分段
+	Segments []int `json:"segments"`
+}
+
+type SegmentDigest struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+type SegmentManifest struct {
+	Collection string   `json:"collection"`
+	Segment    int      `json:"segment"`
+	Pieces     []*Piece `json:"pieces"`
+}
+
+type Piece struct {
+	Entry    string `json:"entry"`
+	File     string `json:"file"`
+	VolumeId uint32 `json:"volume_id"`
+	Offset   int64  `json:"offset"`
+	Size     int64  `json:"size"`
+	Sha256   string `json:"sha256"`
+}
+
+func segmentName(i int, compression string) string {
+	switch compression {
+	case CompressionGzip:
+		return fmt.Sprintf("segment_%05d.tar.gz", i)
+	case CompressionZstd:
+		return fmt.Sprintf("segment_%05d.tar.zst", i)
+	default:
+		return fmt.Sprintf("segment_%05d.tar", i)
+	}
+}
+
+func CheckCompression(compression string) error {
+	switch compression {
+	case CompressionGzip, CompressionZstd, CompressionNone:
+		return nil
+	default:
+		return fmt.Errorf("unknown compression %s", compression)
+	}
+}
+
+func LoadIndex(dir string) (*Index, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, IndexFile))
+	if err != nil {
+		return nil, err
+	}
+	index := &Index{}
+	if err = json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// saveIndex writes the index atomically and syncs it together with the archive dir,
+// the archive may be the only copy of the volumes once it is saved.
+func saveIndex(dir string, index *Index) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := path.Join(dir, IndexFile)
+	file, err := os.OpenFile(filename+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(filename + ".tmp")
+		return err
+	}
+	if err = os.Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+	// 分段和index.json的目录项, 以及新建的归档目录本身
+	if err = syncDir(dir); err != nil {
+		return err
+	}
+	return syncDir(path.Dir(dir))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// hashWriter counts and hashes everything written through it.
+type hashWriter struct {
+	w    io.Writer
+	h    hash.Hash
+	size int64
+}
+
+func newHashWriter(w io.Writer) *hashWriter {
+	return &hashWriter{w: w, h: sha256.New()}
+}
+
+func (hw *hashWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	hw.size += int64(n)
+	return n, err
+}
+
+func (hw *hashWriter) Sum() string {
+	return hex.EncodeToString(hw.h.Sum(nil))
+}
+
+// segmentWriter is one open segment file.
+type segmentWriter struct {
+	file   *os.File
+	digest *hashWriter
+	// 不压缩时为nil
+	compressor io.WriteCloser
+	tw         *tar.Writer
+	manifest   *SegmentManifest
+	written    int64
+}
+
+func (sw *segmentWriter) close() error {
+	data, err := json.MarshalIndent(sw.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = sw.tw.WriteHeader(&tar.Header{
+		Name:    SegmentManifestEntry,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = sw.tw.Write(data); err != nil {
+		return err
+	}
+	if err = sw.tw.Close(); err != nil {
+		return err
+	}
+	if sw.compressor != nil {
+		if err = sw.compressor.Close(); err != nil {
+			return err
+		}
+	}
+	if err = sw.file.Sync(); err != nil {
+		return err
+	}
+	return sw.file.Close()
+}
@@ -0,0 +1,210 @@
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+// 在src中为每个volume生成.dat/.idx, .dat大于分段大小, 会被切分到多个分段中
+func writeVolumes(t *testing.T, src string, vids []uint32, datSize int) map[string][]byte {
+	t.Helper()
+	rnd := rand.New(rand.NewSource(1))
+	files := make(map[string][]byte)
+	for _, vid := range vids {
+		for ext, size := range map[string]int{".dat": datSize, ".idx": datSize / 64} {
+			data := make([]byte, size)
+			rnd.Read(data)
+			name := "test_" + string(rune('0'+vid)) + ext
+			if err := ioutil.WriteFile(path.Join(src, name), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			files[name] = data
+		}
+	}
+	return files
+}
+
+// 将src中的volume写入归档目录, 返回归档目录
+func writeArchive(t *testing.T, src string, vids []uint32, compression string, segmentSize int64) string {
+	t.Helper()
+	dir := path.Join(src, "archive")
+	w, err := NewWriter(dir, "test", compression, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vid := range vids {
+		base := path.Join(src, "test_"+string(rune('0'+vid)))
+		if err = w.AddVolume(vid, []string{base + ".dat", base + ".idx"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func assertRestored(t *testing.T, dst string, files map[string][]byte, vids []uint32) {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(vids)*2 {
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		t.Errorf("restored %v, want the .dat and .idx of %v", names, vids)
+	}
+	for _, vid := range vids {
+		for _, ext := range []string{".dat", ".idx"} {
+			name := "test_" + string(rune('0'+vid)) + ext
+			data, err := ioutil.ReadFile(path.Join(dst, name))
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if !bytes.Equal(data, files[name]) {
+				t.Errorf("%s is restored with different content", name)
+			}
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	vids := []uint32{1, 2, 3}
+	for _, compression := range []string{CompressionGzip, CompressionZstd, CompressionNone} {
+		t.Run(compression, func(t *testing.T) {
+			src := tempDir(t)
+			files := writeVolumes(t, src, vids, 10000)
+			dir := writeArchive(t, src, vids, compression, 4096)
+
+			index, err := LoadIndex(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(index.Volumes) != len(vids) || len(index.Segments) < 8 {
+				t.Fatalf("index has %d volumes and %d segments", len(index.Volumes), len(index.Segments))
+			}
+			if _, err = os.Stat(path.Join(dir, IndexFile+".tmp")); !os.IsNotExist(err) {
+				t.Errorf("the temporary index is left behind")
+			}
+
+			dst := path.Join(src, "all")
+			if err = os.Mkdir(dst, 0755); err != nil {
+				t.Fatal(err)
+			}
+			restored, err := Restore(dir, dst, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(restored) != len(vids) {
+				t.Errorf("restored %d volumes, want %d", len(restored), len(vids))
+			}
+			assertRestored(t, dst, files, vids)
+
+			// 只恢复一个volume
+			one := path.Join(src, "one")
+			if err = os.Mkdir(one, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = Restore(dir, one, map[uint32]bool{2: true}); err != nil {
+				t.Fatal(err)
+			}
+			assertRestored(t, one, files, []uint32{2})
+
+			// 不覆盖已经存在的文件
+			if _, err = Restore(dir, one, map[uint32]bool{2: true}); err == nil {
+				t.Errorf("restoring over existing files succeeds")
+			}
+			if _, err = Restore(dir, one, map[uint32]bool{9: true}); err == nil {
+				t.Errorf("restoring a volume not in the archive succeeds")
+			}
+		})
+	}
+}
+
+func TestRestoreRejectsCorruption(t *testing.T) {
+	vids := []uint32{1}
+	cases := []struct {
+		name    string
+		corrupt func(t *testing.T, dir string, index *Index)
+	}{
+		{"segment byte flipped", func(t *testing.T, dir string, index *Index) {
+			filename := path.Join(dir, index.Segments[1].Name)
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[len(data)/2] ^= 0xff
+			if err = ioutil.WriteFile(filename, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"segment truncated", func(t *testing.T, dir string, index *Index) {
+			if err := os.Truncate(path.Join(dir, index.Segments[1].Name), 100); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"segment missing", func(t *testing.T, dir string, index *Index) {
+			if err := os.Remove(path.Join(dir, index.Segments[2].Name)); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"file hash changed in the index", func(t *testing.T, dir string, index *Index) {
+			index.Volumes[0].Files[0].Sha256 = index.Volumes[0].Files[1].Sha256
+			if err := saveIndex(dir, index); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"file size changed in the index", func(t *testing.T, dir string, index *Index) {
+			index.Volumes[0].Files[0].Size++
+			if err := saveIndex(dir, index); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			src := tempDir(t)
+			writeVolumes(t, src, vids, 10000)
+			dir := writeArchive(t, src, vids, CompressionNone, 4096)
+			index, err := LoadIndex(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.corrupt(t, dir, index)
+
+			dst := path.Join(src, "dst")
+			if err = os.Mkdir(dst, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = Restore(dir, dst, nil); err == nil {
+				t.Fatal("the corrupted archive is restored")
+			}
+			// 失败时不留下任何文件, 包括未完成的文件
+			infos, err := ioutil.ReadDir(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, info := range infos {
+				t.Errorf("%s is left behind", info.Name())
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	unarchivingSuffix = ".unarchiving"
+)
+
+type restoringFile struct {
+	entry *FileEntry
+	file  *os.File
+	hash  hash.Hash
+	size  int64
+}
+
+// Restore extracts the files of the given volumes from the archive in dir into dst, all the volumes if vids is empty.
+// Every segment read, every piece and every restored file is verified against its sha256.
+func Restore(dir, dst string, vids map[uint32]bool) ([]*VolumeEntry, error) {
+	index, err := LoadIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]*restoringFile)
+	segments := make(map[int]bool)
+	var restored []*VolumeEntry
+	for _, ve := range index.Volumes {
+		if len(vids) > 0 && !vids[ve.VolumeId] {
+			continue
+		}
+		restored = append(restored, ve)
+		for _, fe := range ve.Files {
+			if _, err = os.Stat(path.Join(dst, fe.Name)); err == nil {
+				return nil, fmt.Errorf("%s already exists", path.Join(dst, fe.Name))
+			}
+			wanted[fe.Name] = &restoringFile{entry: fe, hash: sha256.New()}
+			for _, i := range fe.Segments {
+				segments[i] = true
+			}
+		}
+	}
+	if len(restored) == 0 {
+		return nil, fmt.Errorf("no volume to restore")
+	}
+
+	defer func() {
+		// 未完成的文件不保留
+		for _, rf := range wanted {
+			if rf.file != nil {
+				_ = rf.file.Close()
+				_ = os.Remove(path.Join(dst, rf.entry.Name+unarchivingSuffix))
+			}
+		}
+	}()
+
+	order := make([]int, 0, len(segments))
+	for i := range segments {
+		order = append(order, i)
+	}
+	sort.Ints(order)
+	for _, i := range order {
+		if i >= len(index.Segments) {
+			return nil, fmt.Errorf("segment %d is not in the index", i)
+		}
+		if err = restoreSegment(dir, dst, index, index.Segments[i], wanted); err != nil {
+			return nil, fmt.Errorf("failed to restore from %s, err: %v", index.Segments[i].Name, err)
+		}
+	}
+
+	// 检查并启用所有的文件
+	for name, rf := range wanted {
+		if rf.file == nil {
+			return nil, fmt.Errorf("%s is missing in the archive", name)
+		}
+		if rf.size != rf.entry.Size {
+			return nil, fmt.Errorf("%s is incomplete, restored %d of %d bytes", name, rf.size, rf.entry.Size)
+		}
+		if sum := hex.EncodeToString(rf.hash.Sum(nil)); sum != rf.entry.Sha256 {
+			return nil, fmt.Errorf("%s sha256 mismatch, expected %s, got %s", name, rf.entry.Sha256, sum)
+		}
+		if err = rf.file.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	for name, rf := range wanted {
+		_ = rf.file.Close()
+		if err = os.Rename(path.Join(dst, name+unarchivingSuffix), path.Join(dst, name)); err != nil {
+			return nil, err
+		}
+		delete(wanted, name)
+	}
+	return restored, nil
+}
+
+func restoreSegment(dir, dst string, index *Index, sd *SegmentDigest, wanted map[string]*restoringFile) error {
+	file, err := os.Open(path.Join(dir, sd.Name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	segmentHash := sha256.New()
+	var r io.Reader = io.TeeReader(file, segmentHash)
+	switch index.Compression {
+	case CompressionGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	pieceHashes := make(map[string]string)
+	var manifest *SegmentManifest
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if header.Name == SegmentManifestEntry {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			manifest = &SegmentManifest{}
+			if err = json.Unmarshal(data, manifest); err != nil {
+				return err
+			}
+			continue
+		}
+		name := pieceFileName(header.Name)
+		rf, ok := wanted[name]
+		if !ok {
+			continue
+		}
+		if rf.file == nil {
+			rf.file, err = os.OpenFile(path.Join(dst, name+unarchivingSuffix), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+		}
+		pieceHash := sha256.New()
+		n, err := io.Copy(io.MultiWriter(rf.file, rf.hash, pieceHash), tr)
+		if err != nil {
+			return err
+		}
+		rf.size += n
+		pieceHashes[header.Name] = hex.EncodeToString(pieceHash.Sum(nil))
+	}
+	// 读完整个分段才能校验分段文件的sha256
+	if _, err = io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	if _, err = io.Copy(ioutil.Discard, file); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(segmentHash.Sum(nil)); sum != sd.Sha256 {
+		return fmt.Errorf("segment sha256 mismatch, expected %s, got %s", sd.Sha256, sum)
+	}
+	if manifest == nil {
+		return fmt.Errorf("no %s in the segment", SegmentManifestEntry)
+	}
+	for _, piece := range manifest.Pieces {
+		if sum, ok := pieceHashes[piece.Entry]; ok && sum != piece.Sha256 {
+			return fmt.Errorf("piece %s sha256 mismatch", piece.Entry)
+		}
+	}
+	return nil
+}
+
+// pieceFileName strips the piece number from a tar entry name.
+func pieceFileName(entry string) string {
+	if i := strings.LastIndex(entry, "."); i > 0 {
+		return entry[:i]
+	}
+	return entry
+}
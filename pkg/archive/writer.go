@@ -0,0 +1,175 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type Writer struct {
+	dir     string
+	index   *Index
+	current *segmentWriter
+}
+
+// NewWriter creates an empty archive inside dir, which must not exist yet.
+func NewWriter(dir, collection, compression string, segmentSize int64) (*Writer, error) {
+	if err := CheckCompression(compression); err != nil {
+		return nil, err
+	}
+	if segmentSize <= 0 {
+		return nil, fmt.Errorf("invalid segment size %d", segmentSize)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		dir: dir,
+		index: &Index{
+			Collection:  collection,
+			Created:     time.Now(),
+			Compression: compression,
+			SegmentSize: segmentSize,
+		},
+	}, nil
+}
+
+// AddVolume appends the given files of a volume into the archive, filenames are full paths.
+func (w *Writer) AddVolume(vid uint32, filenames []string) error {
+	ve := &VolumeEntry{VolumeId: vid}
+	for _, filename := range filenames {
+		fe, err := w.addFile(vid, filename)
+		if err != nil {
+			return fmt.Errorf("failed to archive %s, err: %v", filename, err)
+		}
+		ve.Files = append(ve.Files, fe)
+	}
+	w.index.Volumes = append(w.index.Volumes, ve)
+	return nil
+}
+
+func (w *Writer) addFile(vid uint32, filename string) (*FileEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	fe := &FileEntry{Name: filepath.Base(filename), Size: info.Size()}
+	fileHash := sha256.New()
+	var offset int64
+	for part := 0; offset < fe.Size || part == 0; part++ {
+		if w.current == nil || w.current.written >= w.index.SegmentSize {
+			if err = w.nextSegment(); err != nil {
+				return nil, err
+			}
+		}
+		size := fe.Size - offset
+		if room := w.index.SegmentSize - w.current.written; size > room {
+			size = room
+		}
+		piece := &Piece{
+			Entry:    fmt.Sprintf("%s.%03d", fe.Name, part),
+			File:     fe.Name,
+			VolumeId: vid,
+			Offset:   offset,
+			Size:     size,
+		}
+		err = w.current.tw.WriteHeader(&tar.Header{
+			Name:    piece.Entry,
+			Mode:    0644,
+			Size:    size,
+			ModTime: info.ModTime(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		pieceHash := sha256.New()
+		n, err := io.Copy(io.MultiWriter(w.current.tw, pieceHash, fileHash), io.LimitReader(file, size))
+		if err != nil {
+			return nil, err
+		}
+		if n != size {
+			return nil, fmt.Errorf("%s changed while archiving", filename)
+		}
+		piece.Sha256 = hex.EncodeToString(pieceHash.Sum(nil))
+		w.current.manifest.Pieces = append(w.current.manifest.Pieces, piece)
+		if segment := w.current.manifest.Segment; len(fe.Segments) == 0 || fe.Segments[len(fe.Segments)-1] != segment {
+			fe.Segments = append(fe.Segments, segment)
+		}
+		w.current.written += size
+		offset += size
+	}
+	fe.Sha256 = hex.EncodeToString(fileHash.Sum(nil))
+	return fe, nil
+}
+
+func (w *Writer) nextSegment() error {
+	if err := w.closeSegment(); err != nil {
+		return err
+	}
+	i := len(w.index.Segments)
+	name := segmentName(i, w.index.Compression)
+	file, err := os.OpenFile(path.Join(w.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	sw := &segmentWriter{
+		file:     file,
+		digest:   newHashWriter(file),
+		manifest: &SegmentManifest{Collection: w.index.Collection, Segment: i},
+	}
+	switch w.index.Compression {
+	case CompressionGzip:
+		sw.compressor = gzip.NewWriter(sw.digest)
+		sw.tw = tar.NewWriter(sw.compressor)
+	case CompressionZstd:
+		if sw.compressor, err = zstd.NewWriter(sw.digest); err != nil {
+			_ = file.Close()
+			return err
+		}
+		sw.tw = tar.NewWriter(sw.compressor)
+	default:
+		sw.tw = tar.NewWriter(sw.digest)
+	}
+	w.index.Segments = append(w.index.Segments, &SegmentDigest{Name: name})
+	w.current = sw
+	return nil
+}
+
+func (w *Writer) closeSegment() error {
+	if w.current == nil {
+		return nil
+	}
+	if err := w.current.close(); err != nil {
+		return err
+	}
+	sd := w.index.Segments[len(w.index.Segments)-1]
+	sd.Size, sd.Sha256 = w.current.digest.size, w.current.digest.Sum()
+	w.current = nil
+	return nil
+}
+
+// Close finishes the last segment and writes the index, the archive is complete only after Close returns nil.
+func (w *Writer) Close() (*Index, error) {
+	if err := w.closeSegment(); err != nil {
+		return nil, err
+	}
+	if err := saveIndex(w.dir, w.index); err != nil {
+		return nil, err
+	}
+	return w.index, nil
+}
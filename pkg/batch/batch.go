@@ -0,0 +1,168 @@
+package batch
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/storage"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/needlemap"
+)
+
+// 一个volume的处理结果
+type Result struct {
+	Volume   location.LocalVolume
+	Needles  int64
+	Duration time.Duration
+	Err      error
+}
+
+// ProcessFunc rewrites one volume into the destination dir and returns the number of needles written.
+type ProcessFunc func(v location.LocalVolume) (int64, error)
+
+// Select returns the volumes of the collection in dir, all the volumes if collection is empty.
+func Select(dir, collection string) ([]location.LocalVolume, error) {
+	locations, err := location.NewDiskLocations(dir)
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := locations.Volumes()
+	if err != nil {
+		return nil, err
+	}
+	var selected []location.LocalVolume
+	for _, v := range volumes {
+		if collection != "" && v.Collection != collection {
+			continue
+		}
+		selected = append(selected, v)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].Collection != selected[j].Collection {
+			return selected[i].Collection < selected[j].Collection
+		}
+		return selected[i].Vid < selected[j].Vid
+	})
+	return selected, nil
+}
+
+// Run processes the volumes with at most concurrency volumes at the same time.
+// The results are in the same order as volumes.
+func Run(volumes []location.LocalVolume, concurrency int, process ProcessFunc) []*Result {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	results := make([]*Result, len(volumes))
+	tasks := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tasks {
+				v := volumes[i]
+				start := time.Now()
+				needles, err := process(v)
+				results[i] = &Result{Volume: v, Needles: needles, Duration: time.Since(start), Err: err}
+				if err != nil {
+					logrus.Errorf("failed to process volume <%d> of collection <%s>, err: %v", v.Vid, v.Collection, err)
+				} else {
+					logrus.Infof("processed volume <%d> of collection <%s>, %d needles in %v", v.Vid, v.Collection, needles, results[i].Duration)
+				}
+			}
+		}()
+	}
+	for i := range volumes {
+		tasks <- i
+	}
+	close(tasks)
+	wg.Wait()
+	return results
+}
+
+// Report logs the result of every volume and returns the number of failed volumes.
+func Report(results []*Result) int {
+	var failed int
+	var needles int64
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			logrus.Errorf("FAIL volume <%d> of collection <%s>: %v", r.Volume.Vid, r.Volume.Collection, r.Err)
+			continue
+		}
+		needles += r.Needles
+		logrus.Infof("OK   volume <%d> of collection <%s>: %d needles, %v", r.Volume.Vid, r.Volume.Collection, r.Needles, r.Duration)
+	}
+	logrus.Infof("processed %d volumes, %d succeeded, %d failed, %d needles written",
+		len(results), len(results)-failed, failed, needles)
+	return failed
+}
+
+// Verify checks the rewritten volume in dstDir before it replaces the original one:
+// the .idx is complete, holds exactly the written needles, and all of them are inside the .dat.
+// The .idx is loaded in memory unless it exceeds memoryBudget bytes, see needlemap.New.
+func Verify(v location.LocalVolume, dstDir string, needles int64, memoryBudget int64) error {
+	base := storage.VolumeFileName(dstDir, v.Collection, int(v.Vid))
+	datInfo, err := os.Stat(base + ".dat")
+	if err != nil {
+		return err
+	}
+	if datInfo.Size() < super_block.SuperBlockSize {
+		return fmt.Errorf("%s.dat has no superblock", base)
+	}
+	idxInfo, err := os.Stat(base + ".idx")
+	if err != nil {
+		return err
+	}
+	if idxInfo.Size()%types.NeedleMapEntrySize != 0 {
+		return fmt.Errorf("%s.idx has %d bytes, not a multiple of %d", base, idxInfo.Size(), types.NeedleMapEntrySize)
+	}
+	nm, err := needlemap.Load(base+".idx", memoryBudget, dstDir)
+	if err != nil {
+		return err
+	}
+	defer nm.Close()
+	var live int64
+	err = nm.AscendingVisit(func(nv needle_map.NeedleValue) error {
+		if nv.Size == 0 || nv.Size == types.TombstoneFileSize {
+			return nil
+		}
+		if nv.Offset.ToAcutalOffset()+int64(nv.Size) > datInfo.Size() {
+			return fmt.Errorf("needle %v is out of %s.dat", nv.Key, base)
+		}
+		live++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if live != needles {
+		return fmt.Errorf("%s.idx has %d needles, but %d needles were written", base, live, needles)
+	}
+	return nil
+}
+
+// Replace swaps the rewritten .idx and .dat in dstDir with the original ones, dstDir must be on the same filesystem.
+// The original files are kept as a rollback generation, see Swap. The rewritten files keep the marks
+// of the original ones and carry the given marks as well.
+func Replace(v location.LocalVolume, dstDir string, keep int, marks ...string) error {
+	current, err := Marks(v)
+	if err != nil {
+		return err
+	}
+	for _, mark := range marks {
+		if !containsMark(current, mark) {
+			current = append(current, mark)
+		}
+	}
+	dst := storage.VolumeFileName(dstDir, v.Collection, int(v.Vid))
+	return Swap(v, dst+".dat", dst+".idx", keep, current)
+}
@@ -0,0 +1,279 @@
+package batch
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/operation"
+	"github.com/chrislusf/seaweedfs/weed/pb/master_pb"
+	"github.com/chrislusf/seaweedfs/weed/pb/volume_server_pb"
+	"github.com/chrislusf/seaweedfs/weed/security"
+	"github.com/chrislusf/seaweedfs/weed/util"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+)
+
+// 默认等待master确认挂载状态的最长时间, volume server的心跳间隔为5秒
+const DefaultMountTimeout = time.Minute
+
+// Coordinator unmounts a volume from the volume server serving it before its files are rewritten,
+// and mounts it back afterwards. Both are confirmed through the topology of the master.
+type Coordinator struct {
+	// volume server的地址, 与它在master中注册的地址一致, 例如10.0.2.15:8080
+	VolumeServer   string
+	MasterGrpc     string
+	GrpcDialOption grpc.DialOption
+	Timeout        time.Duration
+}
+
+// NewCoordinator creates a Coordinator with the grpc client options in security.toml
+// and checks that the master knows the volume server.
+func NewCoordinator(volumeServer, masterGrpc string) (*Coordinator, error) {
+	util.LoadConfiguration("security", false)
+	coordinator := &Coordinator{
+		VolumeServer:   volumeServer,
+		MasterGrpc:     masterGrpc,
+		GrpcDialOption: security.LoadClientTLS(util.GetViper(), "grpc.client"),
+	}
+	if err := coordinator.Check(); err != nil {
+		return nil, err
+	}
+	return coordinator, nil
+}
+
+// Guard protects the volumes from being written while process rewrites their files.
+// If volumeServer is provided, each volume is unmounted from it around process through a Coordinator.
+// Otherwise the files of all the volumes are made read-only up front, so that seaweedfs writes into
+// other volumes, and a volume is made writable again if process fails on it.
+func Guard(volumes []location.LocalVolume, volumeServer, masterGrpc string, process ProcessFunc) (ProcessFunc, error) {
+	if volumeServer != "" {
+		coordinator, err := NewCoordinator(volumeServer, masterGrpc)
+		if err != nil {
+			return nil, err
+		}
+		return coordinator.Wrap(process), nil
+	}
+	// 将所有volume设置为只读状态, 后续的写操作, seaweedfs会为之新建volume去写
+	for _, v := range volumes {
+		SetReadOnly(v, true)
+	}
+	return func(v location.LocalVolume) (int64, error) {
+		needles, err := process(v)
+		if err != nil {
+			SetReadOnly(v, false)
+		}
+		return needles, err
+	}, nil
+}
+
+// SetReadOnly changes the mode of the .idx and .dat of the volume to 0444, or back to 0644.
+func SetReadOnly(v location.LocalVolume, readOnly bool) {
+	mode := os.FileMode(0644)
+	if readOnly {
+		mode = 0444
+	}
+	for _, ext := range []string{".idx", ".dat"} {
+		if err := os.Chmod(v.BaseFileName()+ext, mode); err != nil {
+			logrus.Warningf("failed to chmod %s, err: %v", v.BaseFileName()+ext, err)
+		}
+	}
+}
+
+// Check makes sure the master knows the volume server, otherwise an unmounted volume
+// could not be told from a volume server registered with another address.
+func (c *Coordinator) Check() error {
+	topo, err := c.topology()
+	if err != nil {
+		return err
+	}
+	for _, dn := range dataNodes(topo) {
+		if dn.Id == c.VolumeServer {
+			return nil
+		}
+	}
+	return fmt.Errorf("volume server %s is not registered in master %s", c.VolumeServer, c.MasterGrpc)
+}
+
+// Unmount marks the volume read-only and unmounts it from the volume server, then waits until
+// the master no longer sees it on the host of the volume server. Another volume server on the
+// same host may serve the same files, so the volume is refused if it is still mounted there.
+func (c *Coordinator) Unmount(vid uint32) error {
+	err := operation.WithVolumeServerClient(c.VolumeServer, c.GrpcDialOption, func(client volume_server_pb.VolumeServerClient) error {
+		mounted, err := c.mountedOn(vid)
+		if err != nil {
+			return err
+		}
+		var others []string
+		for _, server := range mounted {
+			if server != c.VolumeServer {
+				others = append(others, server)
+			}
+		}
+		if len(others) > 0 {
+			return fmt.Errorf("refuse to rewrite volume <%d>, it is mounted on %v", vid, others)
+		}
+		if len(mounted) == 0 {
+			logrus.Debugf("volume <%d> is not mounted on %s", vid, c.VolumeServer)
+			return nil
+		}
+		if _, err = client.VolumeMarkReadonly(context.Background(), &volume_server_pb.VolumeMarkReadonlyRequest{VolumeId: vid}); err != nil {
+			return fmt.Errorf("failed to mark volume <%d> read-only on %s, err: %v", vid, c.VolumeServer, err)
+		}
+		if _, err = client.VolumeUnmount(context.Background(), &volume_server_pb.VolumeUnmountRequest{VolumeId: vid}); err != nil {
+			return fmt.Errorf("failed to unmount volume <%d> from %s, err: %v", vid, c.VolumeServer, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var mounted []string
+	err = c.wait(func() (bool, error) {
+		mounted, err = c.mountedOn(vid)
+		return len(mounted) == 0, err
+	})
+	if err != nil {
+		return fmt.Errorf("refuse to rewrite volume <%d>, it is still mounted on %v, err: %v", vid, mounted, err)
+	}
+	logrus.Infof("unmounted volume <%d> from %s", vid, c.VolumeServer)
+	return nil
+}
+
+// Mount mounts the volume on the volume server and returns the volume info once the master sees it.
+func (c *Coordinator) Mount(vid uint32) (*master_pb.VolumeInformationMessage, error) {
+	err := operation.WithVolumeServerClient(c.VolumeServer, c.GrpcDialOption, func(client volume_server_pb.VolumeServerClient) error {
+		_, err := client.VolumeMount(context.Background(), &volume_server_pb.VolumeMountRequest{VolumeId: vid})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to mount volume <%d> on %s, err: %v", vid, c.VolumeServer, err)
+	}
+
+	var info *master_pb.VolumeInformationMessage
+	err = c.wait(func() (bool, error) {
+		topo, err := c.topology()
+		if err != nil {
+			return false, err
+		}
+		for _, dn := range dataNodes(topo) {
+			if dn.Id != c.VolumeServer {
+				continue
+			}
+			for _, vi := range dn.VolumeInfos {
+				if vi.Id == vid {
+					info = vi
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("master does not see volume <%d> mounted on %s, err: %v", vid, c.VolumeServer, err)
+	}
+	logrus.Infof("mounted volume <%d> on %s, master sees %d files", vid, c.VolumeServer, info.FileCount)
+	return info, nil
+}
+
+// Wrap unmounts the volume around process, which is expected to replace the volume files.
+// When process succeeds, the master must see at least the written needles in the mounted volume.
+func (c *Coordinator) Wrap(process ProcessFunc) ProcessFunc {
+	return func(v location.LocalVolume) (int64, error) {
+		if err := c.Unmount(v.Vid); err != nil {
+			return 0, err
+		}
+		needles, err := process(v)
+		// 失败时挂载原来的文件, 恢复服务
+		info, mountErr := c.Mount(v.Vid)
+		if mountErr != nil {
+			if err != nil {
+				logrus.Errorf("volume <%d> stays unmounted, err: %v", v.Vid, mountErr)
+				return needles, err
+			}
+			return needles, mountErr
+		}
+		if err == nil && info.FileCount < uint64(needles) {
+			return needles, fmt.Errorf("master sees %d files in volume <%d>, but %d needles were written", info.FileCount, v.Vid, needles)
+		}
+		return needles, err
+	}
+}
+
+// mountedOn returns the volume servers on the host of c.VolumeServer which have the volume mounted.
+func (c *Coordinator) mountedOn(vid uint32) ([]string, error) {
+	topo, err := c.topology()
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(c.VolumeServer)
+	if err != nil {
+		return nil, err
+	}
+	var mounted []string
+	for _, dn := range dataNodes(topo) {
+		if dnHost, _, err := net.SplitHostPort(dn.Id); err != nil || dnHost != host {
+			continue
+		}
+		for _, vi := range dn.VolumeInfos {
+			if vi.Id == vid {
+				mounted = append(mounted, dn.Id)
+				break
+			}
+		}
+	}
+	return mounted, nil
+}
+
+func (c *Coordinator) topology() (*master_pb.TopologyInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	// TODO: add more dial options
+	conn, err := grpc.Dial(c.MasterGrpc, grpc.WithInsecure())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s, err: %v", c.MasterGrpc, err)
+	}
+	defer conn.Close()
+	resp, err := master_pb.NewSeaweedClient(conn).VolumeList(ctx, &master_pb.VolumeListRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volume info from %s, err: %v", c.MasterGrpc, err)
+	}
+	return resp.TopologyInfo, nil
+}
+
+// wait polls done every second until it returns true or the timeout expires.
+func (c *Coordinator) wait(done func() (bool, error)) error {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultMountTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := done()
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("timeout after %v", timeout)
+			}
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func dataNodes(topo *master_pb.TopologyInfo) []*master_pb.DataNodeInfo {
+	var nodes []*master_pb.DataNodeInfo
+	for _, dc := range topo.DataCenterInfos {
+		for _, r := range dc.RackInfos {
+			nodes = append(nodes, r.DataNodeInfos...)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,371 @@
+package batch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+)
+
+// 替换volume时, 原来的.dat/.idx以硬链接的方式保留在<dir>/.rollback/<name>.<generation>.dat|.idx中,
+// 替换过程记录在<dir>/.rollback/<name>.journal中, 中途崩溃后由Recover根据journal继续或者撤销.
+// volume当前文件的标记(比如已经加密)记录在<dir>/.rollback/<name>.marks中, 每个generation的标记
+// 记录在<name>.<generation>.marks中, 随替换和回滚一起切换.
+const (
+	RollbackDir    = ".rollback"
+	journalFileExt = ".journal"
+	marksFileExt   = ".marks"
+)
+
+// MarkEncrypted marks the volumes whose files are encrypted by the transformer.
+const MarkEncrypted = "encrypted"
+
+type Journal struct {
+	Time       time.Time `json:"time"`
+	Collection string    `json:"collection"`
+	VolumeId   uint32    `json:"volume_id"`
+	// 原来的文件保存为该generation
+	Generation int    `json:"generation"`
+	NewDat     string `json:"new_dat"`
+	NewIdx     string `json:"new_idx"`
+	// 替换后的文件的标记
+	Marks []string `json:"marks,omitempty"`
+}
+
+func volumeName(v location.LocalVolume) string {
+	return filepath.Base(v.BaseFileName())
+}
+
+func journalPath(v location.LocalVolume) string {
+	return path.Join(v.Dir, RollbackDir, volumeName(v)+journalFileExt)
+}
+
+// GenerationBase returns the path of the generation files without the extension.
+func GenerationBase(v location.LocalVolume, generation int) string {
+	return path.Join(v.Dir, RollbackDir, fmt.Sprintf("%s.%d", volumeName(v), generation))
+}
+
+func marksPath(v location.LocalVolume) string {
+	return path.Join(v.Dir, RollbackDir, volumeName(v)+marksFileExt)
+}
+
+// Marks returns the marks of the current files of the volume, see Replace.
+func Marks(v location.LocalVolume) ([]string, error) {
+	return loadMarks(marksPath(v))
+}
+
+// HasMark reports whether the current files of the volume carry the mark.
+func HasMark(v location.LocalVolume, mark string) (bool, error) {
+	marks, err := Marks(v)
+	if err != nil {
+		return false, err
+	}
+	return containsMark(marks, mark), nil
+}
+
+func containsMark(marks []string, mark string) bool {
+	for _, m := range marks {
+		if m == mark {
+			return true
+		}
+	}
+	return false
+}
+
+// Generations lists the rollback generations of the volume, from the oldest to the latest.
+func Generations(v location.LocalVolume) ([]int, error) {
+	prefix := volumeName(v) + "."
+	datFiles, err := filepath.Glob(path.Join(v.Dir, RollbackDir, prefix+"*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	var generations []int
+	for _, datFile := range datFiles {
+		s := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(datFile), prefix), ".dat")
+		generation, err := strconv.Atoi(s)
+		if err != nil {
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	sort.Ints(generations)
+	return generations, nil
+}
+
+// Swap replaces the .dat/.idx of the volume with newDat/newIdx, which must be on the same filesystem.
+// The original files are kept as a new rollback generation, only the latest keep generations are retained.
+// The new files carry the given marks, the marks of the original files are kept with the generation.
+func Swap(v location.LocalVolume, newDat, newIdx string, keep int, marks []string) error {
+	if err := os.MkdirAll(path.Join(v.Dir, RollbackDir), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(journalPath(v)); err == nil {
+		return fmt.Errorf("unfinished swap of volume <%d>, run recovery first", v.Vid)
+	}
+	for _, f := range []string{newDat, newIdx} {
+		if err := syncFile(f); err != nil {
+			return err
+		}
+	}
+
+	generations, err := Generations(v)
+	if err != nil {
+		return err
+	}
+	j := &Journal{
+		Time:       time.Now(),
+		Collection: v.Collection,
+		VolumeId:   v.Vid,
+		Generation: 1,
+		NewDat:     newDat,
+		NewIdx:     newIdx,
+		Marks:      marks,
+	}
+	if len(generations) > 0 {
+		j.Generation = generations[len(generations)-1] + 1
+	}
+	if err = saveJournal(v, j); err != nil {
+		return err
+	}
+
+	// 1. 保留原来的文件和标记
+	src, gen := v.BaseFileName(), GenerationBase(v, j.Generation)
+	for _, ext := range []string{".idx", ".dat"} {
+		if err = os.Link(src+ext, gen+ext); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		var current []string
+		if current, err = Marks(v); err == nil {
+			err = saveMarks(gen+marksFileExt, current)
+		}
+	}
+	if err == nil {
+		err = syncDir(path.Join(v.Dir, RollbackDir))
+	}
+	if err != nil {
+		// 还没有替换任何文件, 直接撤销
+		_ = os.Remove(gen + ".idx")
+		_ = os.Remove(gen + ".dat")
+		_ = os.Remove(gen + marksFileExt)
+		_ = os.Remove(journalPath(v))
+		return err
+	}
+	// 2. 先替换.idx再替换.dat, Recover依赖这个顺序判断进度
+	if err = os.Rename(newIdx, src+".idx"); err != nil {
+		return err
+	}
+	if err = os.Rename(newDat, src+".dat"); err != nil {
+		return err
+	}
+	if err = finishSwap(v, j); err != nil {
+		return err
+	}
+	return Prune(v, keep)
+}
+
+func finishSwap(v location.LocalVolume, j *Journal) error {
+	src := v.BaseFileName()
+	for _, ext := range []string{".idx", ".dat"} {
+		if err := os.Chmod(src+ext, 0644); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(v.Dir); err != nil {
+		return err
+	}
+	// 标记在删除journal之前切换, 崩溃后Recover会重新写入
+	if err := saveMarks(marksPath(v), j.Marks); err != nil {
+		return err
+	}
+	if err := os.Remove(journalPath(v)); err != nil {
+		return err
+	}
+	return syncDir(path.Join(v.Dir, RollbackDir))
+}
+
+// Recover finishes or undoes the swaps interrupted by a crash in dir.
+func Recover(dir string) error {
+	journals, err := filepath.Glob(path.Join(dir, RollbackDir, "*"+journalFileExt))
+	if err != nil {
+		return err
+	}
+	for _, filename := range journals {
+		j, err := loadJournal(filename)
+		if err != nil {
+			return fmt.Errorf("failed to load journal %s, err: %v", filename, err)
+		}
+		v := location.LocalVolume{Dir: dir, Collection: j.Collection, Vid: j.VolumeId}
+		_, idxErr := os.Stat(j.NewIdx)
+		_, datErr := os.Stat(j.NewDat)
+		switch {
+		case idxErr == nil && datErr == nil:
+			// 还没有开始替换, 撤销
+			gen := GenerationBase(v, j.Generation)
+			_ = os.Remove(gen + ".idx")
+			_ = os.Remove(gen + ".dat")
+			_ = os.Remove(gen + marksFileExt)
+			if err = os.Remove(filename); err != nil {
+				return err
+			}
+			logrus.Warningf("undo the unfinished swap of volume <%d> of collection <%s>", j.VolumeId, j.Collection)
+		case os.IsNotExist(idxErr) && datErr == nil:
+			// .idx已经替换, 继续替换.dat
+			if err = os.Rename(j.NewDat, v.BaseFileName()+".dat"); err != nil {
+				return err
+			}
+			if err = finishSwap(v, j); err != nil {
+				return err
+			}
+			logrus.Warningf("finish the unfinished swap of volume <%d> of collection <%s>", j.VolumeId, j.Collection)
+		case os.IsNotExist(idxErr) && os.IsNotExist(datErr):
+			// 已经替换完成
+			if err = finishSwap(v, j); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("can not recover the swap of volume <%d> of collection <%s>, new .idx: %v, new .dat: %v",
+				j.VolumeId, j.Collection, idxErr, datErr)
+		}
+	}
+	return nil
+}
+
+// Rollback restores the given generation of the volume, the current files are kept as a new generation.
+func Rollback(v location.LocalVolume, generation int) error {
+	gen := GenerationBase(v, generation)
+	for _, ext := range []string{".idx", ".dat"} {
+		if _, err := os.Stat(gen + ext); err != nil {
+			return fmt.Errorf("generation %d of volume <%d> is not available, err: %v", generation, v.Vid, err)
+		}
+	}
+	marks, err := loadMarks(gen + marksFileExt)
+	if err != nil {
+		return err
+	}
+	// 回滚本身也是一次替换, 可以再次回滚
+	if err = Swap(v, gen+".dat", gen+".idx", 0, marks); err != nil {
+		return err
+	}
+	// 该generation的文件已经移走, 删除它的标记
+	if err = os.Remove(gen + marksFileExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Prune removes the rollback generations except the latest keep ones, keep <= 0 retains all.
+func Prune(v location.LocalVolume, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	generations, err := Generations(v)
+	if err != nil {
+		return err
+	}
+	for len(generations) > keep {
+		gen := GenerationBase(v, generations[0])
+		for _, ext := range []string{".idx", ".dat", marksFileExt} {
+			if err = os.Remove(gen + ext); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		generations = generations[1:]
+	}
+	return nil
+}
+
+func saveJournal(v location.LocalVolume, j *Journal) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	filename := journalPath(v)
+	if err = ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err = syncFile(filename + ".tmp"); err != nil {
+		return err
+	}
+	if err = os.Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+	return syncDir(path.Dir(filename))
+}
+
+func loadJournal(filename string) (*Journal, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{}
+	if err = json.Unmarshal(data, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// 没有标记文件时没有标记, 比如引入标记之前替换的volume
+func loadMarks(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var marks []string
+	if err = json.Unmarshal(data, &marks); err != nil {
+		return nil, fmt.Errorf("failed to parse marks %s, err: %v", filename, err)
+	}
+	return marks, nil
+}
+
+func saveMarks(filename string, marks []string) error {
+	if len(marks) == 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(marks)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err = syncFile(filename + ".tmp"); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+func syncFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
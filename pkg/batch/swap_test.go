@@ -0,0 +1,242 @@
+package batch
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+)
+
+// 一次Swap中途崩溃的位置
+type crashPoint int
+
+const (
+	afterJournal crashPoint = iota
+	afterLinks
+	afterIdxRename
+	afterDatRename
+)
+
+func writeFile(t *testing.T, filename, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, filename string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func exists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// 准备内容为content的volume, 以及内容为newContent的新文件
+func setupSwap(t *testing.T, content, newContent string) (v location.LocalVolume, newDat, newIdx string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "swap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err = os.MkdirAll(path.Join(dir, "dst"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	v = location.LocalVolume{Dir: dir, Collection: "test", Vid: 7}
+	writeFile(t, v.BaseFileName()+".dat", content+".dat")
+	writeFile(t, v.BaseFileName()+".idx", content+".idx")
+	newDat, newIdx = path.Join(dir, "dst", "test_7.dat"), path.Join(dir, "dst", "test_7.idx")
+	writeFile(t, newDat, newContent+".dat")
+	writeFile(t, newIdx, newContent+".idx")
+	return
+}
+
+// 按照Swap的顺序执行到point为止, 模拟在point之后崩溃
+func swapUntil(t *testing.T, v location.LocalVolume, newDat, newIdx string, marks []string, point crashPoint) {
+	t.Helper()
+	if err := os.MkdirAll(path.Join(v.Dir, RollbackDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	generations, err := Generations(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &Journal{Time: time.Now(), Collection: v.Collection, VolumeId: v.Vid, Generation: 1,
+		NewDat: newDat, NewIdx: newIdx, Marks: marks}
+	if len(generations) > 0 {
+		j.Generation = generations[len(generations)-1] + 1
+	}
+	if err = saveJournal(v, j); err != nil {
+		t.Fatal(err)
+	}
+	if point == afterJournal {
+		return
+	}
+	src, gen := v.BaseFileName(), GenerationBase(v, j.Generation)
+	for _, ext := range []string{".idx", ".dat"} {
+		if err = os.Link(src+ext, gen+ext); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current, err := Marks(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = saveMarks(gen+marksFileExt, current); err != nil {
+		t.Fatal(err)
+	}
+	if point == afterLinks {
+		return
+	}
+	if err = os.Rename(newIdx, src+".idx"); err != nil {
+		t.Fatal(err)
+	}
+	if point == afterIdxRename {
+		return
+	}
+	if err = os.Rename(newDat, src+".dat"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertVolume(t *testing.T, v location.LocalVolume, content string, marks []string) {
+	t.Helper()
+	for _, ext := range []string{".idx", ".dat"} {
+		if got := readFile(t, v.BaseFileName()+ext); got != content+ext {
+			t.Errorf("%s holds %q, want %q", ext, got, content+ext)
+		}
+	}
+	got, err := Marks(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, marks) {
+		t.Errorf("marks are %v, want %v", got, marks)
+	}
+	if exists(journalPath(v)) {
+		t.Errorf("journal is left behind")
+	}
+}
+
+func assertGenerations(t *testing.T, v location.LocalVolume, want []int) {
+	t.Helper()
+	generations, err := Generations(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(generations, want) {
+		t.Errorf("generations are %v, want %v", generations, want)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	cases := []struct {
+		name  string
+		point crashPoint
+		// Recover之后volume的内容
+		content     string
+		generations []int
+		marks       []string
+		newLeft     bool
+	}{
+		{"journal written", afterJournal, "old", nil, nil, true},
+		{"generation links made", afterLinks, "old", nil, nil, true},
+		{"idx renamed", afterIdxRename, "new", []int{1}, []string{MarkEncrypted}, false},
+		{"both files renamed", afterDatRename, "new", []int{1}, []string{MarkEncrypted}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v, newDat, newIdx := setupSwap(t, "old", "new")
+			swapUntil(t, v, newDat, newIdx, []string{MarkEncrypted}, c.point)
+			if err := Recover(v.Dir); err != nil {
+				t.Fatal(err)
+			}
+			assertVolume(t, v, c.content, c.marks)
+			assertGenerations(t, v, c.generations)
+			if exists(newDat) != c.newLeft || exists(newIdx) != c.newLeft {
+				t.Errorf("new files left behind: %v, want %v", exists(newDat), c.newLeft)
+			}
+			if !c.newLeft && exists(GenerationBase(v, 1)+marksFileExt) {
+				t.Errorf("the generation of unmarked files has marks")
+			}
+
+			// Recover之后可以正常地替换和回滚
+			writeFile(t, newDat, "newer.dat")
+			writeFile(t, newIdx, "newer.idx")
+			if err := Replace(v, path.Dir(newDat), 0); err != nil {
+				t.Fatal(err)
+			}
+			assertVolume(t, v, "newer", c.marks)
+			generations, err := Generations(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			latest := generations[len(generations)-1]
+			if err = Rollback(v, latest); err != nil {
+				t.Fatal(err)
+			}
+			assertVolume(t, v, c.content, c.marks)
+			if c.newLeft {
+				return
+			}
+			// 回滚到加密之前的generation, 标记随之去掉
+			if err = Rollback(v, 1); err != nil {
+				t.Fatal(err)
+			}
+			assertVolume(t, v, "old", nil)
+		})
+	}
+}
+
+func TestRecoverRejectsMissingFiles(t *testing.T) {
+	v, newDat, newIdx := setupSwap(t, "old", "new")
+	swapUntil(t, v, newDat, newIdx, nil, afterLinks)
+	// 新的.idx还在而.dat丢失, 无法判断进度
+	if err := os.Remove(newDat); err != nil {
+		t.Fatal(err)
+	}
+	if err := Recover(v.Dir); err == nil {
+		t.Fatal("Recover succeeds without the new .dat")
+	}
+	if err := Swap(v, newDat, newIdx, 0, nil); err == nil {
+		t.Fatal("Swap succeeds with an unfinished journal")
+	}
+}
+
+func TestSwapPrune(t *testing.T) {
+	v, newDat, newIdx := setupSwap(t, "v0", "v1")
+	if err := Replace(v, path.Dir(newDat), 2, MarkEncrypted); err != nil {
+		t.Fatal(err)
+	}
+	for i, content := range []string{"v2", "v3"} {
+		writeFile(t, newDat, content+".dat")
+		writeFile(t, newIdx, content+".idx")
+		if err := Replace(v, path.Dir(newDat), 2); err != nil {
+			t.Fatalf("replace %d, err: %v", i, err)
+		}
+	}
+	assertVolume(t, v, "v3", []string{MarkEncrypted})
+	assertGenerations(t, v, []int{2, 3})
+	if exists(GenerationBase(v, 1) + marksFileExt) {
+		t.Errorf("marks of the pruned generation are left behind")
+	}
+	if err := Rollback(v, 2); err != nil {
+		t.Fatal(err)
+	}
+	assertVolume(t, v, "v1", []string{MarkEncrypted})
+	assertGenerations(t, v, []int{3, 4})
+	if got := readFile(t, GenerationBase(v, 4)+".dat"); got != "v3.dat" {
+		t.Errorf("generation 4 holds %q, want the replaced v3", got)
+	}
+}
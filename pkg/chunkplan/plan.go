@@ -0,0 +1,280 @@
+package chunkplan
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/chrislusf/seaweedfs/weed/operation"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/needlemap"
+	"github.com/amazingchow/seaweedfs-tools/pkg/rewrite"
+)
+
+// 一个needle在集群中的位置, 不包括cookie
+type needleKey struct {
+	vid uint32
+	key types.NeedleId
+}
+
+// ChunkedFile is a chunked file to delete as a whole, one line of the delete plan.
+type ChunkedFile struct {
+	Manifest string   `json:"manifest"`
+	Name     string   `json:"name,omitempty"`
+	Size     int64    `json:"size"`
+	Chunks   []string `json:"chunks"`
+}
+
+type chunkedFile struct {
+	ChunkedFile
+	manifest needleKey
+	chunks   []needleKey
+	dropped  bool
+}
+
+// Plan keeps or drops every chunked file as a whole: the manifest is judged by the stages,
+// and its chunks, in whichever volume they are, follow the manifest. A chunked file sharing
+// any chunk with a kept chunked file is kept as well.
+//
+// The manifests of all the volumes are added by Scan or Add first, then Resolve decides
+// the chunked files, the other methods can only be called after Resolve.
+type Plan struct {
+	files      []*chunkedFile
+	byManifest map[string][]*chunkedFile
+	// 引用每个chunk的chunked file, 所有引用者都已经保留的chunk会被删除
+	sharing   map[needleKey][]*chunkedFile
+	decisions map[needleKey]bool
+
+	Files   int64
+	Dropped int64
+	// 无法解析的manifest, 保留
+	Broken int64
+}
+
+func New() *Plan {
+	return &Plan{byManifest: make(map[string][]*chunkedFile)}
+}
+
+// Scan adds the manifests of the live needles in v to the plan.
+func (p *Plan) Scan(v location.LocalVolume, stages []rewrite.Stage, memoryBudget int64, tmpDir string) error {
+	nm, err := needlemap.Load(v.BaseFileName()+".idx", memoryBudget, tmpDir)
+	if err != nil {
+		return fmt.Errorf("failed to load needle map from %s, err: %v", v.BaseFileName()+".idx", err)
+	}
+	defer nm.Close()
+	scanner := &manifestScanner{plan: p, vid: v.Vid, stages: stages}
+	if err = rewrite.ScanVolume(v, nm, rewrite.ScanIndex, scanner); err != nil {
+		return fmt.Errorf("failed to scan %s, err: %v", v.BaseFileName()+".dat", err)
+	}
+	return nil
+}
+
+// Add adds the manifest needle n of volume vid, the chunked file is dropped if dropped is true.
+func (p *Plan) Add(vid uint32, n *needle.Needle, dropped bool) {
+	fid := needle.NewFileId(needle.VolumeId(vid), uint64(n.Id), uint32(n.Cookie)).String()
+	file := &chunkedFile{
+		ChunkedFile: ChunkedFile{Manifest: fid},
+		manifest:    needleKey{vid: vid, key: n.Id},
+		dropped:     dropped,
+	}
+	p.files = append(p.files, file)
+	p.byManifest[fid] = append(p.byManifest[fid], file)
+	p.Files++
+
+	cm, err := operation.LoadChunkManifest(n.Data, n.IsGzipped())
+	if err != nil {
+		logrus.Warningf("failed to parse chunk manifest %s, keep it, err: %v", fid, err)
+		p.Broken++
+		file.dropped = false
+		return
+	}
+	file.Name, file.Size = cm.Name, cm.Size
+	for _, chunk := range cm.Chunks {
+		chunkFid, err := needle.ParseFileIdFromString(chunk.Fid)
+		if err != nil {
+			// 无法定位所有的chunk时不能完整地删除, 保留整个文件
+			logrus.Warningf("failed to parse chunk %s of manifest %s, keep the chunked file, err: %v", chunk.Fid, fid, err)
+			file.dropped = false
+			continue
+		}
+		file.Chunks = append(file.Chunks, chunk.Fid)
+		file.chunks = append(file.chunks, needleKey{vid: uint32(chunkFid.VolumeId), key: chunkFid.Key})
+	}
+}
+
+// Resolve decides every chunked file after all the manifests are added.
+func (p *Plan) Resolve() {
+	p.sharing = make(map[needleKey][]*chunkedFile)
+	var kept []*chunkedFile
+	for _, file := range p.files {
+		for _, k := range file.chunks {
+			p.sharing[k] = append(p.sharing[k], file)
+		}
+		if !file.dropped {
+			kept = append(kept, file)
+		}
+	}
+	p.propagate(kept)
+
+	p.decisions = make(map[needleKey]bool)
+	p.Dropped = 0
+	for _, file := range p.files {
+		p.decisions[file.manifest] = file.dropped
+		for _, k := range file.chunks {
+			p.decisions[k] = file.dropped
+		}
+		if file.dropped {
+			p.Dropped++
+		}
+	}
+}
+
+// propagate keeps the dropped chunked files sharing chunks with the kept ones, transitively,
+// and returns the chunked files kept by it.
+// 每个chunk只在第一次被保留的chunked file引用时检查一次, 总的开销与chunk的引用数成正比
+func (p *Plan) propagate(kept []*chunkedFile) []*chunkedFile {
+	var newlyKept []*chunkedFile
+	queue := append([]*chunkedFile(nil), kept...)
+	for len(queue) > 0 {
+		file := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		for _, k := range file.chunks {
+			for _, other := range p.sharing[k] {
+				if other.dropped {
+					logrus.Debugf("chunked file %s shares chunks with a kept chunked file, keep it", other.Manifest)
+					other.dropped = false
+					newlyKept = append(newlyKept, other)
+					queue = append(queue, other)
+				}
+			}
+			delete(p.sharing, k)
+		}
+	}
+	return newlyKept
+}
+
+// Keep keeps the dropped chunked file of the manifest after all, e.g. when it fails to be deleted,
+// together with the dropped chunked files sharing chunks with it.
+func (p *Plan) Keep(manifest string) {
+	var kept []*chunkedFile
+	for _, file := range p.byManifest[manifest] {
+		if file.dropped {
+			file.dropped = false
+			kept = append(kept, file)
+		}
+	}
+	kept = append(kept, p.propagate(kept)...)
+	for _, file := range kept {
+		p.decisions[file.manifest] = false
+		for _, k := range file.chunks {
+			p.decisions[k] = false
+		}
+		p.Dropped--
+	}
+}
+
+// Decide reports whether the plan drops the needle, ok is false if it is not part of any chunked file.
+func (p *Plan) Decide(vid uint32, key types.NeedleId) (dropped bool, ok bool) {
+	dropped, ok = p.decisions[needleKey{vid: vid, key: key}]
+	return
+}
+
+// Stages returns the stages to process volume vid with: the needles of the chunked files are
+// kept or dropped by the plan, the other needles by the stages, and all the transforms still apply.
+func (p *Plan) Stages(vid uint32, stages []rewrite.Stage) []rewrite.Stage {
+	planned := []rewrite.Stage{{
+		Name: "chunk plan",
+		Drop: func(src *needle.Needle) bool {
+			if dropped, ok := p.Decide(vid, src.Id); ok {
+				return dropped
+			}
+			return rewrite.Dropped(stages, src)
+		},
+	}}
+	for _, stage := range stages {
+		if stage.Transform != nil {
+			planned = append(planned, rewrite.Stage{Name: stage.Name, Transform: stage.Transform})
+		}
+	}
+	return planned
+}
+
+// DroppedFiles returns the chunked files to delete.
+func (p *Plan) DroppedFiles() []*ChunkedFile {
+	var files []*ChunkedFile
+	for _, file := range p.files {
+		if file.dropped {
+			files = append(files, &file.ChunkedFile)
+		}
+	}
+	return files
+}
+
+// Outside returns the number of the needles of the dropped chunked files which are not in the volumes.
+func (p *Plan) Outside(vids map[uint32]bool) int {
+	var outside int
+	for _, file := range p.files {
+		if !file.dropped {
+			continue
+		}
+		for _, k := range append([]needleKey{file.manifest}, file.chunks...) {
+			if !vids[k.vid] {
+				outside++
+			}
+		}
+	}
+	return outside
+}
+
+// Save writes the dropped chunked files into filename, one json per line.
+func (p *Plan) Save(filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, f := range p.DroppedFiles() {
+		data, err := json.Marshal(f)
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		if _, err = w.Write(append(data, '\n')); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// 实现seaweedfs的VolumeFileScanner接口, 只处理manifest
+type manifestScanner struct {
+	plan   *Plan
+	vid    uint32
+	stages []rewrite.Stage
+}
+
+func (scanner *manifestScanner) VisitSuperBlock(super_block.SuperBlock) error {
+	return nil
+}
+
+func (scanner *manifestScanner) ReadNeedleBody() bool {
+	return true
+}
+
+func (scanner *manifestScanner) VisitNeedle(n *needle.Needle, _ int64, _, _ []byte) error {
+	if n.IsChunkedManifest() {
+		scanner.plan.Add(scanner.vid, n, rewrite.Dropped(scanner.stages, n))
+	}
+	return nil
+}
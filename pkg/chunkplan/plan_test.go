@@ -0,0 +1,172 @@
+package chunkplan
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/chrislusf/seaweedfs/weed/operation"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+)
+
+// manifest所在的volume和chunk所在的volume
+const (
+	manifestVid = 1
+	chunkVid    = 2
+)
+
+// chunked file的manifest needle id, 是否被stage丢弃, 以及它的chunk在chunkVid中的needle id
+type testFile struct {
+	id      uint64
+	dropped bool
+	chunks  []uint64
+}
+
+func fid(vid uint32, key uint64) string {
+	return needle.NewFileId(needle.VolumeId(vid), key, 0x12345678).String()
+}
+
+func manifestNeedle(t *testing.T, id uint64, chunks []uint64) *needle.Needle {
+	t.Helper()
+	cm := &operation.ChunkManifest{Name: "file.bin"}
+	for i, chunk := range chunks {
+		cm.Chunks = append(cm.Chunks, &operation.ChunkInfo{Fid: fid(chunkVid, chunk), Offset: int64(i) * 100, Size: 100})
+		cm.Size += 100
+	}
+	data, err := json.Marshal(cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &needle.Needle{Id: types.NeedleId(id), Cookie: 0x12345678, Data: data}
+	n.SetIsChunkManifest()
+	return n
+}
+
+func newPlan(t *testing.T, files []testFile) *Plan {
+	t.Helper()
+	p := New()
+	for _, f := range files {
+		p.Add(manifestVid, manifestNeedle(t, f.id, f.chunks), f.dropped)
+	}
+	p.Resolve()
+	return p
+}
+
+// 检查每个chunked file的manifest和chunk是否都按照want被丢弃
+func assertDropped(t *testing.T, p *Plan, files []testFile, want []uint64) {
+	t.Helper()
+	var got []uint64
+	for _, f := range p.DroppedFiles() {
+		fileId, err := needle.ParseFileIdFromString(f.Manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, uint64(fileId.Key))
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dropped chunked files are %v, want %v", got, want)
+	}
+	if p.Dropped != int64(len(want)) {
+		t.Errorf("Dropped is %d, want %d", p.Dropped, len(want))
+	}
+	dropped := make(map[uint64]bool)
+	for _, id := range want {
+		dropped[id] = true
+	}
+	for _, f := range files {
+		keys := []needleKey{{vid: manifestVid, key: types.NeedleId(f.id)}}
+		for _, chunk := range f.chunks {
+			keys = append(keys, needleKey{vid: chunkVid, key: types.NeedleId(chunk)})
+		}
+		for _, k := range keys {
+			if d, ok := p.Decide(k.vid, k.key); !ok || d != dropped[f.id] {
+				t.Errorf("needle %v of chunked file %d is dropped: %v (planned %v), want %v", k, f.id, d, ok, dropped[f.id])
+			}
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	cases := []struct {
+		name  string
+		files []testFile
+		want  []uint64
+	}{
+		{"no shared chunks", []testFile{
+			{1, true, []uint64{11, 12}},
+			{2, false, []uint64{21, 22}},
+		}, []uint64{1}},
+		{"shared with a kept file", []testFile{
+			{1, true, []uint64{11, 12}},
+			{2, false, []uint64{12, 22}},
+		}, nil},
+		{"shared between dropped files", []testFile{
+			{1, true, []uint64{11, 12}},
+			{2, true, []uint64{12, 22}},
+		}, []uint64{1, 2}},
+		{"kept transitively", []testFile{
+			{1, true, []uint64{11, 12}},
+			{2, true, []uint64{12, 23}},
+			{3, false, []uint64{23, 33}},
+			{4, true, []uint64{41}},
+		}, []uint64{4}},
+		{"kept transitively in reverse order", []testFile{
+			{1, false, []uint64{11, 12}},
+			{2, true, []uint64{22, 33}},
+			{3, true, []uint64{33, 44}},
+			{4, true, []uint64{44, 12}},
+		}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newPlan(t, c.files)
+			if p.Files != int64(len(c.files)) {
+				t.Errorf("Files is %d, want %d", p.Files, len(c.files))
+			}
+			assertDropped(t, p, c.files, c.want)
+		})
+	}
+}
+
+func TestResolveKeepsBrokenManifest(t *testing.T) {
+	p := New()
+	broken := &needle.Needle{Id: 1, Cookie: 0x12345678, Data: []byte("not json")}
+	broken.SetIsChunkManifest()
+	p.Add(manifestVid, broken, true)
+	p.Add(manifestVid, manifestNeedle(t, 2, []uint64{21}), true)
+	p.Resolve()
+	if p.Broken != 1 || p.Dropped != 1 {
+		t.Errorf("Broken is %d and Dropped is %d, want 1 and 1", p.Broken, p.Dropped)
+	}
+	if dropped, ok := p.Decide(manifestVid, 1); !ok || dropped {
+		t.Errorf("the broken manifest is dropped: %v (planned %v)", dropped, ok)
+	}
+	if _, ok := p.Decide(chunkVid, 99); ok {
+		t.Errorf("a needle outside of the chunked files is planned")
+	}
+}
+
+func TestKeep(t *testing.T) {
+	files := []testFile{
+		{1, true, []uint64{11, 12}},
+		{2, true, []uint64{12, 23}},
+		{3, true, []uint64{23, 33}},
+		{4, true, []uint64{41}},
+		{5, false, []uint64{51}},
+	}
+	p := newPlan(t, files)
+	assertDropped(t, p, files, []uint64{1, 2, 3, 4})
+
+	// 保留2之后, 与它共享chunk的1和3也需要保留
+	p.Keep(fid(manifestVid, 2))
+	assertDropped(t, p, files, []uint64{4})
+	// 重复保留以及保留不存在的manifest没有影响
+	p.Keep(fid(manifestVid, 2))
+	p.Keep(fid(manifestVid, 99))
+	assertDropped(t, p, files, []uint64{4})
+	p.Keep(fid(manifestVid, 4))
+	assertDropped(t, p, files, nil)
+}
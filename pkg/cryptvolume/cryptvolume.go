@@ -0,0 +1,89 @@
+package cryptvolume
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+
+	myutils "github.com/amazingchow/seaweedfs-tools/pkg/utils"
+)
+
+// 加密备份的volume除了.dat/.idx之外还有一个.enc文件.
+// 加密后needle的大小会发生变化, 本地的offset与主集群不再一致, 因此增量同步所需的位置信息都以主集群为准记录在.enc文件中.
+const StateFileExt = ".enc"
+
+type State struct {
+	// 已经同步到的主集群.dat文件的位置
+	SourceTailOffset uint64 `json:"source_tail_offset"`
+	// 已经同步的最后一个needle的AppendAtNs, 用于发起下一次增量同步
+	LastAppendAtNs uint64 `json:"last_append_at_ns"`
+	// 主集群volume的compact revision, 主集群compact之后需要重新同步
+	CompactRevision uint32 `json:"compact_revision"`
+	// 本地.dat/.idx文件中已经落盘的大小, 超出的部分是同步中断时写入的, 需要丢弃
+	LocalDatSize uint64 `json:"local_dat_size"`
+	LocalIdxSize uint64 `json:"local_idx_size"`
+}
+
+// IsEncrypted reports whether the volume at baseFileName is an encrypted backup.
+func IsEncrypted(baseFileName string) bool {
+	_, err := os.Stat(baseFileName + StateFileExt)
+	return err == nil
+}
+
+// LoadState returns nil if the volume at baseFileName is not an encrypted backup.
+func LoadState(baseFileName string) (*State, error) {
+	data, err := ioutil.ReadFile(baseFileName + StateFileExt)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &State{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func SaveState(baseFileName string, state *State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpFile := baseFileName + StateFileExt + ".tmp"
+	if err = ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, baseFileName+StateFileExt)
+}
+
+// EncryptNeedle replaces the data of n with its ciphertext, name, mime and pairs are kept as they are.
+func EncryptNeedle(n *needle.Needle, key myutils.CipherKey) error {
+	if len(n.Data) == 0 {
+		return nil
+	}
+	data, err := myutils.Encrypt(n.Data, key)
+	if err != nil {
+		return err
+	}
+	n.Data = data
+	n.Checksum = needle.NewCRC(n.Data)
+	return nil
+}
+
+// DecryptNeedle restores the data of a needle encrypted by EncryptNeedle.
+func DecryptNeedle(n *needle.Needle, key myutils.CipherKey) error {
+	if len(n.Data) == 0 {
+		return nil
+	}
+	data, err := myutils.Decrypt(n.Data, key)
+	if err != nil {
+		return err
+	}
+	n.Data = data
+	n.Checksum = needle.NewCRC(n.Data)
+	return nil
+}
@@ -0,0 +1,195 @@
+package filermeta
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/chrislusf/seaweedfs/weed/pb/filer_pb"
+	"github.com/golang/protobuf/proto"
+)
+
+// 导出文件格式: magic(4 bytes) + version(1 byte) + 若干条记录,
+// 每条记录 = 长度(4 bytes, big endian) + proto序列化后的CreateEntryRequest
+var (
+	magic   = []byte("SWFM")
+	version = byte(1)
+)
+
+const (
+	listPageSize  = 1024
+	maxRecordSize = 64 * 1024 * 1024
+)
+
+var (
+	ErrInvalidFormat = errors.New("invalid filer meta file format")
+	ErrEntryExists   = errors.New("entry already exists on the filer")
+)
+
+type ExportResult struct {
+	Directories int64
+	Files       int64
+}
+
+// Export walks the filer namespace under root and writes every entry into w.
+// Every export is a full one, the entries of a filer can not be told changed
+// by their attributes, e.g. a renamed entry keeps its Mtime.
+func Export(client filer_pb.SeaweedFilerClient, root string, w io.Writer) (*ExportResult, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(magic); err != nil {
+		return nil, err
+	}
+	if err := bw.WriteByte(version); err != nil {
+		return nil, err
+	}
+
+	res := &ExportResult{}
+	err := walk(client, root, func(dir string, entry *filer_pb.Entry) error {
+		if err := writeRecord(bw, &filer_pb.CreateEntryRequest{Directory: dir, Entry: entry}); err != nil {
+			return err
+		}
+		if entry.IsDirectory {
+			res.Directories++
+		} else {
+			res.Files++
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	return res, bw.Flush()
+}
+
+// Import reads the entries exported by Export from r and recreates them on the filer.
+// If exclusive is true, the existing entries on the filer are not overwritten,
+// fn gets ErrEntryExists for them and the other errors as they are.
+// fn is called after each CreateEntry, the import stops if fn returns an error.
+func Import(client filer_pb.SeaweedFilerClient, r io.Reader, exclusive bool, fn func(req *filer_pb.CreateEntryRequest, err error) error) (int64, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, ErrInvalidFormat
+	}
+	if string(header[:len(magic)]) != string(magic) {
+		return 0, ErrInvalidFormat
+	}
+	if header[len(magic)] != version {
+		return 0, fmt.Errorf("unsupported filer meta file version %d", header[len(magic)])
+	}
+
+	var imported int64
+	for {
+		req, err := readRecord(br)
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, err
+		}
+		req.OExcl = exclusive
+		err = filer_pb.CreateEntry(client, req)
+		if err != nil && exclusive {
+			// 只有entry确实已经存在时才认为是OExcl导致的失败
+			_, lookupErr := filer_pb.LookupEntry(client, &filer_pb.LookupDirectoryEntryRequest{
+				Directory: req.Directory,
+				Name:      req.Entry.Name,
+			})
+			if lookupErr == nil {
+				err = ErrEntryExists
+			}
+		}
+		if fn != nil {
+			err = fn(req, err)
+		}
+		if err != nil {
+			return imported, err
+		}
+		imported++
+	}
+}
+
+func walk(client filer_pb.SeaweedFilerClient, dir string, fn func(dir string, entry *filer_pb.Entry) error) error {
+	var subDirs []string
+	lastFileName := ""
+	for {
+		stream, err := client.ListEntries(context.Background(), &filer_pb.ListEntriesRequest{
+			Directory:         dir,
+			StartFromFileName: lastFileName,
+			Limit:             listPageSize,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list %s, err: %v", dir, err)
+		}
+
+		count := 0
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to list %s, err: %v", dir, err)
+			}
+			count++
+			lastFileName = resp.Entry.Name
+			if err = fn(dir, resp.Entry); err != nil {
+				return err
+			}
+			if resp.Entry.IsDirectory {
+				subDirs = append(subDirs, path.Join(dir, resp.Entry.Name))
+			}
+		}
+		if count < listPageSize {
+			break
+		}
+	}
+
+	for _, subDir := range subDirs {
+		if err := walk(client, subDir, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeRecord(w io.Writer, req *filer_pb.CreateEntryRequest) error {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	if _, err = w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func readRecord(r io.Reader) (*filer_pb.CreateEntryRequest, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxRecordSize {
+		return nil, ErrInvalidFormat
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	req := &filer_pb.CreateEntryRequest{}
+	if err := proto.Unmarshal(data, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
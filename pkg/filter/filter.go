@@ -0,0 +1,256 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+)
+
+// 一个简单的needle过滤表达式, 例如:
+//
+//	mime ~ "image/*" and age > 180d and not header("X-Legal-Hold")
+//
+// 字段:
+//
+//	mime, name          : 字符串, 支持 ~ (glob匹配), ==, !=
+//	header("key")       : Pairs中的值(上传时以Seaweed-为前缀的http header), 支持 ~, ==, !=, 单独使用时表示存在该header
+//	size                : 数据大小, 单位B/KB/MB/GB, 支持 <, <=, >, >=, ==, !=
+//	age                 : 距离LastModified的时长, 单位s/m/h/d
+//	append_age          : 距离AppendAtNs的时长, 单位同上
+//	has_ttl, gzipped, chunk_manifest : 布尔值
+//
+// 使用and, or, not(或者&&, ||, !)以及括号组合, 优先级 not > and > or.
+//
+// 没有LastModified的needle的age, 没有AppendAtNs的needle的append_age, 以及不存在的header的比较结果是未知的,
+// 未知经过not仍然是未知, 只有结果确定为true时needle才匹配, 缺少字段的needle不会因为not而被匹配.
+type Expr interface {
+	Match(n *needle.Needle, now time.Time) bool
+	String() string
+}
+
+// 三值逻辑的结果
+type result int
+
+const (
+	resultFalse result = iota
+	resultTrue
+	resultUnknown
+)
+
+func known(b bool) result {
+	if b {
+		return resultTrue
+	}
+	return resultFalse
+}
+
+type node interface {
+	eval(n *needle.Needle, now time.Time) result
+	String() string
+}
+
+type matcher struct{ node }
+
+func (m *matcher) Match(n *needle.Needle, now time.Time) bool {
+	return m.eval(n, now) == resultTrue
+}
+
+// Parse parses the expression once, the result is safe for concurrent use.
+func Parse(s string) (Expr, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", p.peek(), p.peek().pos)
+	}
+	return &matcher{expr}, nil
+}
+
+type andExpr struct{ left, right node }
+
+func (e *andExpr) eval(n *needle.Needle, now time.Time) result {
+	left, right := e.left.eval(n, now), e.right.eval(n, now)
+	switch {
+	case left == resultFalse || right == resultFalse:
+		return resultFalse
+	case left == resultUnknown || right == resultUnknown:
+		return resultUnknown
+	}
+	return resultTrue
+}
+
+func (e *andExpr) String() string {
+	return fmt.Sprintf("(%s and %s)", e.left, e.right)
+}
+
+type orExpr struct{ left, right node }
+
+func (e *orExpr) eval(n *needle.Needle, now time.Time) result {
+	left, right := e.left.eval(n, now), e.right.eval(n, now)
+	switch {
+	case left == resultTrue || right == resultTrue:
+		return resultTrue
+	case left == resultUnknown || right == resultUnknown:
+		return resultUnknown
+	}
+	return resultFalse
+}
+
+func (e *orExpr) String() string {
+	return fmt.Sprintf("(%s or %s)", e.left, e.right)
+}
+
+type notExpr struct{ expr node }
+
+func (e *notExpr) eval(n *needle.Needle, now time.Time) result {
+	switch e.expr.eval(n, now) {
+	case resultTrue:
+		return resultFalse
+	case resultFalse:
+		return resultTrue
+	}
+	return resultUnknown
+}
+
+func (e *notExpr) String() string {
+	return fmt.Sprintf("not %s", e.expr)
+}
+
+type boolExpr struct {
+	field string
+}
+
+func (e *boolExpr) eval(n *needle.Needle, _ time.Time) result {
+	switch e.field {
+	case "has_ttl":
+		return known(n.HasTtl() && n.Ttl != nil && n.Ttl.String() != "")
+	case "gzipped":
+		return known(n.IsGzipped())
+	case "chunk_manifest":
+		return known(n.IsChunkedManifest())
+	}
+	return resultFalse
+}
+
+func (e *boolExpr) String() string {
+	return e.field
+}
+
+type stringExpr struct {
+	field  string
+	header string
+	op     string
+	value  string
+}
+
+func (e *stringExpr) eval(n *needle.Needle, _ time.Time) result {
+	var v string
+	switch e.field {
+	case "mime":
+		v = string(n.Mime)
+	case "name":
+		v = string(n.Name)
+	case "header":
+		var ok bool
+		v, ok = headerValue(n, e.header)
+		// 单独使用时判断是否存在, 比较不存在的header的结果未知
+		if e.op == "" {
+			return known(ok)
+		}
+		if !ok {
+			return resultUnknown
+		}
+	}
+	switch e.op {
+	case "~":
+		matched, _ := path.Match(e.value, v)
+		return known(matched)
+	case "==":
+		return known(v == e.value)
+	case "!=":
+		return known(v != e.value)
+	}
+	return resultFalse
+}
+
+func (e *stringExpr) String() string {
+	field := e.field
+	if e.field == "header" {
+		field = fmt.Sprintf("header(%q)", e.header)
+	}
+	if e.op == "" {
+		return field
+	}
+	return fmt.Sprintf("%s %s %q", field, e.op, e.value)
+}
+
+func headerValue(n *needle.Needle, key string) (string, bool) {
+	if len(n.Pairs) == 0 {
+		return "", false
+	}
+	pairs := make(map[string]string)
+	if err := json.Unmarshal(n.Pairs, &pairs); err != nil {
+		return "", false
+	}
+	key = strings.TrimPrefix(key, needle.PairNamePrefix)
+	for k, v := range pairs {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+type numberExpr struct {
+	field string
+	op    string
+	value int64
+	text  string
+}
+
+func (e *numberExpr) eval(n *needle.Needle, now time.Time) result {
+	var v int64
+	switch e.field {
+	case "size":
+		v = int64(n.DataSize)
+	case "age":
+		if !n.HasLastModifiedDate() || n.LastModified == 0 {
+			return resultUnknown
+		}
+		v = now.Unix() - int64(n.LastModified)
+	case "append_age":
+		if n.AppendAtNs == 0 {
+			return resultUnknown
+		}
+		v = (now.UnixNano() - int64(n.AppendAtNs)) / int64(time.Second)
+	}
+	switch e.op {
+	case "<":
+		return known(v < e.value)
+	case "<=":
+		return known(v <= e.value)
+	case ">":
+		return known(v > e.value)
+	case ">=":
+		return known(v >= e.value)
+	case "==":
+		return known(v == e.value)
+	case "!=":
+		return known(v != e.value)
+	}
+	return resultFalse
+}
+
+func (e *numberExpr) String() string {
+	return fmt.Sprintf("%s %s %s", e.field, e.op, e.text)
+}
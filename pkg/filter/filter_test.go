@@ -0,0 +1,170 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+)
+
+var now = time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// 200天前上传的2MB的jpeg, 带有X-Legal-Hold header
+func holdNeedle() *needle.Needle {
+	n := &needle.Needle{
+		Mime:         []byte("image/jpeg"),
+		Name:         []byte("a.jpg"),
+		DataSize:     2 << 20,
+		LastModified: uint64(now.Add(-200 * 24 * time.Hour).Unix()),
+		AppendAtNs:   uint64(now.Add(-time.Hour).UnixNano()),
+		Pairs:        []byte(`{"X-Legal-Hold":"true","Owner":"alice"}`),
+	}
+	n.SetHasMime()
+	n.SetHasName()
+	n.SetHasLastModifiedDate()
+	n.SetHasPairs()
+	return n
+}
+
+// 没有LastModified, mime, pairs的needle
+func bareNeedle() *needle.Needle {
+	return &needle.Needle{DataSize: 100}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		expr   string
+		needle *needle.Needle
+		want   bool
+	}{
+		// 字符串
+		{`mime ~ "image/*"`, holdNeedle(), true},
+		{`mime ~ "video/*"`, holdNeedle(), false},
+		{`mime == "image/jpeg"`, holdNeedle(), true},
+		{`mime != "image/jpeg"`, holdNeedle(), false},
+		{`name ~ "*.jpg"`, holdNeedle(), true},
+		{`mime == ""`, bareNeedle(), true},
+
+		// 大小单位
+		{`size == 2MB`, holdNeedle(), true},
+		{`size == 2m`, holdNeedle(), true},
+		{`size == 2048KB`, holdNeedle(), true},
+		{`size > 1GB`, holdNeedle(), false},
+		{`size <= 100`, bareNeedle(), true},
+		{`size < 100b`, bareNeedle(), false},
+
+		// 时长单位
+		{`age > 180d`, holdNeedle(), true},
+		{`age > 201d`, holdNeedle(), false},
+		{`age >= 4800h`, holdNeedle(), true},
+		{`age < 17280000s`, holdNeedle(), false},
+		{`append_age == 60m`, holdNeedle(), true},
+		{`append_age > 1h`, holdNeedle(), false},
+
+		// 没有LastModified的needle, age的比较结果未知, 经过not仍然未知
+		{`age > 0`, bareNeedle(), false},
+		{`age < 100d`, bareNeedle(), false},
+		{`age != 1s`, bareNeedle(), false},
+		{`not age > 180d`, bareNeedle(), false},
+		{`not age < 30d`, bareNeedle(), false},
+		{`not not age > 0`, bareNeedle(), false},
+		{`append_age >= 0`, bareNeedle(), false},
+		{`not append_age >= 0`, bareNeedle(), false},
+		// 未知 and false 为false, 未知 or true 为true
+		{`not (age > 180d and gzipped)`, bareNeedle(), true},
+		{`not (age > 180d or size > 1MB)`, bareNeedle(), false},
+		{`age > 180d or size <= 100`, bareNeedle(), true},
+		{`age > 180d and size <= 100`, bareNeedle(), false},
+
+		// header: 单独使用表示存在, 否则比较值
+		{`header("X-Legal-Hold")`, holdNeedle(), true},
+		{`header("x-legal-hold")`, holdNeedle(), true},
+		{`header("Seaweed-X-Legal-Hold")`, holdNeedle(), true},
+		{`header("X-Legal-Hold")`, bareNeedle(), false},
+		{`header("Owner") == "alice"`, holdNeedle(), true},
+		{`header("Owner") ~ "al*"`, holdNeedle(), true},
+		{`header("Owner") != "bob"`, holdNeedle(), true},
+		{`header("Missing") != "bob"`, holdNeedle(), false},
+		{`header("Missing") == ""`, holdNeedle(), false},
+		{`not header("Missing") == "bob"`, holdNeedle(), false},
+		{`not header("Missing")`, holdNeedle(), true},
+
+		// 布尔值
+		{`gzipped`, holdNeedle(), false},
+		{`has_ttl`, holdNeedle(), false},
+		{`chunk_manifest`, bareNeedle(), false},
+
+		// 优先级 not > and > or
+		{`mime ~ "image/*" and age > 180d and not header("X-Legal-Hold")`, holdNeedle(), false},
+		{`mime ~ "video/*" and size > 1MB or size > 1MB`, holdNeedle(), true},
+		{`mime ~ "video/*" and (size > 1MB or size > 1MB)`, holdNeedle(), false},
+		{`size > 1MB or size > 1MB and mime ~ "video/*"`, holdNeedle(), true},
+		{`(size > 1MB or size > 1MB) and mime ~ "video/*"`, holdNeedle(), false},
+		{`not mime ~ "video/*" and mime ~ "video/*"`, holdNeedle(), false},
+		{`not (mime ~ "video/*" and mime ~ "video/*")`, holdNeedle(), true},
+		{`!gzipped && size > 1MB || gzipped`, holdNeedle(), true},
+		{`not not gzipped`, holdNeedle(), false},
+	}
+	for _, c := range cases {
+		expr, err := Parse(c.expr)
+		if err != nil {
+			t.Errorf("Parse(%s) failed, err: %v", c.expr, err)
+			continue
+		}
+		if got := expr.Match(c.needle, now); got != c.want {
+			t.Errorf("%s (parsed as %s) matches %v, want %v", c.expr, expr, got, c.want)
+		}
+	}
+}
+
+func TestParseString(t *testing.T) {
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{`mime ~ "image/*" and age > 180d and not header("X-Legal-Hold")`,
+			`((mime ~ "image/*" and age > 180d) and not header("X-Legal-Hold"))`},
+		{`gzipped or has_ttl and chunk_manifest`, `(gzipped or (has_ttl and chunk_manifest))`},
+		{`(gzipped || has_ttl) && !chunk_manifest`, `((gzipped or has_ttl) and not chunk_manifest)`},
+		{`header("k") == "v" or size >= 1KB`, `(header("k") == "v" or size >= 1KB)`},
+	}
+	for _, c := range cases {
+		expr, err := Parse(c.expr)
+		if err != nil {
+			t.Errorf("Parse(%s) failed, err: %v", c.expr, err)
+			continue
+		}
+		if got := expr.String(); got != c.want {
+			t.Errorf("Parse(%s) = %s, want %s", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, s := range []string{
+		``,
+		`mime`,
+		`mime ~ image`,
+		`mime ~ "[image"`,
+		`name ~ "a\\"`,
+		`header("k") ~ "[a-"`,
+		`mime > "a"`,
+		`size > 1TB`,
+		`size > big`,
+		`age > 1w`,
+		`age ~ "1d"`,
+		`header(k)`,
+		`header("k"`,
+		`(gzipped`,
+		`gzipped)`,
+		`gzipped and`,
+		`not`,
+		`unknown`,
+		`gzipped # has_ttl`,
+		`mime == "unterminated`,
+	} {
+		if expr, err := Parse(s); err == nil {
+			t.Errorf("Parse(%s) = %s, want an error", s, expr)
+		}
+	}
+}
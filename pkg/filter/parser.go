@@ -0,0 +1,302 @@
+package filter
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "~", "!"}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			text, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d, err: %v", i, err)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text, pos: i})
+			i = j + 1
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || unicode.IsLetter(rune(s[j]))) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: s[i:j], pos: i})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: s[i:j], pos: i})
+			i = j
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(s[i:], op) {
+					tokens = append(tokens, token{kind: tokenOp, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at position %d", c, i)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(s)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isKeyword(keyword, op string) bool {
+	t := p.peek()
+	return (t.kind == tokenIdent && t.text == keyword) || (t.kind == tokenOp && t.text == op)
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or", "||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orExpr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and", "&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andExpr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isKeyword("not", "!") {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{expr: expr}, nil
+	}
+	if p.peek().kind == tokenLParen {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokenRParen {
+			return nil, fmt.Errorf("expect ) but got %s at position %d", t, t.pos)
+		}
+		return expr, nil
+	}
+	return p.parsePredicate()
+}
+
+func (p *parser) parsePredicate() (node, error) {
+	t := p.next()
+	if t.kind != tokenIdent {
+		return nil, fmt.Errorf("expect a field but got %s at position %d", t, t.pos)
+	}
+	switch t.text {
+	case "has_ttl", "gzipped", "chunk_manifest":
+		return &boolExpr{field: t.text}, nil
+	case "mime", "name":
+		e := &stringExpr{field: t.text}
+		return e, p.parseStringComparison(e)
+	case "header":
+		if l := p.next(); l.kind != tokenLParen {
+			return nil, fmt.Errorf("expect ( after header at position %d", l.pos)
+		}
+		key := p.next()
+		if key.kind != tokenString {
+			return nil, fmt.Errorf("expect a header name but got %s at position %d", key, key.pos)
+		}
+		if r := p.next(); r.kind != tokenRParen {
+			return nil, fmt.Errorf("expect ) but got %s at position %d", r, r.pos)
+		}
+		e := &stringExpr{field: t.text, header: key.text}
+		// 单独的header("key")表示存在该header
+		if next := p.peek(); next.kind != tokenOp || (next.text != "~" && next.text != "==" && next.text != "!=") {
+			return e, nil
+		}
+		return e, p.parseStringComparison(e)
+	case "size", "age", "append_age":
+		op := p.next()
+		if op.kind != tokenOp || !isNumberOp(op.text) {
+			return nil, fmt.Errorf("expect a comparison after %s but got %s at position %d", t.text, op, op.pos)
+		}
+		v := p.next()
+		if v.kind != tokenNumber {
+			return nil, fmt.Errorf("expect a number after %s but got %s at position %d", t.text, v, v.pos)
+		}
+		var value int64
+		var err error
+		if t.text == "size" {
+			value, err = parseSize(v.text)
+		} else {
+			value, err = parseSeconds(v.text)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %s at position %d, err: %v", t.text, v.text, v.pos, err)
+		}
+		return &numberExpr{field: t.text, op: op.text, value: value, text: v.text}, nil
+	}
+	return nil, fmt.Errorf("unknown field %s at position %d", t.text, t.pos)
+}
+
+func (p *parser) parseStringComparison(e *stringExpr) error {
+	op := p.next()
+	if op.kind != tokenOp || (op.text != "~" && op.text != "==" && op.text != "!=") {
+		return fmt.Errorf("expect ~, == or != after %s but got %s at position %d", e.field, op, op.pos)
+	}
+	v := p.next()
+	if v.kind != tokenString {
+		return fmt.Errorf("expect a quoted string after %s but got %s at position %d", e.field, v, v.pos)
+	}
+	if op.text == "~" {
+		// 匹配时会忽略错误, 非法的glob在解析时拒绝
+		if _, err := path.Match(v.text, ""); err != nil {
+			return fmt.Errorf("invalid glob %s at position %d, err: %v", v, v.pos, err)
+		}
+	}
+	e.op, e.value = op.text, v.text
+	return nil
+}
+
+func isNumberOp(op string) bool {
+	switch op {
+	case "<", "<=", ">", ">=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+func splitUnit(s string) (int64, string, error) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, strings.ToLower(s[i:]), nil
+}
+
+func parseSize(s string) (int64, error) {
+	n, unit, err := splitUnit(s)
+	if err != nil {
+		return 0, err
+	}
+	switch unit {
+	case "", "b":
+		return n, nil
+	case "k", "kb":
+		return n << 10, nil
+	case "m", "mb":
+		return n << 20, nil
+	case "g", "gb":
+		return n << 30, nil
+	}
+	return 0, fmt.Errorf("unknown size unit %s", unit)
+}
+
+func parseSeconds(s string) (int64, error) {
+	n, unit, err := splitUnit(s)
+	if err != nil {
+		return 0, err
+	}
+	switch unit {
+	case "", "s":
+		return n, nil
+	case "m":
+		return n * 60, nil
+	case "h":
+		return n * 3600, nil
+	case "d":
+		return n * 86400, nil
+	}
+	return 0, fmt.Errorf("unknown duration unit %s", unit)
+}
@@ -0,0 +1,136 @@
+package location
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chrislusf/seaweedfs/weed/stats"
+	"github.com/chrislusf/seaweedfs/weed/storage"
+	"github.com/sirupsen/logrus"
+
+	myutils "github.com/amazingchow/seaweedfs-tools/pkg/utils"
+)
+
+var (
+	ErrNoDiskLocation = errors.New("no backup directory provided")
+	ErrNoFreeSpace    = errors.New("no backup directory has enough free space")
+)
+
+// 备份目标目录, 类似于volume server的多个-dir参数
+type DiskLocations struct {
+	Dirs []string
+}
+
+func NewDiskLocations(dirs string) (*DiskLocations, error) {
+	l := &DiskLocations{}
+	for _, dir := range strings.Split(dirs, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		l.Dirs = append(l.Dirs, dir)
+	}
+	if len(l.Dirs) == 0 {
+		return nil, ErrNoDiskLocation
+	}
+	return l, nil
+}
+
+// Find returns the directory which already holds the volume.
+func (l *DiskLocations) Find(collection string, vid uint32) (string, bool) {
+	for _, dir := range l.Dirs {
+		if _, err := os.Stat(storage.VolumeFileName(dir, collection, int(vid)) + ".dat"); err == nil {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// Locate returns the directory to store the volume in. An existing volume stays where it is,
+// a new one goes to the directory with the most free space. expectedSize is the size the
+// volume is going to take up on disk, an error is returned if it does not fit.
+func (l *DiskLocations) Locate(collection string, vid uint32, expectedSize uint64) (string, error) {
+	if dir, ok := l.Find(collection, vid); ok {
+		used := localVolumeSize(storage.VolumeFileName(dir, collection, int(vid)))
+		if expectedSize > used {
+			disk := stats.NewDiskStatus(dir)
+			if expectedSize-used > disk.Free {
+				logrus.Errorf("volume <%d> needs %d more bytes, but %s only has %d bytes free",
+					vid, expectedSize-used, dir, disk.Free)
+				return "", ErrNoFreeSpace
+			}
+		}
+		return dir, nil
+	}
+
+	var best string
+	var bestFree uint64
+	for _, dir := range l.Dirs {
+		disk := stats.NewDiskStatus(dir)
+		logrus.Debugf("%s has %d bytes free", dir, disk.Free)
+		if best == "" || disk.Free > bestFree {
+			best, bestFree = dir, disk.Free
+		}
+	}
+	if expectedSize > bestFree {
+		logrus.Errorf("volume <%d> needs %d bytes, but the most free directory %s only has %d bytes free",
+			vid, expectedSize, best, bestFree)
+		return "", ErrNoFreeSpace
+	}
+	return best, nil
+}
+
+func localVolumeSize(baseFileName string) uint64 {
+	var size uint64
+	for _, ext := range []string{".dat", ".idx"} {
+		if info, err := os.Stat(baseFileName + ext); err == nil {
+			size += uint64(info.Size())
+		}
+	}
+	return size
+}
+
+type LocalVolume struct {
+	Dir        string
+	Collection string
+	Vid        uint32
+}
+
+// Volumes lists all the volumes stored in the backup dirs.
+func (l *DiskLocations) Volumes() ([]LocalVolume, error) {
+	var volumes []LocalVolume
+	for _, dir := range l.Dirs {
+		datFiles, err := filepath.Glob(filepath.Join(dir, "*.dat"))
+		if err != nil {
+			return nil, err
+		}
+		for _, datFile := range datFiles {
+			collection, vid, err := myutils.ParseVolumeFileName(datFile)
+			if err != nil {
+				logrus.Warningf("skip unknown data file %s, err: %v", datFile, err)
+				continue
+			}
+			volumes = append(volumes, LocalVolume{Dir: dir, Collection: collection, Vid: vid})
+		}
+	}
+	return volumes, nil
+}
+
+func (v LocalVolume) BaseFileName() string {
+	return storage.VolumeFileName(v.Dir, v.Collection, int(v.Vid))
+}
+
+// Files returns .dat, .idx, .vif and all the other files which belong to the volume.
+func (v LocalVolume) Files() ([]string, error) {
+	return filepath.Glob(v.BaseFileName() + ".*")
+}
@@ -0,0 +1,164 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+)
+
+const (
+	hashCacheFile = "hash.cache"
+)
+
+// HashFile computes the sha256 of the first size bytes of filename.
+func HashFile(filename string, size int64) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	written, err := io.Copy(h, io.LimitReader(file, size))
+	if err != nil {
+		return "", err
+	}
+	if written != size {
+		return "", fmt.Errorf("%s is shorter than %d bytes", filename, size)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// 备份文件只会在末尾追加, 缓存上一次计算结束时sha256的内部状态, 下一次只需要计算新追加的部分.
+// 文件被删除, 重新拉取或者compact时必须调用ForgetHashes, 新文件可能复用旧文件的inode;
+// 另外缓存还记录了volume的CompactionRevision, 与当前不一致时从头计算.
+type HashCache struct {
+	filename string
+	entries  map[string]*hashCacheEntry
+	// 只保留本次用到的文件, 已经删除的volume不再缓存
+	used map[string]bool
+}
+
+type hashCacheEntry struct {
+	Ino      uint64 `json:"ino"`
+	Revision uint16 `json:"revision"`
+	Size     int64  `json:"size"`
+	State    []byte `json:"state"`
+}
+
+func LoadHashCache(dir string) (*HashCache, error) {
+	c := &HashCache{
+		filename: path.Join(dir, hashCacheFile),
+		entries:  make(map[string]*hashCacheEntry),
+		used:     make(map[string]bool),
+	}
+	data, err := ioutil.ReadFile(c.filename)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &c.entries); err != nil {
+		// 缓存损坏只影响性能
+		c.entries = make(map[string]*hashCacheEntry)
+	}
+	return c, nil
+}
+
+func (c *HashCache) Save() error {
+	for filename := range c.entries {
+		if !c.used[filename] {
+			delete(c.entries, filename)
+		}
+	}
+	return c.write()
+}
+
+func (c *HashCache) write() error {
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.filename, data, 0644)
+}
+
+// ForgetHashes drops the cached hash states of the .dat and .idx of a volume from the hash cache in dir,
+// it must be called before the files are destroyed, copied again or compacted.
+func ForgetHashes(dir, baseFileName string) error {
+	c, err := LoadHashCache(dir)
+	if err != nil {
+		return err
+	}
+	var forgotten bool
+	for _, ext := range []string{".dat", ".idx"} {
+		if _, ok := c.entries[baseFileName+ext]; ok {
+			delete(c.entries, baseFileName+ext)
+			forgotten = true
+		}
+	}
+	if !forgotten {
+		return nil
+	}
+	return c.write()
+}
+
+// HashFile is the same as the package level HashFile, but only hashes the bytes appended since the last call
+// to the same file of the same compaction revision.
+func (c *HashCache) HashFile(filename string, size int64, revision uint16) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	var ino uint64
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		ino = st.Ino
+	}
+
+	h := sha256.New()
+	var offset int64
+	if e, ok := c.entries[filename]; ok && e.Ino == ino && e.Revision == revision && e.Size <= size {
+		if err = h.(encoding.BinaryUnmarshaler).UnmarshalBinary(e.State); err == nil {
+			offset = e.Size
+		} else {
+			h.Reset()
+		}
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	written, err := io.Copy(h, io.LimitReader(file, size-offset))
+	if err != nil {
+		return "", err
+	}
+	if written != size-offset {
+		return "", fmt.Errorf("%s is shorter than %d bytes", filename, size)
+	}
+
+	if err = c.put(filename, ino, revision, size, h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *HashCache) put(filename string, ino uint64, revision uint16, size int64, h hash.Hash) error {
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	c.entries[filename] = &hashCacheEntry{Ino: ino, Revision: revision, Size: size, State: state}
+	c.used[filename] = true
+	return nil
+}
@@ -0,0 +1,210 @@
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// 每次备份生成一份manifest, 记录每个volume的.dat/.idx在已同步位置之前的sha256,
+// 并通过PrevSha256与上一份manifest串联, 最后用ed25519签名, 任何对备份文件或历史manifest的修改都可以被发现.
+const (
+	Dir = "manifests"
+
+	filePrefix = "manifest_"
+	fileSuffix = ".json"
+)
+
+var (
+	ErrBadSignature = errors.New("bad manifest signature")
+)
+
+type Manifest struct {
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	// 上一份manifest文件内容的sha256, 第一份manifest为空
+	PrevSha256 string          `json:"prev_sha256"`
+	Volumes    []*VolumeDigest `json:"volumes"`
+	// ed25519签名, 签名内容为Signature字段为空时的json序列化结果
+	Signature []byte `json:"signature,omitempty"`
+}
+
+type VolumeDigest struct {
+	Collection string     `json:"collection"`
+	VolumeId   uint32     `json:"volume_id"`
+	Dir        string     `json:"dir"`
+	Dat        FileDigest `json:"dat"`
+	Idx        FileDigest `json:"idx"`
+}
+
+type FileDigest struct {
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+func (m *Manifest) signedBytes() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+func (m *Manifest) Sign(key ed25519.PrivateKey) error {
+	data, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	m.Signature = ed25519.Sign(key, data)
+	return nil
+}
+
+func (m *Manifest) Verify(key ed25519.PublicKey) error {
+	data, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, data, m.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// FileName returns the name of the file which m is saved into, sorted by sequence.
+func (m *Manifest) FileName() string {
+	return fmt.Sprintf("%s%012d%s", filePrefix, m.Sequence, fileSuffix)
+}
+
+// Save writes m into dir through a temporary file, and returns the full path.
+func Save(dir string, m *Manifest) (string, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	filename := path.Join(dir, m.FileName())
+	if _, err = os.Stat(filename); err == nil {
+		return "", fmt.Errorf("%s already exists", filename)
+	}
+	if err = ioutil.WriteFile(filename+".tmp", data, 0444); err != nil {
+		return "", err
+	}
+	if err = os.Rename(filename+".tmp", filename); err != nil {
+		_ = os.Remove(filename + ".tmp")
+		return "", err
+	}
+	return filename, nil
+}
+
+// Load returns the manifest together with the raw file content, the latter is what the next manifest chains to.
+func Load(filename string) (*Manifest, []byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &Manifest{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, nil, err
+	}
+	return m, data, nil
+}
+
+// List returns all the manifest files inside dir in sequence order.
+func List(dir string) ([]string, error) {
+	matches, err := filepath.Glob(path.Join(dir, filePrefix+"*"+fileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// VerifyChain loads the manifests in files, which are in sequence order as returned by List,
+// and checks the signature of each one and that each one chains to the one before it.
+// It returns the loaded manifests together with every problem found, err is set only if a manifest can not be loaded.
+func VerifyChain(files []string, key ed25519.PublicKey) (manifests []*Manifest, problems []error, err error) {
+	var prevRaw []byte
+	for i, file := range files {
+		m, raw, err := Load(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load manifest %s, err: %v", file, err)
+		}
+		if err = m.Verify(key); err != nil {
+			problems = append(problems, fmt.Errorf("manifest %s: %v", file, err))
+		}
+		// 最早的manifest的PrevSha256不为空说明更早的manifest已经被删除, 由调用者决定如何处理
+		if i > 0 {
+			prev := manifests[i-1]
+			if m.Sequence != prev.Sequence+1 {
+				problems = append(problems, fmt.Errorf("manifest %s: sequence %d follows %d, some manifests are missing", file, m.Sequence, prev.Sequence))
+			}
+			if m.PrevSha256 != Sha256Hex(prevRaw) {
+				problems = append(problems, fmt.Errorf("manifest %s: the previous manifest %s has been changed", file, files[i-1]))
+			}
+		}
+		manifests = append(manifests, m)
+		prevRaw = raw
+	}
+	return manifests, problems, nil
+}
+
+func Sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadPrivateKey reads a PKCS#8 PEM ed25519 private key, e.g. generated by
+// `openssl genpkey -algorithm ed25519 -out manifest.key`.
+func LoadPrivateKey(filename string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", filename)
+	}
+	return privateKey, nil
+}
+
+// LoadPublicKey reads a PKIX PEM ed25519 public key, e.g. generated by
+// `openssl pkey -in manifest.key -pubout -out manifest.pub`.
+func LoadPublicKey(filename string) (ed25519.PublicKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", filename)
+	}
+	return publicKey, nil
+}
+
+func readPEM(filename string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", filename)
+	}
+	return block, nil
+}
@@ -0,0 +1,174 @@
+package manifest
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 在dir中生成n份串联并签名的manifest, 返回按顺序排列的文件名
+func saveChain(t *testing.T, dir string, key ed25519.PrivateKey, n int) []string {
+	t.Helper()
+	var files []string
+	var prevRaw []byte
+	for i := 1; i <= n; i++ {
+		m := &Manifest{
+			Sequence: uint64(i),
+			Time:     time.Date(2021, 6, i, 0, 0, 0, 0, time.UTC),
+			Volumes: []*VolumeDigest{{
+				Collection: "test",
+				VolumeId:   uint32(i),
+				Dir:        dir,
+				Dat:        FileDigest{Size: int64(i) * 100, Sha256: strings.Repeat("a", 64)},
+				Idx:        FileDigest{Size: int64(i) * 16, Sha256: strings.Repeat("b", 64)},
+			}},
+		}
+		if prevRaw != nil {
+			m.PrevSha256 = Sha256Hex(prevRaw)
+		}
+		if err := m.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		filename, err := Save(dir, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prevRaw, err = ioutil.ReadFile(filename); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, filename)
+	}
+	listed, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(listed, ",") != strings.Join(files, ",") {
+		t.Fatalf("List returns %v, want %v", listed, files)
+	}
+	return files
+}
+
+// 修改manifest文件中的第一个volume并保存, resign为true时用key重新签名
+func tamper(t *testing.T, filename string, key ed25519.PrivateKey, resign bool) {
+	t.Helper()
+	m, _, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Volumes[0].Dat.Size++
+	if resign {
+		if err = m.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Save生成的文件是只读的
+	if err = os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filename, data, 0444); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, otherPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		key    ed25519.PublicKey
+		modify func(t *testing.T, files []string) []string
+		// 每个problem中应该出现的内容
+		want []string
+	}{
+		{"intact", publicKey, nil, nil},
+		{"first manifests pruned", publicKey, func(t *testing.T, files []string) []string {
+			return files[1:]
+		}, nil},
+		{"wrong key", otherPublicKey, nil, []string{
+			ErrBadSignature.Error(), ErrBadSignature.Error(), ErrBadSignature.Error(),
+		}},
+		{"volume changed", publicKey, func(t *testing.T, files []string) []string {
+			tamper(t, files[1], privateKey, false)
+			return files
+		}, []string{ErrBadSignature.Error(), "has been changed"}},
+		{"volume changed and signed by another key", publicKey, func(t *testing.T, files []string) []string {
+			tamper(t, files[1], otherPrivateKey, true)
+			return files
+		}, []string{ErrBadSignature.Error(), "has been changed"}},
+		{"volume changed and signed again", publicKey, func(t *testing.T, files []string) []string {
+			// 即使持有私钥, 修改历史manifest后下一份manifest的PrevSha256也对不上
+			tamper(t, files[0], privateKey, true)
+			return files
+		}, []string{"has been changed"}},
+		{"manifest removed", publicKey, func(t *testing.T, files []string) []string {
+			if err := os.Remove(files[1]); err != nil {
+				t.Fatal(err)
+			}
+			return []string{files[0], files[2]}
+		}, []string{"some manifests are missing", "has been changed"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "manifest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			files := saveChain(t, dir, privateKey, 3)
+			if c.modify != nil {
+				files = c.modify(t, files)
+			}
+			manifests, problems, err := VerifyChain(files, c.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(manifests) != len(files) {
+				t.Errorf("%d manifests are loaded, want %d", len(manifests), len(files))
+			}
+			if len(problems) != len(c.want) {
+				t.Fatalf("problems are %v, want %d problems", problems, len(c.want))
+			}
+			for i, problem := range problems {
+				if !strings.Contains(problem.Error(), c.want[i]) {
+					t.Errorf("problem %d is %v, want %q", i, problem, c.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyChainRejectsUnreadableManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := saveChain(t, dir, privateKey, 2)
+	if err = os.Remove(files[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(files[1], []byte("{"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = VerifyChain(files, publicKey); err == nil {
+		t.Errorf("a truncated manifest is loaded")
+	}
+}
@@ -0,0 +1,160 @@
+package mastermeta
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/pb/master_pb"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+)
+
+const (
+	filePrefix = "master_meta_"
+	fileSuffix = ".json"
+)
+
+// 重建集群时需要的master元数据, 由backup保存, 由seeder读取后用于初始化备用master
+type MasterMeta struct {
+	Time                   time.Time `json:"time"`
+	Master                 string    `json:"master"`
+	MetricsAddress         string    `json:"metrics_address"`
+	MetricsIntervalSeconds uint32    `json:"metrics_interval_seconds"`
+	VolumeSizeLimitMB      uint64    `json:"volume_size_limit_mb"`
+	Collections            []string  `json:"collections"`
+	// 拓扑中出现过的最大volume id, 已经被删除的volume不会出现在拓扑中
+	MaxVolumeId uint32 `json:"max_volume_id"`
+	// 通过向master申请一个fid得到的当前file key, 为0表示申请失败
+	MaxFileKey uint64 `json:"max_file_key"`
+	// key = collection, value = 该collection下出现过的副本策略
+	ReplicaPlacements map[string][]string `json:"replica_placements"`
+	Volumes           []*VolumeMeta       `json:"volumes"`
+	Topology          json.RawMessage     `json:"topology"`
+}
+
+type VolumeMeta struct {
+	Id               uint32   `json:"id"`
+	Collection       string   `json:"collection"`
+	ReplicaPlacement string   `json:"replica_placement,omitempty"`
+	Ttl              string   `json:"ttl,omitempty"`
+	Size             uint64   `json:"size,omitempty"`
+	ReadOnly         bool     `json:"read_only,omitempty"`
+	EcShard          bool     `json:"ec_shard,omitempty"`
+	Servers          []string `json:"servers"`
+}
+
+// CollectVolumes fills the volume related fields of meta from the topology.
+func (meta *MasterMeta) CollectVolumes(topo *master_pb.TopologyInfo) {
+	if meta.ReplicaPlacements == nil {
+		meta.ReplicaPlacements = make(map[string][]string)
+	}
+	volumes := make(map[uint32]*VolumeMeta)
+	add := func(vm *VolumeMeta, server string) {
+		if v, ok := volumes[vm.Id]; ok {
+			v.Servers = append(v.Servers, server)
+			return
+		}
+		vm.Servers = []string{server}
+		volumes[vm.Id] = vm
+		meta.Volumes = append(meta.Volumes, vm)
+		if vm.Id > meta.MaxVolumeId {
+			meta.MaxVolumeId = vm.Id
+		}
+	}
+	for _, dc := range topo.DataCenterInfos {
+		for _, rack := range dc.RackInfos {
+			for _, dn := range rack.DataNodeInfos {
+				for _, vi := range dn.VolumeInfos {
+					vm := &VolumeMeta{
+						Id:         vi.Id,
+						Collection: vi.Collection,
+						Ttl:        needle.LoadTTLFromUint32(vi.Ttl).String(),
+						Size:       vi.Size,
+						ReadOnly:   vi.ReadOnly,
+					}
+					if rp, err := super_block.NewReplicaPlacementFromByte(byte(vi.ReplicaPlacement)); err == nil {
+						vm.ReplicaPlacement = rp.String()
+					}
+					add(vm, dn.Id)
+				}
+				for _, ec := range dn.EcShardInfos {
+					add(&VolumeMeta{Id: ec.Id, Collection: ec.Collection, EcShard: true}, dn.Id)
+				}
+			}
+		}
+	}
+	sort.Slice(meta.Volumes, func(i, j int) bool {
+		return meta.Volumes[i].Id < meta.Volumes[j].Id
+	})
+
+	for _, vm := range meta.Volumes {
+		if vm.EcShard {
+			continue
+		}
+		placements := meta.ReplicaPlacements[vm.Collection]
+		found := false
+		for _, p := range placements {
+			if p == vm.ReplicaPlacement {
+				found = true
+				break
+			}
+		}
+		if !found {
+			meta.ReplicaPlacements[vm.Collection] = append(placements, vm.ReplicaPlacement)
+		}
+	}
+}
+
+// FileName returns the name of the file which meta is saved into.
+func (meta *MasterMeta) FileName() string {
+	return fmt.Sprintf("%s%d%s", filePrefix, meta.Time.Unix(), fileSuffix)
+}
+
+// Save writes meta into dir through a temporary file, and returns the full path.
+func Save(dir string, meta *MasterMeta) (string, error) {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	filename := path.Join(dir, meta.FileName())
+	if err = ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return "", err
+	}
+	if err = os.Rename(filename+".tmp", filename); err != nil {
+		_ = os.Remove(filename + ".tmp")
+		return "", err
+	}
+	return filename, nil
+}
+
+func Load(filename string) (*MasterMeta, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	meta := &MasterMeta{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Latest returns the path of the newest master meta file inside dir.
+func Latest(dir string) (string, error) {
+	matches, err := filepath.Glob(path.Join(dir, filePrefix+"*"+fileSuffix))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no master meta file found in %s", dir)
+	}
+	// 文件名中的时间戳位数相同, 按字符串排序即可
+	sort.Strings(matches)
+	return matches[len(matches)-1], nil
+}
@@ -0,0 +1,198 @@
+package needlemap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+	"github.com/chrislusf/seaweedfs/weed/util"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// 攒够这么多次写入后再写入leveldb
+const diskBatchSize = 4096
+
+// 磁盘上的map, 使用一个临时的leveldb, Close时删除
+type diskMap struct {
+	dir   string
+	db    *leveldb.DB
+	batch *leveldb.Batch
+	// batch中还没有写入leveldb的key, 值为nil表示删除
+	pending map[types.NeedleId]*needle_map.NeedleValue
+}
+
+func openLevelDb(dir string) (*leveldb.DB, error) {
+	return leveldb.OpenFile(dir, &opt.Options{
+		BlockCacheCapacity:     8 * opt.MiB,
+		WriteBuffer:            8 * opt.MiB,
+		OpenFilesCacheCapacity: 64,
+		NoSync:                 true,
+		ErrorIfExist:           true,
+	})
+}
+
+func newDiskMap(tmpDir string) (*diskMap, error) {
+	dir, err := ioutil.TempDir(tmpDir, "needlemap-")
+	if err != nil {
+		return nil, err
+	}
+	db, err := openLevelDb(filepath.Join(dir, "keys"))
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to open leveldb in %s, err: %v", dir, err)
+	}
+	return &diskMap{
+		dir:     dir,
+		db:      db,
+		batch:   new(leveldb.Batch),
+		pending: make(map[types.NeedleId]*needle_map.NeedleValue),
+	}, nil
+}
+
+func (m *diskMap) flush() error {
+	if m.batch.Len() == 0 {
+		return nil
+	}
+	err := m.db.Write(m.batch, nil)
+	m.batch.Reset()
+	m.pending = make(map[types.NeedleId]*needle_map.NeedleValue)
+	return err
+}
+
+func (m *diskMap) Set(key types.NeedleId, offset types.Offset, size uint32) error {
+	bytes := needle_map.ToBytes(key, offset, size)
+	m.batch.Put(bytes[:types.NeedleIdSize], bytes[types.NeedleIdSize:])
+	m.pending[key] = &needle_map.NeedleValue{Key: key, Offset: offset, Size: size}
+	if m.batch.Len() >= diskBatchSize {
+		return m.flush()
+	}
+	return nil
+}
+
+func (m *diskMap) Delete(key types.NeedleId) error {
+	bytes := make([]byte, types.NeedleIdSize)
+	types.NeedleIdToBytes(bytes, key)
+	m.batch.Delete(bytes)
+	m.pending[key] = nil
+	if m.batch.Len() >= diskBatchSize {
+		return m.flush()
+	}
+	return nil
+}
+
+func (m *diskMap) Get(key types.NeedleId) (*needle_map.NeedleValue, bool) {
+	// 先查找还没有写入leveldb的key, 避免每次查找都写入batch
+	if nv, ok := m.pending[key]; ok {
+		if nv == nil {
+			return nil, false
+		}
+		value := *nv
+		return &value, true
+	}
+	bytes := make([]byte, types.NeedleIdSize)
+	types.NeedleIdToBytes(bytes, key)
+	data, err := m.db.Get(bytes, nil)
+	if err != nil || len(data) != types.OffsetSize+types.SizeSize {
+		return nil, false
+	}
+	return &needle_map.NeedleValue{
+		Key:    key,
+		Offset: types.BytesToOffset(data[:types.OffsetSize]),
+		Size:   util.BytesToUint32(data[types.OffsetSize:]),
+	}, true
+}
+
+func (m *diskMap) AscendingVisit(visit func(needle_map.NeedleValue) error) error {
+	if err := m.flush(); err != nil {
+		return err
+	}
+	iter := m.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		data := iter.Value()
+		nv := needle_map.NeedleValue{
+			Key:    types.BytesToNeedleId(iter.Key()),
+			Offset: types.BytesToOffset(data[:types.OffsetSize]),
+			Size:   util.BytesToUint32(data[types.OffsetSize:]),
+		}
+		if err := visit(nv); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// OffsetVisit sorts the live needles by offset in another temporary leveldb.
+func (m *diskMap) OffsetVisit(visit func(needle_map.NeedleValue) error) error {
+	dir := filepath.Join(m.dir, "offsets")
+	db, err := openLevelDb(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open leveldb in %s, err: %v", dir, err)
+	}
+	defer func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}()
+
+	batch := new(leveldb.Batch)
+	err = m.AscendingVisit(func(nv needle_map.NeedleValue) error {
+		if !isLive(nv) {
+			return nil
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(nv.Offset.ToAcutalOffset()))
+		batch.Put(key, nv.ToBytes())
+		if batch.Len() >= diskBatchSize {
+			err := db.Write(batch, nil)
+			batch.Reset()
+			return err
+		}
+		return nil
+	})
+	if err == nil {
+		err = db.Write(batch, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		data := iter.Value()
+		nv := needle_map.NeedleValue{
+			Key:    types.BytesToNeedleId(data[:types.NeedleIdSize]),
+			Offset: types.BytesToOffset(data[types.NeedleIdSize : types.NeedleIdSize+types.OffsetSize]),
+			Size:   util.BytesToUint32(data[types.NeedleIdSize+types.OffsetSize:]),
+		}
+		if err = visit(nv); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+func (m *diskMap) SaveToIdx(idxName string) error {
+	idxFile, err := os.OpenFile(idxName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer idxFile.Close()
+	return m.AscendingVisit(func(nv needle_map.NeedleValue) error {
+		if !isLive(nv) {
+			return nil
+		}
+		_, err := idxFile.Write(nv.ToBytes())
+		return err
+	})
+}
+
+func (m *diskMap) Close() {
+	_ = m.db.Close()
+	_ = os.RemoveAll(m.dir)
+}
@@ -0,0 +1,63 @@
+package needlemap
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+)
+
+func TestDiskMapGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "needlemap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m, err := newDiskMap(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// 超过一个batch, 一部分key已经写入leveldb, 一部分还在batch中
+	const keys = diskBatchSize + diskBatchSize/2
+	for i := 1; i <= keys; i++ {
+		if err = m.Set(types.NeedleId(i), types.ToOffset(int64(i*8)), uint32(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 删除写入leveldb的和还在batch中的key, 并覆盖一个key
+	for _, key := range []types.NeedleId{1, keys} {
+		if err = m.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = m.Set(2, types.ToOffset(800), 100); err != nil {
+		t.Fatal(err)
+	}
+	pending := m.batch.Len()
+
+	for i := 1; i <= keys; i++ {
+		key := types.NeedleId(i)
+		nv, ok := m.Get(key)
+		switch {
+		case key == 1 || key == keys:
+			if ok {
+				t.Errorf("deleted key %v is found", key)
+			}
+		case key == 2:
+			if !ok || nv.Offset.ToAcutalOffset() != 800 || nv.Size != 100 {
+				t.Errorf("key %v is %+v, want the overwritten value", key, nv)
+			}
+		case !ok || nv.Key != key || nv.Offset.ToAcutalOffset() != int64(i*8) || nv.Size != uint32(i):
+			t.Errorf("key %v is %+v, found %v", key, nv, ok)
+		}
+	}
+	if m.batch.Len() != pending {
+		t.Errorf("Get flushes the batch")
+	}
+	if _, ok := m.Get(types.NeedleId(keys + 1)); ok {
+		t.Errorf("missing key is found")
+	}
+}
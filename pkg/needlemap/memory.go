@@ -0,0 +1,34 @@
+package needlemap
+
+import (
+	"sort"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
+)
+
+// 内存中的map
+type memoryMap struct {
+	*needle_map.MemDb
+}
+
+func (m *memoryMap) OffsetVisit(visit func(needle_map.NeedleValue) error) error {
+	var live []needle_map.NeedleValue
+	err := m.AscendingVisit(func(nv needle_map.NeedleValue) error {
+		if isLive(nv) {
+			live = append(live, nv)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].Offset.ToAcutalOffset() < live[j].Offset.ToAcutalOffset()
+	})
+	for _, nv := range live {
+		if err = visit(nv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
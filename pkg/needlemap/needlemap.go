@@ -0,0 +1,75 @@
+package needlemap
+
+import (
+	"os"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/idx"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+	"github.com/sirupsen/logrus"
+)
+
+// 估算的每个entry占用的内存, 包括leveldb memdb的开销和按offset排序时的NeedleValue
+const memoryPerEntry = 64
+
+// NeedleMap保存needle id到offset和size的映射, 与needle_map.MemDb的用法相同,
+// 但是可以放在磁盘上, 内存占用不随needle数量增长.
+type NeedleMap interface {
+	Get(key types.NeedleId) (*needle_map.NeedleValue, bool)
+	Set(key types.NeedleId, offset types.Offset, size uint32) error
+	Delete(key types.NeedleId) error
+	// 按照needle id从小到大访问
+	AscendingVisit(visit func(needle_map.NeedleValue) error) error
+	// 按照offset从小到大访问live needle, 跳过删除记录
+	OffsetVisit(visit func(needle_map.NeedleValue) error) error
+	SaveToIdx(idxName string) error
+	Close()
+}
+
+// InMemory reports whether entries fit in memoryBudget bytes, memoryBudget <= 0 means no limit.
+func InMemory(entries int64, memoryBudget int64) bool {
+	return memoryBudget <= 0 || entries*memoryPerEntry <= memoryBudget
+}
+
+// New creates an empty map expected to hold about entries needles,
+// it is kept in memory if it fits in memoryBudget bytes, otherwise in a LevelDB under tmpDir.
+func New(entries int64, memoryBudget int64, tmpDir string) (NeedleMap, error) {
+	if InMemory(entries, memoryBudget) {
+		return &memoryMap{MemDb: needle_map.NewMemDb()}, nil
+	}
+	logrus.Debugf("%d needles exceed the memory budget of %d bytes, keep them on disk", entries, memoryBudget)
+	return newDiskMap(tmpDir)
+}
+
+// Load loads the .idx into a new map, see New.
+func Load(idxName string, memoryBudget int64, tmpDir string) (NeedleMap, error) {
+	idxFile, err := os.Open(idxName)
+	if err != nil {
+		return nil, err
+	}
+	defer idxFile.Close()
+	info, err := idxFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	nm, err := New(info.Size()/types.NeedleMapEntrySize, memoryBudget, tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	err = idx.WalkIndexFile(idxFile, func(key types.NeedleId, offset types.Offset, size uint32) error {
+		if offset.IsZero() || size == types.TombstoneFileSize {
+			return nm.Delete(key)
+		}
+		return nm.Set(key, offset, size)
+	})
+	if err != nil {
+		nm.Close()
+		return nil, err
+	}
+	return nm, nil
+}
+
+func isLive(nv needle_map.NeedleValue) bool {
+	return nv.Size > 0 && nv.Size != types.TombstoneFileSize && !nv.Offset.IsZero()
+}
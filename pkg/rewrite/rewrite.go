@@ -0,0 +1,418 @@
+package rewrite
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/storage"
+	"github.com/chrislusf/seaweedfs/weed/storage/backend"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/needlemap"
+)
+
+var (
+	ErrCreateDataFile           = errors.New("can not create new data file")
+	ErrCreateNeedle             = errors.New("can not create new needle")
+	ErrPrepareNeedleWriteBuffer = errors.New("can not prepare needle's write buffer")
+	ErrReadNeedleBytes          = errors.New("can not read needle bytes")
+	ErrWriteNeedleBytes         = errors.New("can not write needle bytes")
+	ErrSetNeedleMap             = errors.New("can not set k/v for needle map")
+)
+
+// Stage是rewrite pipeline中的一步, Drop和Transform可以只设置其中一个.
+// 每个live needle依次经过所有的Stage, 任何一个Stage丢弃该needle后不再执行后面的Stage.
+type Stage struct {
+	// 用于日志
+	Name string
+	// 返回true时丢弃该needle, 参数是源needle
+	Drop func(src *needle.Needle) bool
+	// 修改将要写入的needle, dst是src的拷贝, 可以直接修改
+	Transform func(src, dst *needle.Needle) error
+}
+
+// Dropped reports whether any stage drops the needle.
+func Dropped(stages []Stage, src *needle.Needle) bool {
+	for _, stage := range stages {
+		if stage.Drop != nil && stage.Drop(src) {
+			logrus.Debugf("skip needle <id: %d>, as it's dropped by stage %s", src.Id, stage.Name)
+			return true
+		}
+	}
+	return false
+}
+
+// Apply copies src and runs the stages on the copy, it returns nil if any stage drops the needle.
+func Apply(stages []Stage, src *needle.Needle) (*needle.Needle, error) {
+	if Dropped(stages, src) {
+		return nil, nil
+	}
+	dst := CopyNeedle(src)
+	for _, stage := range stages {
+		if stage.Transform == nil {
+			continue
+		}
+		if err := stage.Transform(src, dst); err != nil {
+			return nil, fmt.Errorf("stage %s failed on needle <%d>, err: %v", stage.Name, src.Id, err)
+		}
+	}
+	// Transform可能修改了Data和LastModified
+	dst.DataSize = uint32(len(dst.Data))
+	copyTtl(src, dst)
+	dst.Checksum = needle.NewCRC(dst.Data)
+	return dst, nil
+}
+
+// CopyNeedle creates a new needle with the same id, cookie, data and metadata as src.
+func CopyNeedle(src *needle.Needle) *needle.Needle {
+	dst := new(needle.Needle)
+	// set Cookie + Id
+	dst.Cookie = src.Cookie
+	dst.Id = src.Id
+	// set Data + DataSize
+	dst.Data = make([]byte, src.DataSize)
+	copy(dst.Data, src.Data)
+	dst.DataSize = src.DataSize
+	// set Name + NameSize
+	dst.Name = make([]byte, src.NameSize)
+	copy(dst.Name, src.Name)
+	dst.NameSize = src.NameSize
+	dst.SetHasName()
+	// set Mime + MimeSize
+	dst.Mime = make([]byte, src.MimeSize)
+	copy(dst.Mime, src.Mime)
+	dst.MimeSize = src.MimeSize
+	dst.SetHasMime()
+	// set Pairs + PairsSize
+	dst.Pairs = make([]byte, src.PairsSize)
+	copy(dst.Pairs, src.Pairs)
+	dst.PairsSize = src.PairsSize
+	dst.SetHasPairs()
+	// set LastModified
+	dst.LastModified = src.LastModified
+	if dst.LastModified == 0 {
+		// 与ExpiresAt一致使用AppendAtNs, 否则已经过期的needle会在重写后复活
+		if src.AppendAtNs > 0 {
+			dst.LastModified = src.AppendAtNs / uint64(time.Second)
+		} else {
+			dst.LastModified = uint64(time.Now().Unix())
+		}
+	}
+	dst.SetHasLastModifiedDate()
+	// set Ttl
+	copyTtl(src, dst)
+	// set Checksum
+	dst.Checksum = needle.NewCRC(dst.Data)
+
+	if src.IsGzipped() {
+		dst.SetGzipped()
+	}
+
+	if src.IsChunkedManifest() {
+		dst.SetIsChunkManifest()
+	}
+	return dst
+}
+
+// AppendClock assigns AppendAtNs to the needles written into one .dat.
+// 默认保留needle原来的AppendAtNs, 增量备份等工具依赖AppendAtNs的顺序;
+// 为了保证.dat中的AppendAtNs单调递增, 比前一个needle小的AppendAtNs会被调整为前一个needle的AppendAtNs+1.
+type AppendClock struct {
+	// 使用重写时的时间作为AppendAtNs
+	Restamp bool
+
+	last uint64
+}
+
+// Stamp sets the AppendAtNs of dst, which is the copy of src.
+func (c *AppendClock) Stamp(src, dst *needle.Needle) {
+	appendAtNs := src.AppendAtNs
+	if c.Restamp {
+		appendAtNs = uint64(time.Now().UnixNano())
+	}
+	if appendAtNs <= c.last {
+		logrus.Debugf("needle <%d> has AppendAtNs %d, not after the previous one %d", src.Id, appendAtNs, c.last)
+		appendAtNs = c.last + 1
+	}
+	dst.AppendAtNs = appendAtNs
+	c.last = appendAtNs
+}
+
+// Rewriter rewrites the live needles of a volume through the stages into a new volume with the same name.
+// 只生成.idx文件和.dat文件, 可以复用原先的.vif文件.
+type Rewriter struct {
+	Stages []Stage
+	// 使用重写时的时间作为AppendAtNs, 默认保留原来的AppendAtNs
+	Restamp bool
+	// 直接拷贝needle在.dat中的字节, 不重新序列化needle, 只重建索引.
+	// 此时Stage只能丢弃needle, 不能修改needle, 并且不能与Restamp同时使用
+	Raw bool
+	// 读取源volume的方式, 默认根据垃圾比例自动选择
+	Scan ScanMode
+	// needle map可以使用的内存, 超出时放到dstDir下的临时leveldb中, 0表示不限制
+	MemoryBudget int64
+}
+
+// Rewrite writes the new .dat and .idx of v into dstDir and returns the number of needles written.
+// The partial files are removed on failure.
+func (r *Rewriter) Rewrite(v location.LocalVolume, dstDir string) (int64, error) {
+	if r.Raw {
+		if r.Restamp {
+			return 0, errors.New("can not restamp needles when copying raw needles")
+		}
+		for _, stage := range r.Stages {
+			if stage.Transform != nil {
+				return 0, fmt.Errorf("can not apply stage %s when copying raw needles", stage.Name)
+			}
+		}
+	}
+
+	srcBase := v.BaseFileName()
+	dstBase := storage.VolumeFileName(dstDir, v.Collection, int(v.Vid))
+
+	// needle map缓存needle索引信息, key = []byte(NeedleId), value = []byte(Offset + Size)
+	srcNM, err := needlemap.Load(srcBase+".idx", r.MemoryBudget, dstDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load needle map from %s, err: %v", srcBase+".idx", err)
+	}
+	defer srcNM.Close()
+	// 目标volume的needle不会比源volume的.idx中的entry多
+	idxInfo, err := os.Stat(srcBase + ".idx")
+	if err != nil {
+		return 0, err
+	}
+	dstNM, err := needlemap.New(idxInfo.Size()/types.NeedleMapEntrySize, r.MemoryBudget, dstDir)
+	if err != nil {
+		return 0, err
+	}
+	defer dstNM.Close()
+
+	logrus.Infof("ready to parse %s", srcBase+".dat")
+
+	scanner := &volumeScanner{
+		stages:       r.Stages,
+		srcNeedleMap: srcNM,
+		dstNeedleMap: dstNM,
+		dstDataFile:  dstBase + ".dat",
+		clock:        &AppendClock{Restamp: r.Restamp},
+	}
+	if r.Raw {
+		// 直接从.dat读取needle的字节, 不需要seaweedfs解析needle body
+		srcDataFile, err := os.Open(srcBase + ".dat")
+		if err != nil {
+			return 0, err
+		}
+		defer srcDataFile.Close()
+		scanner.srcDataFile = srcDataFile
+	}
+	err = ScanVolume(v, srcNM, r.Scan, scanner)
+	if err != nil {
+		if scanner.exitErr != ErrCreateDataFile {
+			scanner.close()
+			_ = os.Remove(dstBase + ".dat")
+		}
+		return 0, fmt.Errorf("failed to scan %s, err: %v", srcBase+".dat", err)
+	}
+	if err = scanner.updateSuperBlockTtl(time.Now()); err != nil {
+		scanner.close()
+		_ = os.Remove(dstBase + ".dat")
+		return 0, fmt.Errorf("failed to update the super block of %s, err: %v", dstBase+".dat", err)
+	}
+	scanner.close()
+
+	// 生成新的.idx文件
+	if err = dstNM.SaveToIdx(dstBase + ".idx"); err != nil {
+		_ = os.Remove(dstBase + ".idx")
+		_ = os.Remove(dstBase + ".dat")
+		return 0, fmt.Errorf("failed to save needle map to %s, err: %v", dstBase+".idx", err)
+	}
+
+	logrus.Infof("finish to parse %s", srcBase+".dat")
+	return scanner.counter, nil
+}
+
+// 实现seaweedfs的VolumeFileScanner接口
+type volumeScanner struct {
+	superBlock     super_block.SuperBlock
+	version        needle.Version
+	counter        int64
+	dstDataBackend *backend.DiskFile
+	// 下一个needle的写入位置
+	writeOffset int64
+
+	stages       []Stage
+	srcNeedleMap needlemap.NeedleMap
+	dstNeedleMap needlemap.NeedleMap
+	dstDataFile  string
+	clock        *AppendClock
+	// 不为nil时直接拷贝needle的字节
+	srcDataFile *os.File
+	buf         []byte
+	// 写入的needle中最晚的过期时间, 有needle不会过期或者已经过期时为-1
+	latestExpiry int64
+
+	exitErr error
+}
+
+func (scanner *volumeScanner) VisitSuperBlock(superBlock super_block.SuperBlock) error {
+	scanner.superBlock = superBlock
+	scanner.version = superBlock.Version
+
+	logrus.Debugf("create new data file %s", scanner.dstDataFile)
+	file, err := os.OpenFile(scanner.dstDataFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		logrus.Errorf("failed to create new data file %s, err: %v", scanner.dstDataFile, err)
+		scanner.exitErr = ErrCreateDataFile
+		return ErrCreateDataFile
+	}
+	scanner.dstDataBackend = backend.NewDiskFile(file)
+	// SuperBlock.Ttl在扫描结束后由updateSuperBlockTtl更新
+	header := superBlock.Bytes()
+	_, err = scanner.dstDataBackend.WriteAt(header, 0)
+	if err != nil {
+		logrus.Errorf("failed to write needle bytes for super block, err: %v", err)
+		scanner.exitErr = ErrWriteNeedleBytes
+		return ErrWriteNeedleBytes
+	}
+	scanner.writeOffset = int64(len(header))
+	return nil
+}
+
+func (scanner *volumeScanner) ReadNeedleBody() bool {
+	return scanner.srcDataFile == nil
+}
+
+func (scanner *volumeScanner) VisitNeedle(srcNeedle *needle.Needle, offset int64, _, _ []byte) error {
+	nv, ok := scanner.srcNeedleMap.Get(srcNeedle.Id)
+	if !ok {
+		logrus.Warningf("this needle <%d> seems to be deleted already", srcNeedle.Id)
+		return nil
+	}
+	if nv.Size == 0 || nv.Size == types.TombstoneFileSize || nv.Offset.ToAcutalOffset() != offset {
+		return nil
+	}
+	if scanner.srcDataFile != nil {
+		return scanner.copyRaw(srcNeedle, offset)
+	}
+
+	// 1. write the needle to destination .dat file
+	// 1.1 create a new needle from the old one through the stages
+	dstNeedle, err := Apply(scanner.stages, srcNeedle)
+	if err != nil {
+		logrus.Errorf("failed to create new needle, err: %v", err)
+		scanner.exitErr = ErrCreateNeedle
+		return ErrCreateNeedle
+	}
+	if dstNeedle == nil {
+		return nil
+	}
+
+	logrus.Debugf("process needle <id: %d | offset: %d | size: %d | disk_size: %d>",
+		srcNeedle.Id, offset, srcNeedle.Size, srcNeedle.DiskSize(scanner.version))
+
+	scanner.counter++
+	if expiresAt, ok := ExpiresAt(dstNeedle); !ok || expiresAt <= time.Now().Unix() {
+		scanner.latestExpiry = -1
+	} else if scanner.latestExpiry >= 0 && expiresAt > scanner.latestExpiry {
+		scanner.latestExpiry = expiresAt
+	}
+
+	scanner.clock.Stamp(srcNeedle, dstNeedle)
+	// 1.2 fill in the bytes array with the new needle
+	bytesToWrite, _, _, err := dstNeedle.PrepareWriteBuffer(scanner.version)
+	if err != nil {
+		logrus.Errorf("failed to prepare write buffer, err: %v", err)
+		scanner.exitErr = ErrPrepareNeedleWriteBuffer
+		return ErrPrepareNeedleWriteBuffer
+	}
+	// 1.3 write the bytes array into backend
+	// 2. write the needle index info to .idx file
+	return scanner.write(dstNeedle.Id, dstNeedle.Size, bytesToWrite)
+}
+
+// copyRaw writes the on-disk bytes of the needle as they are,
+// the needle body is parsed only to verify the CRC and to decide whether to drop the needle.
+func (scanner *volumeScanner) copyRaw(srcNeedle *needle.Needle, offset int64) error {
+	diskSize := needle.GetActualSize(srcNeedle.Size, scanner.version)
+	if int64(cap(scanner.buf)) < diskSize {
+		scanner.buf = make([]byte, diskSize)
+	}
+	bytesToWrite := scanner.buf[:diskSize]
+	if _, err := scanner.srcDataFile.ReadAt(bytesToWrite, offset); err != nil {
+		logrus.Errorf("failed to read needle <%d> at offset %d, err: %v", srcNeedle.Id, offset, err)
+		scanner.exitErr = ErrReadNeedleBytes
+		return ErrReadNeedleBytes
+	}
+	// 不重新序列化needle, 但仍然检查CRC, 不拷贝损坏的needle
+	body := bytesToWrite[types.NeedleHeaderSize:]
+	if err := srcNeedle.ReadNeedleBodyBytes(body, scanner.version); err != nil {
+		logrus.Errorf("failed to parse needle <%d> at offset %d, err: %v", srcNeedle.Id, offset, err)
+		scanner.exitErr = ErrReadNeedleBytes
+		return ErrReadNeedleBytes
+	}
+	if err := VerifyChecksum(srcNeedle, body); err != nil {
+		logrus.Errorf("corrupted needle at offset %d, err: %v", offset, err)
+		scanner.exitErr = ErrReadNeedleBytes
+		return ErrReadNeedleBytes
+	}
+	if Dropped(scanner.stages, srcNeedle) {
+		return nil
+	}
+
+	logrus.Debugf("copy needle <id: %d | offset: %d | size: %d | disk_size: %d>",
+		srcNeedle.Id, offset, srcNeedle.Size, diskSize)
+
+	scanner.counter++
+
+	return scanner.write(srcNeedle.Id, srcNeedle.Size, bytesToWrite)
+}
+
+func (scanner *volumeScanner) write(id types.NeedleId, size uint32, bytesToWrite []byte) error {
+	_, err := scanner.dstDataBackend.WriteAt(bytesToWrite, scanner.writeOffset)
+	if err != nil {
+		logrus.Errorf("failed to write needle bytes, err: %v", err)
+		scanner.exitErr = ErrWriteNeedleBytes
+		return ErrWriteNeedleBytes
+	}
+	err = scanner.dstNeedleMap.Set(id, types.ToOffset(scanner.writeOffset), size)
+	if err != nil {
+		logrus.Errorf("failed to set k/v for needle map, err: %v", err)
+		scanner.exitErr = ErrSetNeedleMap
+		return ErrSetNeedleMap
+	}
+	scanner.writeOffset += int64(len(bytesToWrite))
+	return nil
+}
+
+// updateSuperBlockTtl shortens SuperBlock.Ttl so that the volume expires with the last needle written.
+// 以下情况保持原来的ttl: 拷贝原始字节时不解析needle, 没有写入needle, 有needle不会过期或已经过期(-keep_expired).
+func (scanner *volumeScanner) updateSuperBlockTtl(now time.Time) error {
+	ttl := scanner.superBlock.Ttl
+	if scanner.srcDataFile != nil || scanner.counter == 0 || scanner.latestExpiry < 0 {
+		return nil
+	}
+	newTtl := volumeTtl(ttl, scanner.latestExpiry, now)
+	if newTtl == ttl {
+		return nil
+	}
+	logrus.Infof("update ttl of %s from %s to %s", scanner.dstDataFile, ttl.String(), newTtl.String())
+	superBlock := scanner.superBlock
+	superBlock.Ttl = newTtl
+	// superblock的大小不随ttl变化, 原地覆盖
+	if _, err := scanner.dstDataBackend.WriteAt(superBlock.Bytes(), 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (scanner *volumeScanner) close() {
+	if scanner.dstDataBackend != nil {
+		_ = scanner.dstDataBackend.Close()
+	}
+}
@@ -0,0 +1,240 @@
+package rewrite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/needlemap"
+)
+
+// 在dir中生成一个有needles个needle的volume, 每个needle有dataSize字节的数据,
+// 其中每10个needle有一个被覆盖写, 覆盖前的needle是垃圾
+func generateVolume(tb testing.TB, dir string, needles int, dataSize int) location.LocalVolume {
+	tb.Helper()
+	v := location.LocalVolume{Dir: dir, Collection: "test", Vid: 1}
+	sb := super_block.SuperBlock{
+		Version:          needle.Version3,
+		ReplicaPlacement: &super_block.ReplicaPlacement{},
+		Ttl:              needle.EMPTY_TTL,
+	}
+	dat := bytes.NewBuffer(sb.Bytes())
+	nm, err := needlemap.New(int64(needles), 0, dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer nm.Close()
+
+	rnd := rand.New(rand.NewSource(1))
+	now := time.Now()
+	write := func(id int) {
+		n := &needle.Needle{
+			Id:           types.NeedleId(id),
+			Cookie:       types.Cookie(rnd.Uint32()),
+			Data:         make([]byte, dataSize),
+			Name:         []byte("file.bin"),
+			Mime:         []byte("application/octet-stream"),
+			LastModified: uint64(now.Unix()),
+			AppendAtNs:   uint64(now.UnixNano()) + uint64(dat.Len()),
+		}
+		rnd.Read(n.Data)
+		n.Checksum = needle.NewCRC(n.Data)
+		n.SetHasName()
+		n.SetHasMime()
+		n.SetHasLastModifiedDate()
+		offset := dat.Len()
+		buf, _, _, err := n.PrepareWriteBuffer(sb.Version)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		dat.Write(buf)
+		if err = nm.Set(n.Id, types.ToOffset(int64(offset)), n.Size); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	for id := 1; id <= needles; id++ {
+		write(id)
+		if id%10 == 0 {
+			write(id)
+		}
+	}
+	if err = ioutil.WriteFile(v.BaseFileName()+".dat", dat.Bytes(), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	if err = nm.SaveToIdx(v.BaseFileName() + ".idx"); err != nil {
+		tb.Fatal(err)
+	}
+	return v
+}
+
+// 返回volume中所有live needle在.dat中的字节
+func needleBytes(tb testing.TB, base string) map[types.NeedleId][]byte {
+	tb.Helper()
+	data, err := ioutil.ReadFile(base + ".dat")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	nm, err := needlemap.Load(base+".idx", 0, path.Dir(base))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer nm.Close()
+	needles := make(map[types.NeedleId][]byte)
+	err = nm.AscendingVisit(func(nv needle_map.NeedleValue) error {
+		offset := nv.Offset.ToAcutalOffset()
+		needles[nv.Key] = data[offset : offset+needle.GetActualSize(nv.Size, needle.Version3)]
+		return nil
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return needles
+}
+
+func tempDirs(tb testing.TB) (srcDir, dstDir string) {
+	tb.Helper()
+	dir, err := ioutil.TempDir("", "rewrite")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	srcDir, dstDir = path.Join(dir, "src"), path.Join(dir, "dst")
+	for _, d := range []string{srcDir, dstDir} {
+		if err = os.MkdirAll(d, 0755); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	return
+}
+
+func dropOdd() Stage {
+	return Stage{
+		Name: "odd",
+		Drop: func(src *needle.Needle) bool {
+			return src.Id%2 == 1
+		},
+	}
+}
+
+func TestRawRewrite(t *testing.T) {
+	logrus.SetLevel(logrus.WarnLevel)
+	for _, scan := range []ScanMode{ScanSequential, ScanIndex} {
+		for _, stages := range [][]Stage{nil, {dropOdd()}} {
+			srcDir, dstDir := tempDirs(t)
+			v := generateVolume(t, srcDir, 100, 1000)
+			r := &Rewriter{Stages: stages, Raw: true, Scan: scan}
+			counter, err := r.Rewrite(v, dstDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			src := needleBytes(t, v.BaseFileName())
+			dst := needleBytes(t, path.Join(dstDir, path.Base(v.BaseFileName())))
+			if len(src) != 100 {
+				t.Fatalf("the generated volume has %d live needles, want 100", len(src))
+			}
+			if counter != int64(len(dst)) {
+				t.Errorf("%d needles written, but %d needles in the output", counter, len(dst))
+			}
+			for id, srcBytes := range src {
+				dropped := stages != nil && id%2 == 1
+				dstBytes, ok := dst[id]
+				if ok == dropped {
+					t.Errorf("scan %v, needle %v is kept: %v, want %v", scan, id, ok, !dropped)
+					continue
+				}
+				if ok && !bytes.Equal(srcBytes, dstBytes) {
+					t.Errorf("scan %v, needle %v is changed by the raw copy", scan, id)
+				}
+			}
+			if len(dst) > len(src) {
+				t.Errorf("scan %v, %d needles in the output, more than %d in the source", scan, len(dst), len(src))
+			}
+		}
+	}
+}
+
+// 修改needle id的一个数据字节, header和大小保持不变
+func corruptNeedle(tb testing.TB, v location.LocalVolume, id types.NeedleId) {
+	tb.Helper()
+	nm, err := needlemap.Load(v.BaseFileName()+".idx", 0, v.Dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	nv, ok := nm.Get(id)
+	nm.Close()
+	if !ok {
+		tb.Fatalf("needle %v is not found", id)
+	}
+	file, err := os.OpenFile(v.BaseFileName()+".dat", os.O_RDWR, 0644)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer file.Close()
+	b := make([]byte, 1)
+	// 跳过header和Version2的DataSize
+	at := nv.Offset.ToAcutalOffset() + types.NeedleHeaderSize + 4
+	if _, err = file.ReadAt(b, at); err != nil {
+		tb.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err = file.WriteAt(b, at); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestRewriteRejectsCorruptedNeedle(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	defer logrus.SetLevel(logrus.WarnLevel)
+	for _, scan := range []ScanMode{ScanSequential, ScanIndex} {
+		for _, raw := range []bool{false, true} {
+			srcDir, dstDir := tempDirs(t)
+			v := generateVolume(t, srcDir, 20, 100)
+			corruptNeedle(t, v, 5)
+			r := &Rewriter{Raw: raw, Scan: scan}
+			if _, err := r.Rewrite(v, dstDir); err == nil {
+				t.Errorf("scan %v, raw %v, the corrupted needle is copied", scan, raw)
+			}
+			if _, err := os.Stat(path.Join(dstDir, path.Base(v.BaseFileName())+".dat")); !os.IsNotExist(err) {
+				t.Errorf("scan %v, raw %v, the partial .dat is left behind", scan, raw)
+			}
+		}
+	}
+}
+
+func benchmarkRewrite(b *testing.B, raw bool) {
+	logrus.SetLevel(logrus.WarnLevel)
+	srcDir, dstDir := tempDirs(b)
+	v := generateVolume(b, srcDir, 2000, 16<<10)
+	r := &Rewriter{Stages: []Stage{dropOdd()}, Raw: raw, Scan: ScanSequential}
+	info, err := os.Stat(v.BaseFileName() + ".dat")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(info.Size())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = r.Rewrite(v, dstDir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRewriteRaw(b *testing.B) {
+	benchmarkRewrite(b, true)
+}
+
+func BenchmarkRewriteSerialize(b *testing.B) {
+	benchmarkRewrite(b, false)
+}
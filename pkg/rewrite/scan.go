@@ -0,0 +1,185 @@
+package rewrite
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/chrislusf/seaweedfs/weed/storage"
+	"github.com/chrislusf/seaweedfs/weed/storage/backend"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
+	"github.com/chrislusf/seaweedfs/weed/storage/super_block"
+	"github.com/chrislusf/seaweedfs/weed/storage/types"
+	"github.com/chrislusf/seaweedfs/weed/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/needlemap"
+)
+
+// ScanMode决定如何读取volume中的needle
+type ScanMode int
+
+const (
+	// 根据垃圾比例自动选择
+	ScanAuto ScanMode = iota
+	// 顺序读取整个.dat, 包括已经删除和被覆盖的needle
+	ScanSequential
+	// 按照.idx中live needle的offset顺序只读取live needle
+	ScanIndex
+)
+
+// 垃圾比例超过该值时自动选择ScanIndex
+const IndexScanGarbageRatio = 0.3
+
+func (m ScanMode) String() string {
+	switch m {
+	case ScanAuto:
+		return "auto"
+	case ScanSequential:
+		return "sequential"
+	case ScanIndex:
+		return "index"
+	}
+	return fmt.Sprintf("ScanMode(%d)", int(m))
+}
+
+// ParseScanMode parses auto, sequential or index.
+func ParseScanMode(s string) (ScanMode, error) {
+	for _, m := range []ScanMode{ScanAuto, ScanSequential, ScanIndex} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return ScanAuto, fmt.Errorf("unknown scan mode %s, expect auto, sequential or index", s)
+}
+
+// ScanVolume visits the needles of v with the scanner, nm must be loaded from the .idx of v.
+// In ScanIndex mode only the live needles in nm are visited, in the order of their offsets,
+// so the scanner sees the same live needles as in ScanSequential mode but never the deleted or overwritten ones.
+// In both modes the CRC of a live needle is verified before it is visited if the scanner reads needle bodies.
+func ScanVolume(v location.LocalVolume, nm needlemap.NeedleMap, mode ScanMode, scanner storage.VolumeFileScanner) error {
+	datFile := v.BaseFileName() + ".dat"
+	if mode == ScanAuto {
+		mode = ScanSequential
+		info, err := os.Stat(datFile)
+		if err != nil {
+			return err
+		}
+		liveSize, err := liveNeedlesSize(nm)
+		if err != nil {
+			return err
+		}
+		if dataSize := info.Size() - super_block.SuperBlockSize; dataSize > 0 {
+			ratio := 1 - float64(liveSize)/float64(dataSize)
+			if ratio > IndexScanGarbageRatio {
+				mode = ScanIndex
+			}
+			logrus.Debugf("%s has garbage ratio %.2f, scan in %s mode", datFile, ratio, mode)
+		}
+	}
+
+	if mode == ScanSequential {
+		// 已经删除和被覆盖的needle不检查CRC, scanner会跳过它们
+		err := storage.ScanVolumeFile(v.Dir, v.Collection, needle.VolumeId(v.Vid), storage.NeedleMapInMemory,
+			&checksumScanner{VolumeFileScanner: scanner, nm: nm})
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	}
+	return scanLiveNeedles(datFile, nm, scanner)
+}
+
+// VerifyChecksum compares the CRC of the needle data parsed from body with the one stored in body.
+func VerifyChecksum(n *needle.Needle, body []byte) error {
+	if int64(len(body)) < int64(n.Size)+needle.NeedleChecksumSize {
+		return fmt.Errorf("needle <%d> has a body of %d bytes, shorter than its size %d", n.Id, len(body), n.Size)
+	}
+	stored := util.BytesToUint32(body[n.Size : n.Size+needle.NeedleChecksumSize])
+	if crc := needle.NewCRC(n.Data).Value(); crc != stored {
+		return fmt.Errorf("needle <%d> has CRC %x, but %x is stored", n.Id, crc, stored)
+	}
+	return nil
+}
+
+// 顺序扫描时检查live needle的CRC
+type checksumScanner struct {
+	storage.VolumeFileScanner
+	nm needlemap.NeedleMap
+}
+
+func (scanner *checksumScanner) VisitNeedle(n *needle.Needle, offset int64, header, body []byte) error {
+	if scanner.ReadNeedleBody() {
+		nv, ok := scanner.nm.Get(n.Id)
+		if ok && nv.Size != 0 && nv.Size != types.TombstoneFileSize && nv.Offset.ToAcutalOffset() == offset {
+			if err := VerifyChecksum(n, body); err != nil {
+				return fmt.Errorf("corrupted needle at offset %d: %v", offset, err)
+			}
+		}
+	}
+	return scanner.VolumeFileScanner.VisitNeedle(n, offset, header, body)
+}
+
+func liveNeedlesSize(nm needlemap.NeedleMap) (int64, error) {
+	var size int64
+	err := nm.AscendingVisit(func(nv needle_map.NeedleValue) error {
+		if nv.Size == 0 || nv.Size == types.TombstoneFileSize || nv.Offset.IsZero() {
+			return nil
+		}
+		// 不同版本的needle大小差别只在padding, 这里按照Version3估算
+		size += needle.GetActualSize(nv.Size, needle.CurrentVersion)
+		return nil
+	})
+	return size, err
+}
+
+func scanLiveNeedles(datFile string, nm needlemap.NeedleMap, scanner storage.VolumeFileScanner) error {
+	file, err := os.Open(datFile)
+	if err != nil {
+		return err
+	}
+	datBackend := backend.NewDiskFile(file)
+	defer datBackend.Close()
+	superBlock, err := super_block.ReadSuperBlock(datBackend)
+	if err != nil {
+		return err
+	}
+	if err = scanner.VisitSuperBlock(superBlock); err != nil {
+		return err
+	}
+	version := superBlock.Version
+
+	err = nm.OffsetVisit(func(nv needle_map.NeedleValue) error {
+		offset := nv.Offset.ToAcutalOffset()
+		n, header, bodyLength, err := needle.ReadNeedleHeader(datBackend, version, offset)
+		if err != nil {
+			return fmt.Errorf("cannot read needle header at offset %d: %v", offset, err)
+		}
+		if n == nil {
+			return fmt.Errorf("cannot read needle header at offset %d: %v", offset, io.ErrUnexpectedEOF)
+		}
+		if n.Id != nv.Key || n.Size != nv.Size {
+			return fmt.Errorf("needle at offset %d is <%d> with size %d, but the index has <%d> with size %d",
+				offset, n.Id, n.Size, nv.Key, nv.Size)
+		}
+		var body []byte
+		if scanner.ReadNeedleBody() {
+			if body, err = n.ReadNeedleBody(datBackend, version, offset+types.NeedleHeaderSize, bodyLength); err != nil {
+				return fmt.Errorf("cannot read needle body at offset %d: %v", offset, err)
+			}
+			if err = VerifyChecksum(n, body); err != nil {
+				return fmt.Errorf("corrupted needle at offset %d: %v", offset, err)
+			}
+		}
+		if err = scanner.VisitNeedle(n, offset, header, body); err != nil && err != io.EOF {
+			return fmt.Errorf("visit needle error: %v", err)
+		}
+		return err
+	})
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
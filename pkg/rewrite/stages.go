@@ -0,0 +1,43 @@
+package rewrite
+
+import (
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/filter"
+	myutils "github.com/amazingchow/seaweedfs-tools/pkg/utils"
+)
+
+// 常用的Stage
+
+// NewerThan drops the needles whose LastModified is before newerThanUnix, the needles without LastModified are kept.
+func NewerThan(newerThanUnix int64) Stage {
+	return Stage{
+		Name: "newer",
+		Drop: func(src *needle.Needle) bool {
+			return src.HasLastModifiedDate() && src.LastModified < uint64(newerThanUnix)
+		},
+	}
+}
+
+// DropMatching drops the needles matching the filter expression.
+func DropMatching(expr filter.Expr) Stage {
+	return Stage{
+		Name: "drop " + expr.String(),
+		Drop: func(src *needle.Needle) bool {
+			return expr.Match(src, time.Now())
+		},
+	}
+}
+
+// Encrypt encrypts the needle data with the cipher key.
+func Encrypt(ck myutils.CipherKey) Stage {
+	return Stage{
+		Name: "encrypt",
+		Transform: func(src, dst *needle.Needle) (err error) {
+			dst.Data, err = myutils.Encrypt(src.Data, ck)
+			return
+		},
+	}
+}
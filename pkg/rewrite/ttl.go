@@ -0,0 +1,81 @@
+package rewrite
+
+import (
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+)
+
+// 与seaweedfs读取needle时的判断一致, needle在LastModified+Ttl之后过期,
+// 没有LastModified的needle使用AppendAtNs计算.
+
+// ExpiresAt returns the unix time when the needle expires, false if the needle never expires.
+func ExpiresAt(n *needle.Needle) (int64, bool) {
+	if !n.HasTtl() || n.Ttl == nil || n.Ttl.Minutes() == 0 {
+		return 0, false
+	}
+	var base int64
+	switch {
+	case n.HasLastModifiedDate() && n.LastModified > 0:
+		base = int64(n.LastModified)
+	case n.AppendAtNs > 0:
+		base = int64(n.AppendAtNs / uint64(time.Second))
+	default:
+		return 0, false
+	}
+	return base + int64(n.Ttl.Minutes())*60, true
+}
+
+// Expired reports whether the needle has expired at now.
+func Expired(n *needle.Needle, now time.Time) bool {
+	expiresAt, ok := ExpiresAt(n)
+	return ok && now.Unix() >= expiresAt
+}
+
+// DropExpired drops the needles which have expired.
+func DropExpired() Stage {
+	return Stage{
+		Name: "expired",
+		Drop: func(src *needle.Needle) bool {
+			return Expired(src, time.Now())
+		},
+	}
+}
+
+// copyTtl sets the ttl of dst so that it expires at the same time as src,
+// the ttl keeps the unit of src and is rounded up, dst.LastModified must be set.
+func copyTtl(src, dst *needle.Needle) {
+	dst.Ttl = needle.EMPTY_TTL
+	expiresAt, ok := ExpiresAt(src)
+	if !ok {
+		return
+	}
+	dst.Ttl = &needle.TTL{Count: src.Ttl.Count, Unit: src.Ttl.Unit}
+	dst.SetHasTtl()
+
+	unitSeconds := int64(src.Ttl.Minutes()/uint32(src.Ttl.Count)) * 60
+	count := (expiresAt - int64(dst.LastModified) + unitSeconds - 1) / unitSeconds
+	if count <= 0 {
+		// 已经过期但是被保留的needle, 保留原来的ttl
+		return
+	}
+	if count > 255 {
+		count = 255
+	}
+	dst.Ttl.Count = byte(count)
+}
+
+// volumeTtl returns the superblock ttl of a rewritten volume whose needles expire no later than expiresAt,
+// the ttl keeps the unit of ttl, is rounded up and never exceeds ttl.
+// 重写后.dat的修改时间变为now, volume在修改时间+ttl之后整体过期, 保留原来的ttl会延长volume的寿命.
+func volumeTtl(ttl *needle.TTL, expiresAt int64, now time.Time) *needle.TTL {
+	if ttl == nil || ttl.Minutes() == 0 || expiresAt <= now.Unix() {
+		return ttl
+	}
+	unitSeconds := int64(needle.TTL{Count: 1, Unit: ttl.Unit}.Minutes()) * 60
+	count := (expiresAt - now.Unix() + unitSeconds - 1) / unitSeconds
+	if count >= int64(ttl.Count) {
+		return ttl
+	}
+	return &needle.TTL{Count: byte(count), Unit: ttl.Unit}
+}
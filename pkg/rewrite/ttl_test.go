@@ -0,0 +1,147 @@
+package rewrite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+)
+
+const (
+	minute = int64(60)
+	hour   = 60 * minute
+	day    = 24 * hour
+)
+
+func ttlNeedle(lastModified int64, count, unit byte) *needle.Needle {
+	n := &needle.Needle{LastModified: uint64(lastModified), Ttl: &needle.TTL{Count: count, Unit: unit}}
+	n.SetHasLastModifiedDate()
+	n.SetHasTtl()
+	return n
+}
+
+func TestCopyTtl(t *testing.T) {
+	base := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC).Unix()
+	cases := []struct {
+		name string
+		src  *needle.Needle
+		// 重写后的needle的LastModified与src的LastModified之差
+		delay int64
+		want  needle.TTL
+	}{
+		{"minute", ttlNeedle(base, 10, needle.Minute), 3 * minute, needle.TTL{Count: 7, Unit: needle.Minute}},
+		{"minute rounded up", ttlNeedle(base, 10, needle.Minute), 150, needle.TTL{Count: 8, Unit: needle.Minute}},
+		{"hour", ttlNeedle(base, 5, needle.Hour), 2 * hour, needle.TTL{Count: 3, Unit: needle.Hour}},
+		{"hour rounded up", ttlNeedle(base, 5, needle.Hour), 90 * minute, needle.TTL{Count: 4, Unit: needle.Hour}},
+		{"day", ttlNeedle(base, 3, needle.Day), 0, needle.TTL{Count: 3, Unit: needle.Day}},
+		{"day rounded up", ttlNeedle(base, 3, needle.Day), 1, needle.TTL{Count: 3, Unit: needle.Day}},
+		{"week", ttlNeedle(base, 4, needle.Week), 7 * day, needle.TTL{Count: 3, Unit: needle.Week}},
+		{"week rounded up", ttlNeedle(base, 4, needle.Week), 8 * day, needle.TTL{Count: 3, Unit: needle.Week}},
+		{"month", ttlNeedle(base, 6, needle.Month), 62 * day, needle.TTL{Count: 4, Unit: needle.Month}},
+		{"month rounded up", ttlNeedle(base, 6, needle.Month), 30 * day, needle.TTL{Count: 6, Unit: needle.Month}},
+		{"year", ttlNeedle(base, 2, needle.Year), 365 * day, needle.TTL{Count: 1, Unit: needle.Year}},
+		{"year rounded up", ttlNeedle(base, 2, needle.Year), 400 * day, needle.TTL{Count: 1, Unit: needle.Year}},
+		{"at most 255", ttlNeedle(base, 200, needle.Day), -100 * day, needle.TTL{Count: 255, Unit: needle.Day}},
+		// 已经过期但是被保留(-keep_expired)的needle保留原来的ttl
+		{"expired at rewrite", ttlNeedle(base, 1, needle.Day), day, needle.TTL{Count: 1, Unit: needle.Day}},
+		{"expired long ago", ttlNeedle(base, 10, needle.Minute), 30 * day, needle.TTL{Count: 10, Unit: needle.Minute}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dst := &needle.Needle{LastModified: uint64(base + c.delay)}
+			dst.SetHasLastModifiedDate()
+			copyTtl(c.src, dst)
+			if !dst.HasTtl() || dst.Ttl == nil || *dst.Ttl != c.want {
+				t.Fatalf("ttl is %v (has ttl %v), want %s", dst.Ttl, dst.HasTtl(), c.want.String())
+			}
+			if c.want.Count == 255 || c.want == *c.src.Ttl {
+				return
+			}
+			// 向上取整, 重写后的needle不会早于原来的needle过期, 最多晚一个单位
+			srcExpiresAt, _ := ExpiresAt(c.src)
+			dstExpiresAt, _ := ExpiresAt(dst)
+			unit := int64(needle.TTL{Count: 1, Unit: c.want.Unit}.Minutes()) * 60
+			if dstExpiresAt < srcExpiresAt || dstExpiresAt >= srcExpiresAt+unit {
+				t.Errorf("expires at %d, want in [%d, %d)", dstExpiresAt, srcExpiresAt, srcExpiresAt+unit)
+			}
+		})
+	}
+}
+
+func TestCopyTtlFromAppendAtNs(t *testing.T) {
+	base := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	// 没有LastModified的needle使用AppendAtNs计算过期时间
+	src := &needle.Needle{AppendAtNs: uint64(base.UnixNano()), Ttl: &needle.TTL{Count: 3, Unit: needle.Hour}}
+	src.SetHasTtl()
+	dst := &needle.Needle{LastModified: uint64(base.Unix() + hour)}
+	dst.SetHasLastModifiedDate()
+	copyTtl(src, dst)
+	if want := (needle.TTL{Count: 2, Unit: needle.Hour}); dst.Ttl == nil || *dst.Ttl != want {
+		t.Errorf("ttl is %v, want %s", dst.Ttl, want.String())
+	}
+}
+
+func TestCopyTtlWithoutTtl(t *testing.T) {
+	for _, src := range []*needle.Needle{
+		{LastModified: 1},
+		// 有ttl但是无法计算过期时间
+		{Ttl: &needle.TTL{Count: 3, Unit: needle.Day}},
+		// ttl为空
+		{LastModified: 1, Ttl: needle.EMPTY_TTL},
+	} {
+		if src.Ttl != nil {
+			src.SetHasTtl()
+		}
+		if src.LastModified > 0 {
+			src.SetHasLastModifiedDate()
+		}
+		dst := &needle.Needle{LastModified: 100}
+		dst.SetHasLastModifiedDate()
+		copyTtl(src, dst)
+		if dst.HasTtl() || dst.Ttl != needle.EMPTY_TTL {
+			t.Errorf("copyTtl(%+v) sets ttl %v", src, dst.Ttl)
+		}
+	}
+}
+
+func TestVolumeTtl(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	ttl := &needle.TTL{Count: 10, Unit: needle.Day}
+	cases := []struct {
+		name string
+		ttl  *needle.TTL
+		// 最晚的needle过期时间与now之差
+		remaining int64
+		want      *needle.TTL
+	}{
+		{"shortened", ttl, 3 * day, &needle.TTL{Count: 3, Unit: needle.Day}},
+		{"rounded up", ttl, 3*day + 1, &needle.TTL{Count: 4, Unit: needle.Day}},
+		{"at most the original", ttl, 12 * day, ttl},
+		{"same as the original", ttl, 10 * day, ttl},
+		{"expired", ttl, 0, ttl},
+		{"hour", &needle.TTL{Count: 24, Unit: needle.Hour}, 90 * minute, &needle.TTL{Count: 2, Unit: needle.Hour}},
+		{"no ttl", needle.EMPTY_TTL, day, needle.EMPTY_TTL},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := volumeTtl(c.ttl, now.Unix()+c.remaining, now)
+			if *got != *c.want {
+				t.Errorf("ttl is %s, want %s", got.String(), c.want.String())
+			}
+		})
+	}
+}
+
+func TestCopyNeedleKeepsExpiry(t *testing.T) {
+	base := time.Now().Add(-30 * 24 * time.Hour)
+	// 没有LastModified并且已经过期的needle, 保留(-keep_expired)后仍然是过期的
+	src := &needle.Needle{AppendAtNs: uint64(base.UnixNano()), Ttl: &needle.TTL{Count: 3, Unit: needle.Day}}
+	src.SetHasTtl()
+	dst := CopyNeedle(src)
+	if dst.LastModified != uint64(base.Unix()) {
+		t.Errorf("LastModified is %d, want %d from AppendAtNs", dst.LastModified, base.Unix())
+	}
+	if !Expired(dst, time.Now()) {
+		t.Errorf("the expired needle is revived with ttl %s", dst.Ttl.String())
+	}
+}
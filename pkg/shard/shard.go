@@ -0,0 +1,144 @@
+package shard
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+)
+
+// 多台备份机器之间分摊volume, 每台机器只备份分配给自己的volume, 无需中心化协调.
+// backup和lag等工具使用相同的分片参数, 看到的是同一组volume.
+type Sharding struct {
+	Index int
+	Count int
+	// 可选, 第i个元素为第i个分片所在的备份机器, 仅用于展示
+	Hosts []string
+	// 可选, 只备份在这些数据中心中有副本的volume
+	DataCenters map[string]bool
+}
+
+func NewSharding(index, count int, hosts, dataCenters string) (*Sharding, error) {
+	s := &Sharding{Index: index, Count: count, DataCenters: make(map[string]bool)}
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			s.Hosts = append(s.Hosts, host)
+		}
+	}
+	for _, dc := range strings.Split(dataCenters, ",") {
+		if dc = strings.TrimSpace(dc); dc != "" {
+			s.DataCenters[dc] = true
+		}
+	}
+	if len(s.Hosts) > 0 && s.Count != len(s.Hosts) {
+		return nil, fmt.Errorf("shard count %d does not match %d shard hosts", s.Count, len(s.Hosts))
+	}
+	if s.Count < 1 || s.Index < 0 || s.Index >= s.Count {
+		return nil, fmt.Errorf("invalid shard index %d for shard count %d", s.Index, s.Count)
+	}
+	return s, nil
+}
+
+// Owner returns the shard which the volume is assigned to. It uses jump consistent hash,
+// so when a new shard is appended only the volumes moving to the new shard are reassigned.
+func (s *Sharding) Owner(collection string, vid uint32) int {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(collection))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(strconv.FormatUint(uint64(vid), 10)))
+	return jumpHash(h.Sum64(), s.Count)
+}
+
+func (s *Sharding) OwnerName(shard int) string {
+	if shard < len(s.Hosts) {
+		return s.Hosts[shard]
+	}
+	return "shard-" + strconv.Itoa(shard)
+}
+
+// Filter keeps the volumes owned by this shard, duplicated volume ids reported by
+// different replicas are merged.
+func (s *Sharding) Filter(collectionMap map[string][]uint32, dcMap map[uint32][]string) map[string][]uint32 {
+	owned := make(map[string][]uint32)
+	for collection, vids := range collectionMap {
+		seen := make(map[uint32]bool)
+		for _, vid := range vids {
+			if seen[vid] {
+				continue
+			}
+			seen[vid] = true
+			if s.Owner(collection, vid) != s.Index || !s.inDataCenters(dcMap[vid]) {
+				continue
+			}
+			owned[collection] = append(owned[collection], vid)
+		}
+	}
+	return owned
+}
+
+func (s *Sharding) inDataCenters(dcs []string) bool {
+	if len(s.DataCenters) == 0 {
+		return true
+	}
+	for _, dc := range dcs {
+		if s.DataCenters[dc] {
+			return true
+		}
+	}
+	return false
+}
+
+// PrintStatus writes the owner of every volume into w.
+func (s *Sharding) PrintStatus(w io.Writer, collectionMap map[string][]uint32, dcMap map[uint32][]string, locations *location.DiskLocations) error {
+	type row struct {
+		collection string
+		vid        uint32
+	}
+	var rows []row
+	for collection, vids := range collectionMap {
+		seen := make(map[uint32]bool)
+		for _, vid := range vids {
+			if !seen[vid] {
+				seen[vid] = true
+				rows = append(rows, row{collection, vid})
+			}
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].collection != rows[j].collection {
+			return rows[i].collection < rows[j].collection
+		}
+		return rows[i].vid < rows[j].vid
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTION\tVOLUME\tDATA CENTERS\tOWNER\tLOCAL DIR")
+	for _, r := range rows {
+		owner := s.OwnerName(s.Owner(r.collection, r.vid))
+		if !s.inDataCenters(dcMap[r.vid]) {
+			owner = "-"
+		}
+		localDir := "-"
+		if dir, ok := locations.Find(r.collection, r.vid); ok {
+			localDir = dir
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", r.collection, r.vid, strings.Join(dcMap[r.vid], ","), owner, localDir)
+	}
+	return tw.Flush()
+}
+
+// jumpHash is the jump consistent hash from "A Fast, Minimal Memory, Consistent Hash Algorithm".
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
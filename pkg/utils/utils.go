@@ -1,6 +1,11 @@
 package pkg
 
 import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
 	"github.com/chrislusf/seaweedfs/weed/pb/master_pb"
 )
 
@@ -31,3 +36,75 @@ func CollectVolumeInfo(topo *master_pb.TopologyInfo, canWriteOnly bool) map[stri
 	}
 	return m
 }
+
+// CollectEcVolumeInfo returns the erasure coded volumes of each collection, they only show up as ec shards.
+func CollectEcVolumeInfo(topo *master_pb.TopologyInfo) map[string][]uint32 {
+	m := make(map[string][]uint32)
+	for _, dc := range topo.DataCenterInfos {
+		for _, r := range dc.RackInfos {
+			for _, dn := range r.DataNodeInfos {
+				for _, shard := range dn.EcShardInfos {
+					m[shard.Collection] = append(m[shard.Collection], shard.Id)
+				}
+			}
+		}
+	}
+	return m
+}
+
+// CollectVolumeDataCenters returns the data centers which hold a replica of each volume.
+func CollectVolumeDataCenters(topo *master_pb.TopologyInfo) map[uint32][]string {
+	m := make(map[uint32][]string)
+	for _, dc := range topo.DataCenterInfos {
+		for _, r := range dc.RackInfos {
+			for _, dn := range r.DataNodeInfos {
+				for _, v := range dn.VolumeInfos {
+					found := false
+					for _, id := range m[v.Id] {
+						if id == dc.Id {
+							found = true
+							break
+						}
+					}
+					if !found {
+						m[v.Id] = append(m[v.Id], dc.Id)
+					}
+				}
+			}
+		}
+	}
+	return m
+}
+
+// CollectVolumeVersions returns the needle version of each volume.
+func CollectVolumeVersions(topo *master_pb.TopologyInfo) map[uint32]uint32 {
+	m := make(map[uint32]uint32)
+	for _, dc := range topo.DataCenterInfos {
+		for _, r := range dc.RackInfos {
+			for _, dn := range r.DataNodeInfos {
+				for _, v := range dn.VolumeInfos {
+					m[v.Id] = v.Version
+				}
+			}
+		}
+	}
+	return m
+}
+
+// ParseVolumeFileName parses the collection and volume id from a volume file name
+// like "collection_vid.dat" or "vid.dat", the collection itself may contain underscores.
+func ParseVolumeFileName(filename string) (collection string, vid uint32, err error) {
+	base := filepath.Base(filename)
+	if ext := filepath.Ext(base); ext != "" {
+		base = strings.TrimSuffix(base, ext)
+	}
+	idString := base
+	if i := strings.LastIndex(base, "_"); i >= 0 {
+		collection, idString = base[:i], base[i+1:]
+	}
+	id, err := strconv.ParseUint(idString, 10, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid volume file name %s", filename)
+	}
+	return collection, uint32(id), nil
+}
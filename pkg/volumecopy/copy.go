@@ -0,0 +1,122 @@
+package volumecopy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/chrislusf/seaweedfs/weed/operation"
+	"github.com/chrislusf/seaweedfs/weed/pb/volume_server_pb"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+const (
+	// 拷贝过程中的临时文件后缀, 拷贝完成后重命名
+	CopyingSuffix = ".copying"
+	vifStopOffset = 1024 * 1024
+)
+
+// File is one file of a volume to copy, the copy stops at StopOffset.
+type File struct {
+	Ext        string
+	StopOffset uint64
+	Optional   bool
+}
+
+// Copy fetches the .dat, .idx and .vif files of a volume into baseFileName through the CopyFile stream.
+// It is much faster than replaying every needle with IncrementalBackup, the returned status is
+// the one the copy stopped at.
+func Copy(volumeServer string, grpcDialOption grpc.DialOption, baseFileName, collection string, volumeId uint32) (*volume_server_pb.ReadVolumeFileStatusResponse, error) {
+	var status *volume_server_pb.ReadVolumeFileStatusResponse
+	err := operation.WithVolumeServerClient(volumeServer, grpcDialOption, func(client volume_server_pb.VolumeServerClient) error {
+		var err error
+		status, err = client.ReadVolumeFileStatus(context.Background(), &volume_server_pb.ReadVolumeFileStatusRequest{
+			VolumeId: volumeId,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read volume <%d> file status, err: %v", volumeId, err)
+		}
+
+		// .dat在.idx之前拷贝, 保证.idx中的每条记录指向的数据都已经在.dat中
+		files := []File{
+			{Ext: ".dat", StopOffset: status.DatFileSize},
+			{Ext: ".idx", StopOffset: status.IdxFileSize},
+			{Ext: ".vif", StopOffset: vifStopOffset, Optional: true},
+		}
+		var copied []string
+		defer func() {
+			for _, ext := range copied {
+				_ = os.Remove(baseFileName + ext + CopyingSuffix)
+			}
+		}()
+		for _, f := range files {
+			copied = append(copied, f.Ext)
+			written, err := CopyFile(client, collection, volumeId, status.CompactionRevision, f, baseFileName+f.Ext+CopyingSuffix)
+			if err != nil {
+				return fmt.Errorf("failed to copy volume <%d> %s file, err: %v", volumeId, f.Ext, err)
+			}
+			if !f.Optional && written != f.StopOffset {
+				return fmt.Errorf("volume <%d> %s file is incomplete, copied %d of %d bytes", volumeId, f.Ext, written, f.StopOffset)
+			}
+			logrus.Debugf("copied %d bytes into %s%s", written, baseFileName, f.Ext)
+		}
+
+		for _, f := range files {
+			tmpFile := baseFileName + f.Ext + CopyingSuffix
+			if f.Optional {
+				if info, err := os.Stat(tmpFile); err == nil && info.Size() == 0 {
+					continue
+				}
+			}
+			if err = os.Rename(tmpFile, baseFileName+f.Ext); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// CopyFile streams one file of a volume into filename and returns the number of bytes written.
+func CopyFile(client volume_server_pb.VolumeServerClient, collection string, volumeId uint32, compactionRevision uint32,
+	f File, filename string) (uint64, error) {
+	stream, err := client.CopyFile(context.Background(), &volume_server_pb.CopyFileRequest{
+		VolumeId:                 volumeId,
+		Ext:                      f.Ext,
+		CompactionRevision:       compactionRevision,
+		StopOffset:               f.StopOffset,
+		Collection:               collection,
+		IgnoreSourceFileNotFound: f.Optional,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var written uint64
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+		n, err := file.Write(resp.FileContent)
+		if err != nil {
+			return written, err
+		}
+		written += uint64(n)
+	}
+	return written, file.Sync()
+}
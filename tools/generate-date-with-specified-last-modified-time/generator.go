@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/rewrite"
+)
+
+// 将needle的LastModified替换为time-server生成的假时间戳
+type FakeTimestampGenerator struct {
+	shouldBeDeleted int64
+	httpClient      *http.Client
+
+	OlderThan int64
+}
+
+func (g *FakeTimestampGenerator) PrepareHttpClient() {
+	g.httpClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 10 * time.Second,
+				DualStack: true,
+			}).DialContext,
+			MaxIdleConns:          50,
+			MaxIdleConnsPerHost:   5,
+			IdleConnTimeout:       1 * time.Hour,
+			ResponseHeaderTimeout: 5 * time.Second,
+			DisableCompression:    true,
+		},
+	}
+}
+
+func (g *FakeTimestampGenerator) Stage() rewrite.Stage {
+	return rewrite.Stage{
+		Name: "fake timestamp",
+		Transform: func(src, dst *needle.Needle) error {
+			timestamp, _ := g.FetchFakeTimestamp()
+			dst.LastModified = uint64(timestamp)
+			if g.OlderThan >= 0 && src.HasLastModifiedDate() && dst.LastModified < uint64(g.OlderThan) {
+				g.shouldBeDeleted++
+			}
+			return nil
+		},
+	}
+}
+
+func (g *FakeTimestampGenerator) ShouldBeDeleted() int64 {
+	return g.shouldBeDeleted
+}
@@ -2,16 +2,12 @@ package main
 
 import (
 	param_parser "flag"
-	"io"
-	"os"
-	"path"
-	"strconv"
 	"time"
 
-	"github.com/chrislusf/seaweedfs/weed/storage"
-	"github.com/chrislusf/seaweedfs/weed/storage/needle"
-	"github.com/chrislusf/seaweedfs/weed/storage/needle_map"
 	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/seaweedfs-tools/pkg/location"
+	"github.com/amazingchow/seaweedfs-tools/pkg/rewrite"
 )
 
 var (
@@ -66,49 +62,15 @@ func main() {
 	}
 	olderThanUnix := olderThan.Unix()
 
-	// 只需生成.idx文件和.dat文件, 可以复用原先的.vif文件
-	filename := *_Collection + "_" + strconv.Itoa(*_VolumeId)
-	idxFile := filename + ".idx"
-	datFile := filename + ".dat"
-
-	// needle map缓存needle索引信息, key = []byte(NeedleId), value = []byte(Offset + Size)
-	srcNM := needle_map.NewMemDb()
-	defer srcNM.Close()
-	if err = srcNM.LoadFromIdx(path.Join(*_SrcDir, idxFile)); err != nil {
-		logrus.Fatalf("failed to load needle map from %s, err: %v", path.Join(*_SrcDir, idxFile), err)
-	}
-	dstNM := needle_map.NewMemDb()
-	defer dstNM.Close()
-
-	logrus.Infof("ready to parse %s", path.Join(*_SrcDir, datFile))
-
-	vid := needle.VolumeId(*_VolumeId)
-	volumeFileScanner := &VolumeFileScanner4Transformer{
-		SrcNeedleMap: srcNM,
-		DstNeedleMap: dstNM,
-		DstDataFile:  path.Join(*_DstDir, datFile),
-		OlderThan:    olderThanUnix,
-	}
-	volumeFileScanner.PrepareHttpClient()
-
-	err = storage.ScanVolumeFile(*_SrcDir, *_Collection, vid, storage.NeedleMapInMemory, volumeFileScanner)
-	if err != nil && err != io.EOF {
-		if volumeFileScanner.ExitErr != ErrCreateDataFile {
-			volumeFileScanner.Close()
-			_ = os.Remove(path.Join(*_DstDir, datFile))
-		}
-		logrus.Fatalf("failed to scan %s, err: %v", path.Join(*_SrcDir, datFile), err)
-	}
-	volumeFileScanner.Close()
-
-	// 生成新的.idx文件
-	if err = dstNM.SaveToIdx(path.Join(*_DstDir, idxFile)); err != nil {
-		logrus.Fatalf("failed to save needle map to %s, err: %v", path.Join(*_DstDir, idxFile), err)
-		_ = os.Remove(path.Join(*_DstDir, idxFile))
-		_ = os.Remove(path.Join(*_DstDir, datFile))
+	v := location.LocalVolume{Dir: *_SrcDir, Collection: *_Collection, Vid: uint32(*_VolumeId)}
+	generator := &FakeTimestampGenerator{OlderThan: olderThanUnix}
+	generator.PrepareHttpClient()
+	rewriter := &rewrite.Rewriter{Stages: []rewrite.Stage{generator.Stage()}}
+	counter, err := rewriter.Rewrite(v, *_DstDir)
+	if err != nil {
+		logrus.Fatal(err)
 	}
 
-	logrus.Infof("finish to parse %s", path.Join(*_SrcDir, datFile))
-	logrus.Infof("totally processed %d needles", volumeFileScanner.Counter())
-	logrus.Infof("there are %d needles should be deleted", volumeFileScanner.ShouldBeDeleted())
+	logrus.Infof("totally processed %d needles", counter)
+	logrus.Infof("there are %d needles should be deleted", generator.ShouldBeDeleted())
 }
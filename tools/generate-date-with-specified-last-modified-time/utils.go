@@ -13,8 +13,8 @@ type TimeResponse struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
-func (scanner *VolumeFileScanner4Transformer) FetchFakeTimestamp() (int64, error) {
-	resp, err := scanner.httpClient.Get("http://127.0.0.1:5000/random_timestamp?passed=90")
+func (g *FakeTimestampGenerator) FetchFakeTimestamp() (int64, error) {
+	resp, err := g.httpClient.Get("http://127.0.0.1:5000/random_timestamp?passed=90")
 	if err != nil {
 		logrus.WithError(err).Error("failed to fetch fake timestamp")
 		return time.Now().Unix(), err